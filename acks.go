@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/sftp"
+	"gopkg.in/ini.v1"
+)
+
+// ackEntry is an uploaded file whose source is kept until the receiver
+// acknowledges it.
+type ackEntry struct {
+	remotePath string
+	uploaded   time.Time
+	nextCheck  time.Time
+	// overdue is set once the missing acknowledgment was alerted
+	overdue bool
+}
+
+// pendingAcks holds the uploaded files waiting for their acknowledgment. It
+// is only used from the main goroutine.
+var pendingAcks = map[string]*ackEntry{}
+
+// loadAcks reads the acknowledgment settings from [server].
+func loadAcks(section *ini.Section, config *Config) error {
+	config.AckFolder = section.Key("AckFolder").String()
+	if config.AckFolder == "" {
+		return nil
+	}
+	config.AckSuffix = section.Key("AckSuffix").MustString(".ack")
+	config.AckTimeout = section.Key("AckTimeout").MustDuration(24 * time.Hour)
+	config.AckPollInterval = time.Duration(section.Key("AckPollSeconds").MustInt(30)) * time.Second
+	if config.AckTimeout <= 0 || config.AckPollInterval <= 0 {
+		return fmt.Errorf("AckTimeout and AckPollSeconds must be positive")
+	}
+	return nil
+}
+
+// awaitAck keeps the uploaded source file path in place until
+// "<AckFolder>/<remote name><AckSuffix>" shows up on the server. The upload
+// stays recorded in the state file meanwhile, so a restart neither uploads
+// the file again nor lets go of it early.
+func awaitAck(path, remotePath string, uploaded time.Time, config *Config) {
+	if _, waiting := pendingAcks[path]; waiting {
+		return
+	}
+	pendingAcks[path] = &ackEntry{remotePath: remotePath, uploaded: uploaded, overdue: state.ackOverdue(path)}
+	slog.Info("Waiting for the receiver's acknowledgment before archiving", "file", path, "ack", ackPath(remotePath, config))
+}
+
+func ackPath(remotePath string, config *Config) string {
+	return path.Join(config.AckFolder, path.Base(remotePath)+config.AckSuffix)
+}
+
+// checkAcks finishes the files whose acknowledgment arrived and alerts once
+// for those that were not acknowledged within AckTimeout. Unacknowledged
+// files stay in the watch folder and are still finished when the
+// acknowledgment arrives late.
+func checkAcks(sftpClient *sftp.Client, config *Config) {
+	now := time.Now()
+	for localPath, entry := range pendingAcks {
+		if now.Before(entry.nextCheck) {
+			continue
+		}
+		entry.nextCheck = now.Add(config.AckPollInterval)
+
+		_, err := sftpClient.Stat(ackPath(entry.remotePath, config))
+		if err == nil {
+			delete(pendingAcks, localPath)
+			if entry.overdue {
+				slog.Info("Late acknowledgment arrived", "file", localPath, "after", now.Sub(entry.uploaded).Round(time.Second))
+			}
+			err = finishAcknowledged(localPath, config)
+			if err != nil {
+				slog.Error("Failed to archive acknowledged file", "file", localPath, "error", err)
+			}
+			continue
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Failed to check for acknowledgment", "file", localPath, "ack", ackPath(entry.remotePath, config), "error", err)
+		}
+		if !entry.overdue && now.Sub(entry.uploaded) >= config.AckTimeout {
+			entry.overdue = true
+			err = state.markAckOverdue(localPath)
+			if err != nil {
+				slog.Warn("Failed to record overdue acknowledgment in state file", "file", localPath, "error", err)
+			}
+			alert(fmt.Sprintf("No acknowledgment for %s within %s, the file stays in place. Expected %s", localPath, config.AckTimeout, ackPath(entry.remotePath, config)))
+		}
+	}
+}
+
+// finishAcknowledged applies the post-upload action to an acknowledged file.
+func finishAcknowledged(localPath string, config *Config) error {
+	file, err := os.Open(localPath)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Info("Acknowledged file is already gone", "file", localPath)
+		return state.forgetUploaded(localPath)
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	slog.Info("Upload acknowledged by the receiver", "file", localPath)
+	return finishRecordedFile(localPath, file, config)
+}
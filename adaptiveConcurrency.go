@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	// adaptiveMinSample is the least an upload must send to count as a
+	// throughput sample. Smaller files are dominated by the round trips to
+	// open and close them.
+	adaptiveMinSample = 1 << 20
+	// adaptiveProbeEvery is after how many samples at a steady rate the
+	// controller tries one step more, in case the link got faster.
+	adaptiveProbeEvery = 10
+)
+
+// uploadConcurrency is the number of write requests in flight per upload
+// with AdaptiveConcurrency. The heartbeat reads it, it is only changed from
+// the main goroutine.
+var uploadConcurrency atomic.Int64
+
+// adaptiveState is what the controller learned from the previous samples.
+// It is only used from the main goroutine.
+var adaptiveState struct {
+	lastRate float64
+	steady   int
+}
+
+// loadAdaptiveConcurrency reads AdaptiveConcurrency, MinConcurrency and
+// MaxConcurrency from [server].
+func loadAdaptiveConcurrency(section *ini.Section, config *Config) error {
+	config.AdaptiveConcurrency = section.Key("AdaptiveConcurrency").MustBool(false)
+	config.MinConcurrency = section.Key("MinConcurrency").MustInt(1)
+	config.MaxConcurrency = section.Key("MaxConcurrency").MustInt(64)
+	if !config.AdaptiveConcurrency {
+		return nil
+	}
+	if config.MinConcurrency < 1 || config.MaxConcurrency < config.MinConcurrency {
+		return fmt.Errorf("MinConcurrency must be at least 1 and at most MaxConcurrency, got %d and %d", config.MinConcurrency, config.MaxConcurrency)
+	}
+	return nil
+}
+
+// currentConcurrency returns how many write requests the next upload may
+// have in flight. The controller starts at MinConcurrency.
+func currentConcurrency(config *Config) int {
+	level := int(uploadConcurrency.Load())
+	if level == 0 {
+		level = config.MinConcurrency
+	}
+	return max(config.MinConcurrency, min(level, config.MaxConcurrency))
+}
+
+// adaptConcurrency feeds the outcome of an upload to the controller. A
+// write error halves the concurrency. Otherwise the rate is compared with
+// the previous sample: while more requests in flight make the upload faster
+// the concurrency keeps growing, when the rate drops it shrinks again.
+func adaptConcurrency(written int64, elapsed time.Duration, writeErr error, config *Config) {
+	level := currentConcurrency(config)
+	next := level
+	switch {
+	case writeErr != nil:
+		next = level / 2
+		adaptiveState.lastRate, adaptiveState.steady = 0, 0
+	case written < adaptiveMinSample || elapsed <= 0:
+		return
+	default:
+		rate := float64(written) / elapsed.Seconds()
+		step := max(1, level/4)
+		switch last := adaptiveState.lastRate; {
+		case last == 0 || rate > last*1.05:
+			next = level + step
+			adaptiveState.steady = 0
+		case rate < last*0.9:
+			next = level - step
+			adaptiveState.steady = 0
+		default:
+			adaptiveState.steady++
+			if adaptiveState.steady >= adaptiveProbeEvery {
+				next = level + step
+				adaptiveState.steady = 0
+			}
+		}
+		adaptiveState.lastRate = rate
+	}
+
+	next = max(config.MinConcurrency, min(next, config.MaxConcurrency))
+	if next != level {
+		slog.Debug("Upload concurrency changed", "from", level, "to", next, "afterError", writeErr != nil)
+	}
+	uploadConcurrency.Store(int64(next))
+}
+
+// parallelWriter writes a new remote file with up to n requests in flight.
+// The data is cut into packets that are each sent as a write at their own
+// offset, so at most n packets are held in memory.
+type parallelWriter struct {
+	f       *sftp.File
+	packet  int
+	offset  int64
+	slots   chan struct{}
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	err     error
+	written atomic.Int64
+}
+
+func newParallelWriter(f *sftp.File, n int, config *Config) *parallelWriter {
+	return &parallelWriter{f: f, packet: config.SftpMaxPacketKB * 1024, slots: make(chan struct{}, n)}
+}
+
+func (w *parallelWriter) Write(p []byte) (int, error) {
+	if err := w.firstError(); err != nil {
+		return 0, err
+	}
+	for start := 0; start < len(p); start += w.packet {
+		chunk := append([]byte(nil), p[start:min(start+w.packet, len(p))]...)
+		offset := w.offset
+		w.offset += int64(len(chunk))
+
+		w.slots <- struct{}{}
+		w.wg.Add(1)
+		go func() {
+			defer func() {
+				<-w.slots
+				w.wg.Done()
+			}()
+			n, err := w.f.WriteAt(chunk, offset)
+			w.written.Add(int64(n))
+			if err != nil {
+				w.mu.Lock()
+				if w.err == nil {
+					w.err = err
+				}
+				w.mu.Unlock()
+			}
+		}()
+	}
+	return len(p), nil
+}
+
+func (w *parallelWriter) firstError() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// wait waits for the writes in flight and returns the first error.
+func (w *parallelWriter) wait() error {
+	w.wg.Wait()
+	return w.firstError()
+}
+
+// adaptiveUpload wraps the write of an upload so it goes out with the
+// current concurrency and its outcome is fed back to the controller.
+func adaptiveUpload(w io.Writer, write func(io.Writer) error, config *Config) error {
+	f, ok := w.(*sftp.File)
+	if !ok {
+		return write(w)
+	}
+	parallel := newParallelWriter(f, currentConcurrency(config), config)
+	start := time.Now()
+	err := write(parallel)
+	writeErr := parallel.wait()
+	if err == nil {
+		err = writeErr
+	}
+	adaptConcurrency(parallel.written.Load(), time.Since(start), writeErr, config)
+	return err
+}
+
+// concurrencyAttrs returns the current concurrency for the heartbeat.
+func concurrencyAttrs(config *Config) []any {
+	return []any{"concurrency", currentConcurrency(config)}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/sftp"
+)
+
+// Values of the UploadMode setting.
+const (
+	uploadModeReplace = "replace"
+	uploadModeAppend  = "append"
+)
+
+// appendNewData appends whatever was written to a source file since the last
+// upload to its remote copy. The remote file is treated as one growing log:
+// when the source shrinks (truncated) or is another file than the offset
+// was counted in (rotated) the offset starts over and the new content is
+// appended after what was shipped before.
+func appendNewData(path string, sftpClient *sftp.Client, config *Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	offset, replaced := state.offset(path, info)
+	size := info.Size()
+	if replaced {
+		slog.Warn("File was replaced since the last upload, assuming it was rotated", "file", path, "size", size)
+	}
+	if size < offset {
+		slog.Warn("File shrank since the last upload, assuming it was truncated or rotated", "file", path, "offset", offset, "size", size)
+		offset = 0
+	}
+	if size == offset {
+		return nil
+	}
+
+	waitForUploadSlot(config)
+	remotePath, ok := state.appendRemote(path)
+	if !ok {
+		remotePath = remotePathFor(path, config)
+		err = state.setAppendRemote(path, remotePath)
+		if err != nil {
+			slog.Error("Failed to save remote file of appends", "file", path, "error", err)
+		}
+	}
+	err = ensureRemoteParent(sftpClient, remotePath, config)
+	if err != nil {
+		return err
+	}
+	remoteFile, err := sftpClient.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+	if err != nil {
+		return fmt.Errorf("failed to open remote file: %w", err)
+	}
+	// not every server honours the append flag, so position explicitly
+	_, err = remoteFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		remoteFile.Close()
+		return fmt.Errorf("failed to seek remote file: %w", err)
+	}
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		remoteFile.Close()
+		return fmt.Errorf("failed to seek source file: %w", err)
+	}
+
+	// only ship up to the size we looked at, the writer may still be busy
+	w, done := startTransfer(remoteFile)
+	written, err := copyBuffered(w, diskReader{io.LimitReader(file, size-offset)}, config)
+	done()
+	closeErr := remoteFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if written > 0 {
+		// record partial progress too, the bytes are on the remote already
+		saveErr := state.setOffset(path, info, offset+written)
+		if saveErr != nil {
+			slog.Error("Failed to save upload offset", "file", path, "error", saveErr)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to append to remote file: %w", err)
+	}
+
+	slog.Info("Appended new data", "file", path, "remote", remotePath, "bytes", written)
+	return nil
+}
+
+// handleAppendEvent is the event handling for files in FolderToWatch when
+// UploadMode=append: files are never archived, every write ships the new tail.
+func handleAppendEvent(event fsnotify.Event, sftpClient *sftp.Client, config *Config) {
+	if isInternalFolder(event.Name, config) || !matchesFilter(event.Name, config) {
+		return
+	}
+
+	if event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+		err := appendNewData(event.Name, sftpClient, config)
+		if err != nil {
+			slog.Error("Failed to append file", "file", event.Name, "error", err)
+		}
+	}
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		err := state.forgetOffset(event.Name)
+		if err != nil {
+			slog.Error("Failed to save upload offset", "file", event.Name, "error", err)
+		}
+	}
+}
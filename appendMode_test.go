@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAppendAfterRotationToLargerFile(t *testing.T) {
+	quietLogs(t)
+	useTestState(t)
+	remote := t.TempDir()
+	settings := startSftpServer(t, remote, nil)
+	settings["general.UploadMode"] = "append"
+	folder := t.TempDir()
+	config := testConfig(t, folder, settings)
+	sftpClient, sshClient, _, err := dialServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeClients(sftpClient, sshClient) })
+
+	path := filepath.Join(folder, "app.log")
+	appendTo := func(content string) {
+		t.Helper()
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.WriteString(content)
+		file.Close()
+		err = appendNewData(path, sftpClient, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	appendTo("one\n")
+	appendTo("two\n")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := fileIdentity(info); !ok {
+		t.Skip("no file identities on this platform")
+	}
+
+	// the new file is already larger than what was sent of the old one, only
+	// its identity tells it apart
+	err = os.Rename(path, path+".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendTo("rotated, " + strings.Repeat("x", 20) + "\n")
+	appendTo("three\n")
+
+	uploaded, err := os.ReadFile(filepath.Join(remote, "app.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "one\ntwo\nrotated, " + strings.Repeat("x", 20) + "\nthree\n"
+	if string(uploaded) != want {
+		t.Errorf("remote file is %q, want %q", uploaded, want)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// isArchive reports whether path is an archive ExpandArchives unpacks.
+func isArchive(path string) bool {
+	name := strings.ToLower(path)
+	return strings.HasSuffix(name, ".zip") || strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// processArchive uploads the members of an archive as individual files and
+// then applies the post-upload action to the archive itself. Members are
+// subject to the same filters as files in the watch folder.
+func processArchive(archivePath string, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) error {
+	file, err := os.Open(archivePath)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Debug("Archive is already gone, skipping it", "file", archivePath)
+		forgetRetry(archivePath)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer file.Close()
+
+	count := 0
+	err = forEachArchiveMember(file, func(name string, info os.FileInfo, r io.Reader) error {
+		localPath := filepath.Join(filepath.Dir(archivePath), filepath.FromSlash(name))
+		if !matchesFilter(localPath, config) {
+			slog.Debug("Skipping archive member that does not match the filters", "archive", archivePath, "member", name)
+			return nil
+		}
+		err := uploadArchiveMember(localPath, info, r, sftpClient, sshClient, config)
+		if err != nil {
+			return fmt.Errorf("member %s: %w", name, err)
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to expand archive: %w", err)
+	}
+
+	slog.Info("Archive expanded", "archive", archivePath, "uploaded", count)
+	return finishUploadedFile(archivePath, file, config)
+}
+
+// uploadArchiveMember uploads one member to the remote path localPath would
+// have. Members are streamed out of the archive, so they need no room in
+// TempDir. Only the hash RemoteCollisionStrategy needs the content before
+// the upload, then the member is staged in TempDir first.
+func uploadArchiveMember(localPath string, info os.FileInfo, r io.Reader, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) error {
+	if config.RemoteCollisionStrategy == collisionHashSuffix {
+		return uploadStagedMember(localPath, info, r, sftpClient, sshClient, config)
+	}
+	remotePath, err := resolveRemotePath(sftpClient, remotePathFor(localPath, config), localPath, config)
+	if errors.Is(err, errRemoteExists) {
+		slog.Warn("Remote file already exists, archive member skipped", "path", remotePathFor(localPath, config))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = copyToSftp(streamSource(localPath, r, info), remotePath, sftpClient, sshClient, config)
+	return err
+}
+
+// uploadStagedMember copies a member to TempDir, if there is room for it,
+// and uploads the copy.
+func uploadStagedMember(localPath string, info os.FileInfo, r io.Reader, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) error {
+	err := checkFreeSpace(config.TempDir, info.Size(), config)
+	if err != nil {
+		return err
+	}
+	staged, err := os.CreateTemp(config.TempDir, "filewatcher-member-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staged.Name())
+	defer staged.Close()
+
+	_, err = copyBuffered(staged, r, config)
+	if err != nil {
+		return err
+	}
+	_, err = staged.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	remotePath, err := resolveRemotePath(sftpClient, remotePathFor(localPath, config), staged.Name(), config)
+	if errors.Is(err, errRemoteExists) {
+		slog.Warn("Remote file already exists, archive member skipped", "path", remotePathFor(localPath, config))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = copyToSftp(streamSource(localPath, staged, info), remotePath, sftpClient, sshClient, config)
+	return err
+}
+
+// forEachArchiveMember calls fn for every regular file in a zip or tar.gz
+// archive. Member names are checked before use, names that would leave the
+// extraction folder (absolute paths, drive letters, "..") fail the whole
+// archive. They are all checked in a first pass, so such an archive uploads
+// nothing.
+func forEachArchiveMember(file *os.File, fn func(name string, info os.FileInfo, r io.Reader) error) error {
+	each := forEachTarGzMember
+	if strings.HasSuffix(strings.ToLower(file.Name()), ".zip") {
+		each = forEachZipMember
+	}
+	err := each(file, func(string, os.FileInfo, io.Reader) error { return nil })
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return each(file, fn)
+}
+
+func forEachZipMember(file *os.File, fn func(name string, info os.FileInfo, r io.Reader) error) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(file, info.Size())
+	if err != nil {
+		return err
+	}
+
+	for _, member := range zr.File {
+		if !member.Mode().IsRegular() {
+			continue
+		}
+		name, err := safeMemberName(member.Name)
+		if err != nil {
+			return err
+		}
+		r, err := member.Open()
+		if err != nil {
+			return err
+		}
+		err = fn(name, member.FileInfo(), r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func forEachTarGzMember(file *os.File, fn func(name string, info os.FileInfo, r io.Reader) error) error {
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name, err := safeMemberName(header.Name)
+		if err != nil {
+			return err
+		}
+		err = fn(name, header.FileInfo(), tr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// safeMemberName returns the cleaned, slash separated member name, or an
+// error for names that point outside the archive root ("zip slip"). Drive
+// letters are refused on every platform, like backslashes they come from
+// archives made on Windows.
+func safeMemberName(name string) (string, error) {
+	clean := path.Clean(strings.ReplaceAll(name, `\`, "/"))
+	if clean == "." || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") ||
+		filepath.VolumeName(filepath.FromSlash(clean)) != "" || driveLetter.MatchString(clean) {
+		return "", fmt.Errorf("unsafe archive member name %q", name)
+	}
+	return clean, nil
+}
+
+var driveLetter = regexp.MustCompile(`^[A-Za-z]:`)
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSafeMemberName(t *testing.T) {
+	tests := []struct {
+		name string
+		// want is the cleaned name, "" when the name is refused
+		want string
+	}{
+		{"a.csv", "a.csv"},
+		{"dir/./a.csv", "dir/a.csv"},
+		{`dir\a.csv`, "dir/a.csv"},
+		{"dir/../a.csv", "a.csv"},
+		{"../x", ""},
+		{"a/../../x", ""},
+		{"/etc/x", ""},
+		{`C:\x`, ""},
+		{"c:x", ""},
+		{`..\x`, ""},
+		{`..\\x`, ""},
+		{".", ""},
+		{"..", ""},
+	}
+	for _, test := range tests {
+		got, err := safeMemberName(test.name)
+		if test.want == "" && err == nil {
+			t.Errorf("safeMemberName(%q) = %q, want an error", test.name, got)
+		}
+		if test.want != "" && (err != nil || got != test.want) {
+			t.Errorf("safeMemberName(%q) = %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
+
+// TestUnsafeArchiveRejected covers archives whose unsafe member comes after a
+// safe one: the safe one must not be passed on either.
+func TestUnsafeArchiveRejected(t *testing.T) {
+	members := []string{"ok.csv", "../evil.csv"}
+	archives := map[string]func(w io.Writer) error{
+		"slip.zip": func(w io.Writer) error {
+			zw := zip.NewWriter(w)
+			for _, name := range members {
+				f, err := zw.Create(name)
+				if err != nil {
+					return err
+				}
+				f.Write([]byte("id;amount\n"))
+			}
+			return zw.Close()
+		},
+		"slip.tar.gz": func(w io.Writer) error {
+			gz := gzip.NewWriter(w)
+			tw := tar.NewWriter(gz)
+			for _, name := range members {
+				err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 10, Typeflag: tar.TypeReg})
+				if err != nil {
+					return err
+				}
+				tw.Write([]byte("id;amount\n"))
+			}
+			err := tw.Close()
+			if err != nil {
+				return err
+			}
+			return gz.Close()
+		},
+	}
+	for name, write := range archives {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			file, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			err = write(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file.Seek(0, io.SeekStart)
+
+			var passed []string
+			err = forEachArchiveMember(file, func(name string, info os.FileInfo, r io.Reader) error {
+				passed = append(passed, name)
+				return nil
+			})
+			if err == nil {
+				t.Error("archive with ../evil.csv accepted")
+			}
+			if len(passed) != 0 {
+				t.Errorf("members %v passed on from a rejected archive", passed)
+			}
+		})
+	}
+}
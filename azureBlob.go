@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"gopkg.in/ini.v1"
+)
+
+// azureBlob uploads block blobs with UploadStream. Each chunk is staged as
+// a block, checked by the service against its CRC64, and the blob is
+// created by committing the block list once the data ended. Data smaller
+// than a chunk is put in one request at the end instead. Blocks that are
+// never committed are discarded by the service after a week.
+type azureBlob struct {
+	client    *azblob.Client
+	container string
+	chunkSize int
+	// auth describes the credentials in the connection string
+	auth string
+}
+
+// newAzureBlob reads ConnectionString, as shown for the storage account in
+// the Azure portal. It authorizes either with AccountName and AccountKey or
+// with a SharedAccessSignature, BlobEndpoint overrides the endpoint, e.g.
+// for Azurite.
+func newAzureBlob(section *ini.Section, config *Config) (*azureBlob, error) {
+	raw, err := expandEnv("ConnectionString", section.Key("ConnectionString").String())
+	if err != nil {
+		return nil, err
+	}
+	if raw == "" {
+		return nil, fmt.Errorf("UploadBackend = azblob needs ConnectionString in [cloud]")
+	}
+	options := &azblob.ClientOptions{ClientOptions: azcore.ClientOptions{
+		Retry: policy.RetryOptions{TryTimeout: config.CloudRequestTimeout},
+	}}
+	client, err := azblob.NewClientFromConnectionString(raw, options)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ConnectionString: %w", err)
+	}
+
+	settings := map[string]string{}
+	for _, part := range strings.Split(raw, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		settings[strings.ToLower(name)] = value
+	}
+	auth := "shared access signature"
+	if settings["accountkey"] != "" {
+		auth = "shared key of " + settings["accountname"]
+	}
+	return &azureBlob{client: client, container: config.CloudContainer, chunkSize: config.CloudChunkSize, auth: auth}, nil
+}
+
+func (a *azureBlob) describe() (string, string) {
+	return strings.TrimSuffix(a.client.URL(), "/") + "/" + a.container, a.auth
+}
+
+// newObject starts UploadStream on a pipe, the data written to the object
+// goes through it. Closing the pipe ends the data and commits the blob,
+// closing it with an error makes UploadStream give up before the commit.
+func (a *azureBlob) newObject(name string) (cloudObject, error) {
+	r, w := io.Pipe()
+	object := &azureObject{w: w, done: make(chan error, 1)}
+	go func() {
+		_, err := a.client.UploadStream(context.Background(), a.container, name, r, &azblob.UploadStreamOptions{
+			BlockSize:               int64(a.chunkSize),
+			Concurrency:             1,
+			TransactionalValidation: blob.TransferValidationTypeComputeCRC64(),
+			HTTPHeaders:             &blob.HTTPHeaders{BlobContentType: to.Ptr("application/octet-stream")},
+		})
+		// a failed upload makes further writes fail instead of blocking
+		r.CloseWithError(err)
+		object.done <- err
+	}()
+	return object, nil
+}
+
+type azureObject struct {
+	w    *io.PipeWriter
+	done chan error
+}
+
+func (o *azureObject) Write(p []byte) (int, error) {
+	return o.w.Write(p)
+}
+
+func (o *azureObject) commit() error {
+	o.w.Close()
+	return <-o.done
+}
+
+func (o *azureObject) abort() {
+	o.w.CloseWithError(errUploadAborted)
+	<-o.done
+}
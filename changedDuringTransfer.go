@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// errChangedDuringTransfer reports a source file that was still written to
+// while it was uploaded. The upload is discarded and the file retried.
+var errChangedDuringTransfer = errors.New("file changed during upload")
+
+// checkSourceUnchanged compares the size and modification time of file with
+// those recorded before the upload started.
+func checkSourceUnchanged(file *os.File, before os.FileInfo) error {
+	after, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file after upload: %w", err)
+	}
+	if after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		return fmt.Errorf("%w: size %d -> %d, modified %s -> %s", errChangedDuringTransfer,
+			before.Size(), after.Size(), before.ModTime().Format(time.RFC3339Nano), after.ModTime().Format(time.RFC3339Nano))
+	}
+	return nil
+}
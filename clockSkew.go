@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"time"
+)
+
+// arrivalTime returns the modification time of a file for the features that
+// bucket or label files by time. A time further in the future than
+// MaxClockSkewSeconds means the clocks disagree, e.g. after a VM migration,
+// and is replaced by the current time.
+func arrivalTime(path string, info os.FileInfo, config *Config) time.Time {
+	now := time.Now()
+	if info == nil {
+		return now
+	}
+	return clampFuture(path, info.ModTime(), now, config)
+}
+
+// clampFuture returns now instead of t when t lies more than MaxClockSkew
+// ahead of it.
+func clampFuture(path string, t, now time.Time, config *Config) time.Time {
+	if t.Sub(now) <= config.MaxClockSkew {
+		return t
+	}
+	slog.Warn("File is modified in the future, check the clocks. Using the current time instead",
+		"file", path, "modified", t.Format(time.RFC3339), "now", now.Format(time.RFC3339))
+	return now
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// cloudStorage uploads files as objects of an Azure Blob container or a
+// Google Cloud Storage bucket instead of to the SFTP server, with the
+// services' SDKs. An object only becomes visible once all its data arrived,
+// so readers never see a partial file and no .part name is needed.
+type cloudStorage interface {
+	// newObject starts the upload of the object name.
+	newObject(name string) (cloudObject, error)
+	// describe returns where uploads go and how they are authorized, for the
+	// configuration summary.
+	describe() (target, auth string)
+}
+
+// cloudObject is an object being uploaded. Nothing of it is visible before
+// commit, an upload that is given up on leaves no object behind.
+type cloudObject interface {
+	io.Writer
+	// commit sends the rest of the data and creates the object.
+	commit() error
+	// abort gives up on the upload, the object isn't created.
+	abort()
+}
+
+// errUploadAborted ends the upload of an object that is given up on.
+var errUploadAborted = errors.New("upload aborted")
+
+// loadCloudStorage reads the [cloud] section for UploadBackend = azblob or
+// gcs. Prefix takes the place of DestinationFolder. Settings that work on
+// the SFTP session, which isn't opened for cloud storage, are rejected,
+// TransformCommand and EncryptWith work on the data and apply as usual.
+func loadCloudStorage(section *ini.Section, config *Config) error {
+	if config.UploadBackend != uploadBackendAzureBlob && config.UploadBackend != uploadBackendGCS {
+		return nil
+	}
+	conflicts := []struct {
+		set     bool
+		setting string
+	}{
+		{config.UploadMode == uploadModeAppend, "UploadMode = append"},
+		{config.WatchUnit == watchUnitDirectory, "WatchUnit = directory"},
+		{config.GroupPattern != nil, "GroupPattern"},
+		{config.ExpandArchives, "ExpandArchives"},
+		{config.VerifyUpload != verifyNone, "VerifyUpload"},
+		{config.WriteRemoteChecksumSidecar, "WriteRemoteChecksumSidecar"},
+		{config.WriteRemoteReadyMarker, "WriteRemoteReadyMarker"},
+		{config.RemoteUID >= 0 || config.RemoteGID >= 0, "RemoteUID and RemoteGID"},
+		{config.PostUploadRemoteCommand != "", "PostUploadRemoteCommand"},
+		{config.RemoteCollisionStrategy != collisionOverwrite, "RemoteCollisionStrategy other than overwrite"},
+		{config.RemoteCaseInsensitive, "RemoteCaseInsensitive"},
+		{config.MirrorDeletions, "MirrorDeletions"},
+		{config.AckFolder != "", "AckFolder"},
+		{config.RemoteRetentionDays > 0, "RemoteRetentionDays"},
+		{config.SelfTestInterval > 0, "SelfTestIntervalMinutes"},
+		{config.PartFileRecovery != partRecoveryOff, "PartFileRecovery"},
+	}
+	for _, conflict := range conflicts {
+		if conflict.set {
+			return fmt.Errorf("UploadBackend = %s can't be combined with %s, it needs the SFTP server", config.UploadBackend, conflict.setting)
+		}
+	}
+
+	config.CloudContainer = section.Key("Container").String()
+	if config.CloudContainer == "" {
+		return fmt.Errorf("UploadBackend = %s needs Container in [cloud]", config.UploadBackend)
+	}
+	prefix := section.Key("Prefix").String()
+	if prefix != "" {
+		if config.destionationFolder != "" {
+			return fmt.Errorf("set either Prefix in [cloud] or DestinationFolder, not both")
+		}
+		config.destionationFolder = strings.TrimSuffix(strings.TrimPrefix(prefix, "/"), "/") + "/"
+	}
+	megabytes := section.Key("ChunkSizeMB").MustInt(defaultCloudChunkSizeMB)
+	if megabytes < 1 || megabytes > maxCloudChunkSizeMB {
+		return fmt.Errorf("ChunkSizeMB must be between 1 and %d, got %d", maxCloudChunkSizeMB, megabytes)
+	}
+	config.CloudChunkSize = megabytes << 20
+	seconds := section.Key("RequestTimeoutSeconds").MustInt(defaultCloudRequestTimeoutSeconds)
+	if seconds <= 0 {
+		return fmt.Errorf("RequestTimeoutSeconds must be positive, got %d", seconds)
+	}
+	config.CloudRequestTimeout = time.Duration(seconds) * time.Second
+
+	var err error
+	if config.UploadBackend == uploadBackendAzureBlob {
+		config.cloud, err = newAzureBlob(section, config)
+	} else {
+		config.cloud, err = newGCS(section, config)
+	}
+	return err
+}
+
+// Chunk sizes of cloud uploads. A chunk is held in memory while it is sent.
+// The request timeout limits sending one chunk, not a whole file.
+const (
+	defaultCloudChunkSizeMB           = 8
+	maxCloudChunkSizeMB               = 1024
+	defaultCloudRequestTimeoutSeconds = 300
+)
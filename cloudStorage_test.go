@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+	"gopkg.in/ini.v1"
+)
+
+// fakeAzure is the Blob service for the Put Blob and block requests
+// UploadStream makes. Signing them is the SDK's job, it only checks they
+// are authorized the way the connection string says.
+type fakeAzure struct {
+	t   *testing.T
+	sas string
+	// failBlock fails the put of this block number, 0 for none
+	failBlock int
+
+	mu     sync.Mutex
+	puts   int
+	blocks map[string][]byte
+	blobs  map[string][]byte
+	lists  map[string]int
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	query := r.URL.Query()
+	if f.sas != "" {
+		if r.Header.Get("Authorization") != "" || query.Get("sig") != f.sas {
+			http.Error(w, "bad signature", http.StatusForbidden)
+			return
+		}
+	} else if !strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey devstoreaccount1:") {
+		http.Error(w, "not signed", http.StatusForbidden)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		f.t.Error(err)
+		return
+	}
+
+	switch query.Get("comp") {
+	case "":
+		// Put Blob, for data that fits one block
+		f.blobs[r.URL.Path] = body
+		f.lists[r.URL.Path] = 0
+	case "block":
+		f.puts++
+		if f.puts == f.failBlock {
+			// not retried, unlike a server error
+			http.Error(w, "injected failure", http.StatusBadRequest)
+			return
+		}
+		f.blocks[r.URL.Path+"#"+query.Get("blockid")] = body
+	case "blocklist":
+		var list struct {
+			Blocks []string `xml:",any"`
+		}
+		err := xml.Unmarshal(body, &list)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var blob []byte
+		for _, id := range list.Blocks {
+			block, ok := f.blocks[r.URL.Path+"#"+id]
+			if !ok {
+				http.Error(w, "InvalidBlockList", http.StatusBadRequest)
+				return
+			}
+			blob = append(blob, block...)
+		}
+		f.blobs[r.URL.Path] = blob
+		f.lists[r.URL.Path] = len(list.Blocks)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func startFakeAzure(t *testing.T) (*fakeAzure, *httptest.Server) {
+	f := &fakeAzure{t: t, blocks: map[string][]byte{}, blobs: map[string][]byte{}, lists: map[string]int{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+// azureSettings returns the settings to upload to the fake with a shared
+// key, whose value doesn't matter to it.
+func azureSettings(server *httptest.Server) map[string]string {
+	return map[string]string{
+		"general.UploadBackend": "azblob",
+		"cloud.Container":       "inbox",
+		"cloud.ChunkSizeMB":     "1",
+		"cloud.ConnectionString": "DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;AccountKey=" +
+			base64.StdEncoding.EncodeToString([]byte("not a real account key")) + ";BlobEndpoint=" + server.URL,
+	}
+}
+
+// startFakeGCS starts a fake-gcs-server with the bucket inbox and points
+// the storage client to it.
+func startFakeGCS(t *testing.T) (*fakestorage.Server, map[string]string) {
+	server, err := fakestorage.NewServerWithOptions(fakestorage.Options{Scheme: "http"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Stop)
+	server.CreateBucketWithOpts(fakestorage.CreateBucketOpts{Name: "inbox"})
+	t.Setenv("STORAGE_EMULATOR_HOST", server.URL())
+	return server, map[string]string{
+		"general.UploadBackend": "gcs",
+		"cloud.Container":       "inbox",
+		"cloud.ChunkSizeMB":     "1",
+	}
+}
+
+// gcsContent returns the content of the object name, false if there is
+// none.
+func gcsContent(server *fakestorage.Server, name string) ([]byte, bool) {
+	object, err := server.GetObject("inbox", name)
+	if err != nil {
+		return nil, false
+	}
+	return object.Content, true
+}
+
+// useTestState points the state file to a temporary one for the test.
+func useTestState(t *testing.T) {
+	previous := state
+	var err error
+	state, err = openStateStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { state = previous })
+}
+
+// cloudTestUpload writes content to a local file and uploads it with the
+// uploader of config as remotePath.
+func cloudTestUpload(t *testing.T, content []byte, remotePath string, config *Config) error {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "upload.bin")
+	writeFile(t, path, string(content))
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	_, err = uploadFile(file, remotePath, nil, nil, config)
+	return err
+}
+
+func TestAzureBlobUpload(t *testing.T) {
+	quietLogs(t)
+	useTestState(t)
+	fake, server := startFakeAzure(t)
+	folder := t.TempDir()
+	content := make([]byte, 5<<19)
+	rand.Read(content)
+	writeFile(t, filepath.Join(folder, "daily report.csv"), string(content))
+
+	settings := azureSettings(server)
+	settings["general.WatchFileExtension"] = ".csv"
+	settings["cloud.Prefix"] = "/incoming"
+	config := testConfig(t, folder, settings)
+	failed, err := processExistingFiles(folder, nil, nil, *config)
+	if err != nil || failed != 0 {
+		t.Fatalf("upload failed: %d files, %v", failed, err)
+	}
+
+	blob := "/inbox/incoming/daily report.csv"
+	if !bytes.Equal(fake.blobs[blob], content) {
+		t.Fatalf("blob %q has %d bytes that differ from the %d bytes uploaded", blob, len(fake.blobs[blob]), len(content))
+	}
+	if fake.lists[blob] != 3 {
+		t.Errorf("blob committed from %d blocks, want 3 of 1 MB", fake.lists[blob])
+	}
+	if _, err := os.Stat(filepath.Join(folder, "daily report.csv")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("uploaded file is still in the watch folder: %v", err)
+	}
+}
+
+func TestAzureBlobSharedAccessSignature(t *testing.T) {
+	quietLogs(t)
+	fake, server := startFakeAzure(t)
+	fake.sas = "c2lnbmF0dXJl"
+	config := testConfig(t, t.TempDir(), map[string]string{
+		"general.UploadBackend":  "azblob",
+		"cloud.Container":        "inbox",
+		"cloud.ConnectionString": "BlobEndpoint=" + server.URL + ";SharedAccessSignature=sv=2021-08-06&sr=c&sp=cw&sig=" + fake.sas,
+	})
+
+	// an empty file is put in one request, like any smaller than a chunk
+	err := cloudTestUpload(t, nil, "empty.csv", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob, ok := fake.blobs["/inbox/empty.csv"]; !ok || len(blob) != 0 {
+		t.Errorf("empty blob not created, got %d bytes, exists %v", len(blob), ok)
+	}
+}
+
+func TestAzureBlobFailedBlockLeavesNoBlob(t *testing.T) {
+	quietLogs(t)
+	fake, server := startFakeAzure(t)
+	fake.failBlock = 2
+	config := testConfig(t, t.TempDir(), azureSettings(server))
+
+	err := cloudTestUpload(t, make([]byte, 3<<20), "report.csv", config)
+	if err == nil || !strings.Contains(err.Error(), "injected failure") {
+		t.Fatalf("upload error = %v, want the failed block", err)
+	}
+	if len(fake.blobs) != 0 {
+		t.Errorf("blobs created by a failed upload: %d", len(fake.blobs))
+	}
+}
+
+func TestAzureBlobTransform(t *testing.T) {
+	quietLogs(t)
+	fake, server := startFakeAzure(t)
+	settings := azureSettings(server)
+	settings["general.TransformCommand"] = "tr a-z A-Z"
+	config := testConfig(t, t.TempDir(), settings)
+
+	err := cloudTestUpload(t, []byte("id;amount\n1;42\n"), "report.csv", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fake.blobs["/inbox/report.csv"]); got != "ID;AMOUNT\n1;42\n" {
+		t.Errorf("blob = %q, want the output of TransformCommand", got)
+	}
+
+	// a failing transform aborts the upload before the commit
+	settings["general.TransformCommand"] = "false"
+	config = testConfig(t, t.TempDir(), settings)
+	err = cloudTestUpload(t, []byte("id;amount\n"), "broken.csv", config)
+	var transformErr *transformError
+	if !errors.As(err, &transformErr) {
+		t.Fatalf("upload error = %v, want a transform error", err)
+	}
+	if _, ok := fake.blobs["/inbox/broken.csv"]; ok {
+		t.Error("blob created from a failed transform")
+	}
+}
+
+func TestGCSUpload(t *testing.T) {
+	quietLogs(t)
+	server, settings := startFakeGCS(t)
+	config := testConfig(t, t.TempDir(), settings)
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"partial chunk", 5 << 19},
+		{"whole chunks", 2 << 20},
+		{"empty", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content := make([]byte, test.size)
+			rand.Read(content)
+			err := cloudTestUpload(t, content, "/in/"+test.name+".csv", config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			object, ok := gcsContent(server, "in/"+test.name+".csv")
+			if !ok || !bytes.Equal(object, content) {
+				t.Errorf("object has %d bytes that differ from the %d bytes uploaded", len(object), len(content))
+			}
+		})
+	}
+}
+
+func TestGCSEncrypted(t *testing.T) {
+	quietLogs(t)
+	server, settings := startFakeGCS(t)
+	partner, err := openpgp.NewEntity("Partner", "", "partner@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings["paths.EncryptWith"] = writePublicKey(t, t.TempDir(), partner)
+	config := testConfig(t, t.TempDir(), settings)
+
+	content := strings.Repeat("id;amount\n1;42\n", 100000)
+	err = cloudTestUpload(t, []byte(content), encryptedName("in/report.csv", config), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object, ok := gcsContent(server, "in/report.csv.gpg")
+	if !ok {
+		t.Fatal("no encrypted object")
+	}
+	message, err := openpgp.ReadMessage(bytes.NewReader(object), openpgp.EntityList{partner}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := io.ReadAll(message.UnverifiedBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != content {
+		t.Errorf("decrypted %d bytes that differ from the %d bytes uploaded", len(decrypted), len(content))
+	}
+}
+
+// failingReader returns err after n zero bytes.
+type failingReader struct {
+	n   int
+	err error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, r.err
+	}
+	n := min(len(p), r.n)
+	clear(p[:n])
+	r.n -= n
+	return n, nil
+}
+
+func TestGCSFailedReadLeavesNoObject(t *testing.T) {
+	quietLogs(t)
+	server, settings := startFakeGCS(t)
+	config := testConfig(t, t.TempDir(), settings)
+
+	// more than a chunk is sent before the source fails
+	injected := errors.New("injected read failure")
+	source := streamSource("report.csv", &failingReader{n: 3 << 19, err: injected}, nil)
+	_, err := newUploader(nil, nil, config).upload(source, "report.csv")
+	if !errors.Is(err, injected) {
+		t.Fatalf("upload error = %v, want the read failure", err)
+	}
+	if _, ok := gcsContent(server, "report.csv"); ok {
+		t.Error("object created by a failed upload")
+	}
+}
+
+func TestLoadCloudStorageErrors(t *testing.T) {
+	azure := map[string]string{
+		"general.UploadBackend":  "azblob",
+		"cloud.Container":        "inbox",
+		"cloud.ConnectionString": "AccountName=account;AccountKey=a2V5",
+	}
+	tests := []struct {
+		name     string
+		settings map[string]string
+	}{
+		{"append", map[string]string{"general.UploadMode": "append"}},
+		{"verify", map[string]string{"general.VerifyUpload": "readback"}},
+		{"no container", map[string]string{"cloud.Container": ""}},
+		{"prefix and destination", map[string]string{"cloud.Prefix": "in/", "server.DestinationFolder": "out/"}},
+		{"chunk size", map[string]string{"cloud.ChunkSizeMB": "0"}},
+		{"no connection string", map[string]string{"cloud.ConnectionString": ""}},
+		{"no account key", map[string]string{"cloud.ConnectionString": "AccountName=account"}},
+		{"missing credentials", map[string]string{"general.UploadBackend": "gcs", "cloud.CredentialsFile": filepath.Join(t.TempDir(), "missing.json")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := ini.Empty()
+			cfg.Section("paths").Key("FolderToWatch").SetValue(t.TempDir())
+			for _, settings := range []map[string]string{azure, test.settings} {
+				for name, value := range settings {
+					section, key, _ := strings.Cut(name, ".")
+					cfg.Section(section).Key(key).SetValue(value)
+				}
+			}
+			if _, err := configFromIni(cfg, "", nil); err == nil {
+				t.Error("configFromIni accepted the configuration")
+			}
+		})
+	}
+}
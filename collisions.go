@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// Strategies for a target name that is taken, see CollisionStrategy.
+const (
+	collisionOverwrite  = "overwrite"
+	collisionSkip       = "skip"
+	collisionTimestamp  = "timestamp"
+	collisionCounter    = "counter"
+	collisionHashSuffix = "hash-suffix"
+)
+
+var collisionStrategies = []string{collisionOverwrite, collisionSkip, collisionTimestamp, collisionCounter, collisionHashSuffix}
+
+// errNameTaken is returned by resolveCollision when the strategy is skip and
+// the target exists.
+var errNameTaken = errors.New("target name is taken")
+
+// loadCollisionStrategies reads CollisionStrategy and the overrides for the
+// remote destination, the processed folder and the failed folder.
+// OnRemoteExists, the older name of RemoteCollisionStrategy, is still read,
+// its "rename" is the counter strategy.
+func loadCollisionStrategies(section *ini.Section, config *Config) error {
+	var err error
+	config.CollisionStrategy, err = oneOf(section.Key("CollisionStrategy"), collisionStrategies...)
+	if err != nil {
+		return err
+	}
+
+	remote := section.Key("RemoteCollisionStrategy")
+	if remote.String() == "" {
+		remote = section.Key("OnRemoteExists")
+	}
+	if strings.EqualFold(strings.TrimSpace(remote.String()), "rename") {
+		config.RemoteCollisionStrategy = collisionCounter
+	} else {
+		config.RemoteCollisionStrategy, err = strategyOr(remote, config.CollisionStrategy)
+		if err != nil {
+			return err
+		}
+	}
+	config.ProcessedCollisionStrategy, err = strategyOr(section.Key("ProcessedCollisionStrategy"), config.CollisionStrategy)
+	if err != nil {
+		return err
+	}
+	config.FailedCollisionStrategy, err = strategyOr(section.Key("FailedCollisionStrategy"), config.CollisionStrategy)
+	return err
+}
+
+// strategyOr reads a per-location strategy, an unset key uses fallback.
+func strategyOr(key *ini.Key, fallback string) (string, error) {
+	if strings.TrimSpace(key.String()) == "" {
+		key.SetValue(fallback)
+		return fallback, nil
+	}
+	return oneOf(key, collisionStrategies...)
+}
+
+// resolveCollision returns the name to use for target when strategy applies.
+// exists reports whether a candidate is taken, hash returns the content hash
+// for hash-suffix. Timestamped names that are taken as well get a counter.
+// A file with the same content hash is the same file, so hash-suffix
+// replaces it.
+func resolveCollision(target, strategy string, exists func(string) (bool, error), hash func() (string, error)) (string, error) {
+	if strategy == collisionOverwrite {
+		return target, nil
+	}
+	taken, err := exists(target)
+	if err != nil || !taken {
+		return target, err
+	}
+
+	switch strategy {
+	case collisionSkip:
+		return "", errNameTaken
+	case collisionHashSuffix:
+		sum, err := hash()
+		if err != nil {
+			return "", err
+		}
+		return withNameSuffix(target, "_"+sum), nil
+	case collisionTimestamp:
+		candidate := withNameSuffix(target, "_"+time.Now().Format("20060102T150405"))
+		taken, err := exists(candidate)
+		if err != nil || !taken {
+			return candidate, err
+		}
+		target = candidate
+	}
+
+	for i := 1; ; i++ {
+		candidate := withNameSuffix(target, fmt.Sprintf("_%d", i))
+		taken, err := exists(candidate)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return candidate, nil
+		}
+	}
+}
+
+// withNameSuffix inserts suffix between the name and the extension of p.
+// filepath.Ext also splits remote paths correctly, their "/" is a separator
+// everywhere.
+func withNameSuffix(p, suffix string) string {
+	ext := filepath.Ext(p)
+	return strings.TrimSuffix(p, ext) + suffix + ext
+}
+
+// fileHashSuffix returns the first 12 hex digits of the SHA-256 of a local
+// file, for hash-suffix names. A directory is hashed over the names and
+// contents of the files in it.
+func fileHashSuffix(path string) (string, error) {
+	hash := sha256.New()
+	var err error
+	if info, statErr := os.Stat(path); statErr == nil && info.IsDir() {
+		err = filepath.WalkDir(path, func(p string, entry os.DirEntry, err error) error {
+			if err != nil || !entry.Type().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(path, p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hash, "%s\x00", filepath.ToSlash(rel))
+			return hashFile(hash, p)
+		})
+	} else {
+		err = hashFile(hash, path)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:12], nil
+}
+
+func hashFile(w io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// localTarget resolves the name of path moved into the local folder dir.
+func localTarget(path, dir, strategy string) (string, error) {
+	target := filepath.Join(dir, filepath.Base(path))
+	resolved, err := resolveCollision(target, strategy, localFileExists, func() (string, error) {
+		return fileHashSuffix(path)
+	})
+	if err == nil && resolved != target {
+		slog.Info("File name is taken, using a new name", "file", path, "target", resolved, "strategy", strategy)
+	}
+	return resolved, err
+}
+
+func localFileExists(path string) (bool, error) {
+	_, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// maxRecentRemoteNames bounds the remote names remembered for
+// RemoteCaseInsensitive.
+const maxRecentRemoteNames = 10000
+
+// recentRemoteNames maps the case-folded remote paths of recent uploads to
+// their actual spelling, oldest first in recentRemoteOrder. Only used from
+// the main goroutine.
+var (
+	recentRemoteNames = map[string]string{}
+	recentRemoteOrder []string
+)
+
+// rememberRemoteName records an uploaded remote path for case-insensitive
+// collision checks.
+func rememberRemoteName(remotePath string, config *Config) {
+	if !config.RemoteCaseInsensitive {
+		return
+	}
+	key := strings.ToLower(remotePath)
+	if _, ok := recentRemoteNames[key]; !ok {
+		recentRemoteOrder = append(recentRemoteOrder, key)
+	}
+	recentRemoteNames[key] = remotePath
+	if len(recentRemoteOrder) > maxRecentRemoteNames {
+		delete(recentRemoteNames, recentRemoteOrder[0])
+		recentRemoteOrder = recentRemoteOrder[1:]
+	}
+}
+
+// recentCaseVariant returns a recently uploaded remote path that differs
+// from remotePath only in case.
+func recentCaseVariant(remotePath string) (string, bool) {
+	other, ok := recentRemoteNames[strings.ToLower(remotePath)]
+	return other, ok && other != remotePath
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"gopkg.in/ini.v1"
+)
+
+func TestResolveCollision(t *testing.T) {
+	hash := func() (string, error) { return "0123456789ab", nil }
+	tests := []struct {
+		name     string
+		strategy string
+		taken    []string
+		want     string
+		wantErr  error
+	}{
+		{"free name", collisionCounter, nil, "in/a.csv", nil},
+		{"overwrite", collisionOverwrite, []string{"in/a.csv"}, "in/a.csv", nil},
+		{"skip", collisionSkip, []string{"in/a.csv"}, "", errNameTaken},
+		{"skip free name", collisionSkip, nil, "in/a.csv", nil},
+		{"counter", collisionCounter, []string{"in/a.csv"}, "in/a_1.csv", nil},
+		{"counter past taken", collisionCounter, []string{"in/a.csv", "in/a_1.csv", "in/a_2.csv"}, "in/a_3.csv", nil},
+		{"hash suffix", collisionHashSuffix, []string{"in/a.csv"}, "in/a_0123456789ab.csv", nil},
+		// the same content hash is the same file, which is replaced
+		{"hash suffix taken", collisionHashSuffix, []string{"in/a.csv", "in/a_0123456789ab.csv"}, "in/a_0123456789ab.csv", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			taken := map[string]bool{}
+			for _, name := range test.taken {
+				taken[name] = true
+			}
+			exists := func(p string) (bool, error) { return taken[p], nil }
+			got, err := resolveCollision("in/a.csv", test.strategy, exists, hash)
+			if !errors.Is(err, test.wantErr) || got != test.want {
+				t.Errorf("resolveCollision = %q, %v, want %q, %v", got, err, test.want, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestResolveCollisionTimestamp(t *testing.T) {
+	stamped := regexp.MustCompile(`^in/a_\d{8}T\d{6}\.csv$`)
+	exists := func(p string) (bool, error) { return p == "in/a.csv", nil }
+	got, err := resolveCollision("in/a.csv", collisionTimestamp, exists, nil)
+	if err != nil || !stamped.MatchString(got) {
+		t.Errorf("resolveCollision = %q, %v, want a timestamped name", got, err)
+	}
+
+	// a timestamped name that is taken as well gets a counter
+	exists = func(p string) (bool, error) { return p == "in/a.csv" || stamped.MatchString(p), nil }
+	got, err = resolveCollision("in/a.csv", collisionTimestamp, exists, nil)
+	if err != nil || !regexp.MustCompile(`^in/a_\d{8}T\d{6}_1\.csv$`).MatchString(got) {
+		t.Errorf("resolveCollision = %q, %v, want a timestamped name with a counter", got, err)
+	}
+}
+
+func TestResolveCollisionErrors(t *testing.T) {
+	failing := errors.New("stat failed")
+	_, err := resolveCollision("in/a.csv", collisionCounter, func(string) (bool, error) { return false, failing }, nil)
+	if !errors.Is(err, failing) {
+		t.Errorf("exists error: got %v", err)
+	}
+	exists := func(string) (bool, error) { return true, nil }
+	_, err = resolveCollision("in/a.csv", collisionHashSuffix, exists, func() (string, error) { return "", failing })
+	if !errors.Is(err, failing) {
+		t.Errorf("hash error: got %v", err)
+	}
+}
+
+func TestWithNameSuffix(t *testing.T) {
+	tests := []struct{ path, want string }{
+		{"a.csv", "a_1.csv"},
+		{"in/a.csv", "in/a_1.csv"},
+		{"in/archive.tar.gz", "in/archive.tar_1.gz"},
+		{"in/README", "in/README_1"},
+		{"in.d/README", "in.d/README_1"},
+	}
+	for _, test := range tests {
+		if got := withNameSuffix(test.path, "_1"); got != test.want {
+			t.Errorf("withNameSuffix(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestLocalTarget(t *testing.T) {
+	quietLogs(t)
+	dir := t.TempDir()
+	source := filepath.Join(t.TempDir(), "a.csv")
+	writeFile(t, source, "new")
+	writeFile(t, filepath.Join(dir, "a.csv"), "old")
+
+	got, err := localTarget(source, dir, collisionCounter)
+	if want := filepath.Join(dir, "a_1.csv"); err != nil || got != want {
+		t.Errorf("counter: got %q, %v, want %q", got, err, want)
+	}
+	// sha256("new") starts with 11507a0e2f5e
+	got, err = localTarget(source, dir, collisionHashSuffix)
+	if want := filepath.Join(dir, "a_11507a0e2f5e.csv"); err != nil || got != want {
+		t.Errorf("hash-suffix: got %q, %v, want %q", got, err, want)
+	}
+	_, err = localTarget(source, dir, collisionSkip)
+	if !errors.Is(err, errNameTaken) {
+		t.Errorf("skip: got %v, want errNameTaken", err)
+	}
+}
+
+func TestLoadCollisionStrategies(t *testing.T) {
+	tests := []struct {
+		name                       string
+		settings                   map[string]string
+		remote, processed, failure string
+	}{
+		{"defaults", nil, collisionOverwrite, collisionOverwrite, collisionOverwrite},
+		{"shared", map[string]string{"CollisionStrategy": "counter"}, collisionCounter, collisionCounter, collisionCounter},
+		{"overrides", map[string]string{"CollisionStrategy": "skip", "RemoteCollisionStrategy": "hash-suffix", "FailedCollisionStrategy": "timestamp"}, collisionHashSuffix, collisionSkip, collisionTimestamp},
+		{"old name", map[string]string{"OnRemoteExists": "rename"}, collisionCounter, collisionOverwrite, collisionOverwrite},
+		{"new name wins", map[string]string{"OnRemoteExists": "rename", "RemoteCollisionStrategy": "skip"}, collisionSkip, collisionOverwrite, collisionOverwrite},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			section := ini.Empty().Section("general")
+			for key, value := range test.settings {
+				section.Key(key).SetValue(value)
+			}
+			var config Config
+			err := loadCollisionStrategies(section, &config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.RemoteCollisionStrategy != test.remote || config.ProcessedCollisionStrategy != test.processed || config.FailedCollisionStrategy != test.failure {
+				t.Errorf("got remote %s, processed %s, failed %s", config.RemoteCollisionStrategy, config.ProcessedCollisionStrategy, config.FailedCollisionStrategy)
+			}
+		})
+	}
+
+	section := ini.Empty().Section("general")
+	section.Key("ProcessedCollisionStrategy").SetValue("rename")
+	if err := loadCollisionStrategies(section, &Config{}); err == nil {
+		t.Error("rename is only accepted for OnRemoteExists")
+	}
+}
+
+func TestRecentCaseVariant(t *testing.T) {
+	t.Cleanup(func() {
+		recentRemoteNames = map[string]string{}
+		recentRemoteOrder = nil
+	})
+	config := &Config{RemoteCaseInsensitive: true}
+	rememberRemoteName("in/Report.csv", config)
+
+	if other, ok := recentCaseVariant("in/report.csv"); !ok || other != "in/Report.csv" {
+		t.Errorf("recentCaseVariant = %q, %v, want in/Report.csv", other, ok)
+	}
+	if _, ok := recentCaseVariant("in/Report.csv"); ok {
+		t.Error("the same spelling is no variant")
+	}
+
+	// the oldest names are forgotten beyond maxRecentRemoteNames
+	for i := range maxRecentRemoteNames {
+		rememberRemoteName(fmt.Sprintf("in/file%d.csv", i), config)
+	}
+	if _, ok := recentCaseVariant("in/report.csv"); ok {
+		t.Error("the oldest name is still remembered")
+	}
+	if len(recentRemoteOrder) != maxRecentRemoteNames {
+		t.Errorf("%d names remembered, want %d", len(recentRemoteOrder), maxRecentRemoteNames)
+	}
+}
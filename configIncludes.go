@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+
+	"gopkg.in/ini.v1"
+)
+
+// loadIniFiles loads filename together with the files it includes and
+// returns the merged result and the files in the order they were read. An
+// "include" key before the first section lists files, comma separated and
+// relative to the including file. Included files are read first, so every
+// key of the including file overrides theirs while keys it leaves out are
+// inherited.
+func loadIniFiles(filename string) (*ini.File, []string, error) {
+	files, err := includeChain(filepath.Clean(filename), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	sources := make([]any, len(files))
+	for i, file := range files {
+		sources[i] = file
+	}
+	cfg, err := ini.Load(sources[0], sources[1:]...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, files, nil
+}
+
+// includeChain returns the files filename includes, recursively, followed by
+// filename itself. A file included twice is read once, at its first place.
+func includeChain(filename string, including []string) ([]string, error) {
+	if slices.Contains(including, filename) {
+		return nil, fmt.Errorf("%s includes itself", filename)
+	}
+	cfg, err := ini.Load(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, include := range cfg.Section(ini.DefaultSection).Key("include").Strings(",") {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(filename), include)
+		}
+		chain, err := includeChain(filepath.Clean(include), append(including, filename))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range chain {
+			if !slices.Contains(files, file) {
+				files = append(files, file)
+			}
+		}
+	}
+	return append(files, filename), nil
+}
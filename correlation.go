@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// correlationKey is the log attribute, and the name in events and
+// dead-letter messages, that carries a file's correlation ID.
+const correlationKey = "correlationId"
+
+// correlationIDs maps source files to their correlation ID. Log lines come
+// from every goroutine, so it is a sync.Map.
+var correlationIDs sync.Map
+
+// correlationFor returns the correlation ID of a source file, generating
+// one when the file is seen for the first time. Without CorrelationIDs it
+// returns "".
+func correlationFor(path string, config *Config) string {
+	if !config.CorrelationIDs {
+		return ""
+	}
+	id, _ := correlationIDs.LoadOrStore(filepath.Clean(path), newCorrelationID())
+	return id.(string)
+}
+
+// correlationOf returns the correlation ID of a source file, or "" if it
+// has none.
+func correlationOf(path string) string {
+	if id, ok := correlationIDs.Load(filepath.Clean(path)); ok {
+		return id.(string)
+	}
+	return ""
+}
+
+// forgetCorrelation drops the ID of a file that left the watch folder, so a
+// new file of the same name gets its own.
+func forgetCorrelation(path string) {
+	correlationIDs.Delete(filepath.Clean(path))
+}
+
+// forgetFinishedCorrelations drops the IDs of files that are gone, like
+// group members and files that were taken away by someone else.
+func forgetFinishedCorrelations() {
+	correlationIDs.Range(func(path, _ any) bool {
+		if _, err := os.Lstat(path.(string)); os.IsNotExist(err) {
+			correlationIDs.Delete(path)
+		}
+		return true
+	})
+}
+
+// newCorrelationID returns a random (version 4) UUID.
+func newCorrelationID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// correlationHandler adds the correlation ID to every log line whose "file"
+// attribute names a file that has one.
+type correlationHandler struct {
+	slog.Handler
+}
+
+func (h correlationHandler) Handle(ctx context.Context, record slog.Record) error {
+	var id string
+	record.Attrs(func(a slog.Attr) bool {
+		if a.Key == "file" {
+			id = correlationOf(a.Value.String())
+			return false
+		}
+		return true
+	})
+	if id != "" {
+		record = record.Clone()
+		record.AddAttrs(slog.String(correlationKey, id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h correlationHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return correlationHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h correlationHandler) WithGroup(name string) slog.Handler {
+	return correlationHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Webhook delivery attempts and the delay before the first retry, doubled
+// for each further one.
+const (
+	webhookAttempts   = 5
+	webhookRetryDelay = time.Second
+)
+
+// deadLetterEvent is the JSON body posted to DeadLetterWebhookURL.
+type deadLetterEvent struct {
+	File      string    `json:"file"`
+	Target    string    `json:"target,omitempty"`
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	Timestamp time.Time `json:"timestamp"`
+	// CorrelationID is set with CorrelationIDs
+	CorrelationID string `json:"correlationId,omitempty"`
+}
+
+// retriesExhaustedError is the reason a file is given up on after retries.
+type retriesExhaustedError struct {
+	attempts int
+	elapsed  time.Duration
+	err      error
+}
+
+func (e *retriesExhaustedError) Error() string {
+	return fmt.Sprintf("giving up after %d attempts in %s: %v", e.attempts, e.elapsed.Round(time.Second), e.err)
+}
+
+func (e *retriesExhaustedError) Unwrap() error {
+	return e.err
+}
+
+// postDeadLetter reports a file that ended up in the failed folder to
+// DeadLetterWebhookURL. It runs in the background and retries with backoff,
+// so a short webhook outage doesn't lose the report.
+func postDeadLetter(path, target string, reason error, config *Config) {
+	if config.DeadLetterWebhookURL == "" {
+		return
+	}
+
+	event := deadLetterEvent{File: path, Target: target, Error: reason.Error(), Attempts: 1, Timestamp: time.Now(), CorrelationID: correlationOf(path)}
+	var exhausted *retriesExhaustedError
+	if errors.As(reason, &exhausted) {
+		event.Attempts = exhausted.attempts
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Failed to encode dead-letter event", "file", path, "error", err)
+		return
+	}
+
+	url := config.DeadLetterWebhookURL
+	pendingAlerts.Add(1)
+	go func() {
+		defer pendingAlerts.Done()
+		delay := webhookRetryDelay
+		for attempt := 1; ; attempt++ {
+			err := postJSON(url, body)
+			if err == nil {
+				slog.Debug("Dead-letter webhook delivered", "file", path)
+				return
+			}
+			if attempt == webhookAttempts {
+				alert(fmt.Sprintf("Dead-letter webhook failed for %s: %v", path, err))
+				return
+			}
+			slog.Warn("Dead-letter webhook failed, retrying", "file", path, "attempt", attempt, "error", err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}()
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func postJSON(url string, body []byte) error {
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
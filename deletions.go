@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/sftp"
+)
+
+// toolRemovals remembers source files the tool deleted itself (e.g. after
+// moving them to the processed folder), so the Remove events fsnotify reports
+// for them are not mistaken for deletions made by a user.
+var toolRemovals = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: map[string]bool{}}
+
+// removeSourceFile deletes a source file and records the removal as our own.
+func removeSourceFile(path string) error {
+	return removeSourceFileWith(path, func() error { return os.Remove(path) })
+}
+
+// removeSourceFileWith records path as removed by the tool and runs remove,
+// which deletes or renames it away.
+func removeSourceFileWith(path string, remove func() error) error {
+	path = filepath.Clean(path)
+
+	toolRemovals.Lock()
+	toolRemovals.paths[path] = true
+	toolRemovals.Unlock()
+
+	err := remove()
+	if err != nil {
+		toolRemovals.Lock()
+		delete(toolRemovals.paths, path)
+		toolRemovals.Unlock()
+	}
+	return err
+}
+
+// wasRemovedByTool reports whether path was deleted by removeSourceFile and
+// forgets the record, so a later deletion of a new file with the same name is
+// seen as external again.
+func wasRemovedByTool(path string) bool {
+	path = filepath.Clean(path)
+
+	toolRemovals.Lock()
+	defer toolRemovals.Unlock()
+	if toolRemovals.paths[path] {
+		delete(toolRemovals.paths, path)
+		return true
+	}
+	return false
+}
+
+// mirrorDeletion removes the remote copy of a file that was deleted locally.
+// The remote path is the one recorded at the upload. Only without dated or
+// run folders it can be derived again for files without a record.
+func mirrorDeletion(localPath string, sftpClient *sftp.Client, config *Config) {
+	remotePath, ok := state.uploadedRemote(localPath)
+	if !ok {
+		if config.RemoteDirTemplate != "" || config.RunFolderTemplate != "" {
+			slog.Debug("No upload recorded for deleted file, nothing to mirror", "file", localPath)
+			return
+		}
+		remotePath = remotePathFor(localPath, config)
+	}
+	err := sftpClient.Remove(remotePath)
+	if errors.Is(err, os.ErrNotExist) {
+		// never uploaded, nothing to mirror
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to mirror deletion", "file", localPath, "remote", remotePath, "error", err)
+		return
+	}
+	slog.Info("Mirrored deletion: removed remote file", "remote", remotePath)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// defaultSftpPort is used unless another port is configured.
+const defaultSftpPort = 22
+
+// loadSftpServer reads SftpServer and SftpPort. The server may carry its
+// port, like ftp.yukawa.de:2222 or [2001:db8::1]:2222, which then must agree
+// with SftpPort if that is set too. Without a port 22 is used.
+func loadSftpServer(section *ini.Section, config *Config) error {
+	config.SftpServer = section.Key("SftpServer").String()
+	config.SftpPort = defaultSftpPort
+	key := section.Key("SftpPort")
+	if key.String() != "" {
+		port, err := parsePort(key.String())
+		if err != nil {
+			return fmt.Errorf("invalid SftpPort: %w", err)
+		}
+		config.SftpPort = port
+	}
+
+	host, rawPort, err := net.SplitHostPort(config.SftpServer)
+	if err != nil {
+		// no port, but IPv6 addresses may still come in brackets
+		config.SftpServer = strings.TrimSuffix(strings.TrimPrefix(config.SftpServer, "["), "]")
+		return nil
+	}
+	port, err := parsePort(rawPort)
+	if err != nil {
+		return fmt.Errorf("invalid port in SftpServer %q: %w", config.SftpServer, err)
+	}
+	if key.String() != "" && port != config.SftpPort {
+		return fmt.Errorf("SftpServer %q and SftpPort %d name different ports", config.SftpServer, config.SftpPort)
+	}
+	config.SftpServer, config.SftpPort = host, port
+	return nil
+}
+
+// sftpAddress returns the host:port to dial, with IPv6 addresses in
+// brackets.
+func sftpAddress(config *Config) string {
+	return net.JoinHostPort(config.SftpServer, strconv.Itoa(config.SftpPort))
+}
+
+// parsePort parses a TCP port number.
+func parsePort(raw string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("%q is not a port between 1 and 65535", raw)
+	}
+	return port, nil
+}
+
+// loadDestinationURL reads DestinationURL, e.g.
+// sftp://user@host:2222/~/AlpineGlow/Incoming/, and fills server, port, user
+// and destination folder from it, overriding the separate keys. As in ssh
+// URIs, a path starting with /~/ is relative to the login folder, any other
+// path is absolute. Passwords don't belong into the URL, they stay in
+// SftpPassword or the private key.
+func loadDestinationURL(section *ini.Section, config *Config) error {
+	raw := section.Key("DestinationURL").String()
+	if raw == "" {
+		return nil
+	}
+	raw, err := expandEnv("DestinationURL", raw)
+	if err != nil {
+		return err
+	}
+	return applySftpURL("DestinationURL", raw, config)
+}
+
+// applySftpURL fills server, port, user and destination folder of config
+// from the sftp:// URL raw, read from the key name.
+func applySftpURL(name, raw string, config *Config) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	switch {
+	case u.Scheme != "sftp":
+		return fmt.Errorf("%s must start with sftp://, got %q", name, u.Scheme)
+	case u.Hostname() == "":
+		return fmt.Errorf("%s has no host", name)
+	case u.RawQuery != "" || u.Fragment != "":
+		return fmt.Errorf("%s must not have a query or fragment", name)
+	}
+	if _, ok := u.User.Password(); ok {
+		return fmt.Errorf("%s must not contain a password, set SftpPassword instead", name)
+	}
+
+	config.SftpServer = u.Hostname()
+	if u.Port() != "" {
+		port, err := parsePort(u.Port())
+		if err != nil {
+			return fmt.Errorf("invalid port in %s: %w", name, err)
+		}
+		config.SftpPort = port
+	}
+	if u.User != nil && u.User.Username() != "" {
+		config.SftpUser = u.User.Username()
+	}
+
+	folder := u.Path
+	if folder == "/~" || strings.HasPrefix(folder, "/~/") {
+		folder = strings.TrimPrefix(strings.TrimPrefix(folder, "/~"), "/")
+	}
+	if folder != "" && !strings.HasSuffix(folder, "/") {
+		folder += "/"
+	}
+	config.destionationFolder = folder
+	return nil
+}
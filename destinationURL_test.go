@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/ini.v1"
+)
+
+func TestLoadSftpServer(t *testing.T) {
+	tests := []struct {
+		name, server, port string
+		want               string
+		wantErr            bool
+	}{
+		{"default port", "ftp.yukawa.de", "", "ftp.yukawa.de:22", false},
+		{"explicit port", "ftp.yukawa.de", "2222", "ftp.yukawa.de:2222", false},
+		{"port in server", "ftp.yukawa.de:2222", "", "ftp.yukawa.de:2222", false},
+		{"same port twice", "ftp.yukawa.de:2222", "2222", "ftp.yukawa.de:2222", false},
+		{"IPv6 default port", "2001:db8::1", "", "[2001:db8::1]:22", false},
+		{"IPv6 in brackets", "[2001:db8::1]", "2222", "[2001:db8::1]:2222", false},
+		{"IPv6 with port", "[2001:db8::1]:2222", "", "[2001:db8::1]:2222", false},
+		{"different ports", "ftp.yukawa.de:2222", "22", "", true},
+		{"invalid port", "ftp.yukawa.de", "ssh", "", true},
+		{"port out of range", "ftp.yukawa.de:70000", "", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			section := ini.Empty().Section("server")
+			section.Key("SftpServer").SetValue(test.server)
+			if test.port != "" {
+				section.Key("SftpPort").SetValue(test.port)
+			}
+			var config Config
+			err := loadSftpServer(section, &config)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("loadSftpServer accepted %q and port %q", test.server, test.port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sftpAddress(&config); got != test.want {
+				t.Errorf("sftpAddress = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Units of work accepted by WatchUnit.
+const (
+	watchUnitFile      = "file"
+	watchUnitDirectory = "directory"
+)
+
+// dirCheckInterval is how often pending directories are checked for
+// stability.
+const dirCheckInterval = 2 * time.Second
+
+// dirSignature summarizes a directory tree. While anything is still being
+// written into it, the signature keeps changing.
+type dirSignature struct {
+	files  int
+	size   int64
+	latest time.Time
+}
+
+// dirUnit is a subdirectory of FolderToWatch waiting to become stable.
+type dirUnit struct {
+	signature  dirSignature
+	lastChange time.Time
+}
+
+// pendingDirs holds the directories waiting to be uploaded. It is only used
+// from the main goroutine.
+var pendingDirs = map[string]*dirUnit{}
+
+// isDirectoryUnit reports whether path is a subdirectory of FolderToWatch
+// that is uploaded as a whole in WatchUnit=directory mode.
+func isDirectoryUnit(path string, config *Config) bool {
+	if config.WatchUnit != watchUnitDirectory || !isInWatchFolder(path, config) || isInternalFolder(path, config) {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// addDirectory starts tracking a directory. A directory that has not changed
+// for DirectoryQuietSeconds already, e.g. one found at startup, is stable
+// right away.
+func addDirectory(dir string, config *Config) {
+	dir = filepath.Clean(dir)
+	if _, ok := pendingDirs[dir]; ok {
+		return
+	}
+	if _, waiting := pendingRetries[dir]; waiting {
+		return
+	}
+	signature, err := signDirectory(dir)
+	if err != nil {
+		slog.Error("Failed to read directory", "dir", dir, "error", err)
+		return
+	}
+	slog.Info("New directory detected, waiting for it to settle", "dir", dir)
+	pendingDirs[dir] = &dirUnit{signature: signature, lastChange: clampFuture(dir, signature.latest, time.Now(), config)}
+}
+
+// checkDirectories uploads the pending directories that did not change for
+// DirectoryQuietSeconds and returns how many of those failed. Failed
+// directories are retried like files, outside --once mode.
+func checkDirectories(sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) int {
+	failed := 0
+	for dir, unit := range pendingDirs {
+		signature, err := signDirectory(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			slog.Debug("Directory is already gone, skipping it", "dir", dir)
+			delete(pendingDirs, dir)
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to read directory", "dir", dir, "error", err)
+			continue
+		}
+		if signature != unit.signature {
+			unit.signature = signature
+			unit.lastChange = time.Now()
+			continue
+		}
+		if time.Since(unit.lastChange) < config.DirectoryQuiet {
+			continue
+		}
+
+		delete(pendingDirs, dir)
+		err = uploadDirectory(dir, sftpClient, sshClient, config)
+		if err == nil {
+			forgetRetry(dir)
+			continue
+		}
+		failed++
+		if retryScanFailures {
+			scheduleRetry(dir, err, config)
+			continue
+		}
+		if isPermanentError(err, config) {
+			err = moveToFailed(dir, err, config)
+		}
+		if err != nil {
+			slog.Error("Failed to upload directory", "dir", dir, "error", err)
+		}
+	}
+	return failed
+}
+
+func signDirectory(dir string) (dirSignature, error) {
+	var signature dirSignature
+	err := filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(signature.latest) {
+			signature.latest = info.ModTime()
+		}
+		if info.Mode().IsRegular() {
+			signature.files++
+			signature.size += info.Size()
+		}
+		return nil
+	})
+	return signature, err
+}
+
+// uploadDirectory uploads the tree below dir into "<remote>.part" and renames
+// that to the final name once every file is there, then applies the default
+// post-upload action to the directory. A taken remote name is handled by
+// RemoteCollisionStrategy, hash-suffix works like counter for directories.
+// The upload is recorded in the state file until the directory is archived,
+// so a failure after the rename only repeats the archiving. A .part folder
+// left by a failed attempt is filled up again.
+func uploadDirectory(dir string, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) error {
+	if remoteDir, ok := state.uploadedRemote(dir); ok {
+		slog.Info("Directory was uploaded before, archiving it", "dir", dir, "remote", remoteDir)
+		return finishRecordedDirectory(dir, config)
+	}
+
+	remoteDir, err := resolveRemoteDir(sftpClient, remoteFolderFor(dir, config), config)
+	if errors.Is(err, errRemoteExists) {
+		slog.Warn("Remote directory already exists, upload skipped", "dir", dir, "remote", remoteFolderFor(dir, config))
+		if config.duplicatesFolder != "" {
+			target, err := moveLocalFile(dir, config.duplicatesFolder, config.CollisionStrategy)
+			if err != nil {
+				return fmt.Errorf("failed to move directory to duplicates folder: %w", err)
+			}
+			slog.Info("Directory moved to duplicates folder", "dir", dir, "target", target)
+			return nil
+		}
+		return finishDirectory(dir, config)
+	}
+	if err != nil {
+		return err
+	}
+	tempDir := remoteDir + remoteTempSuffix
+
+	count := 0
+	err = filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		remotePath := encryptedName(path.Join(tempDir, filepath.ToSlash(rel)), config)
+		err = sftpClient.MkdirAll(path.Dir(remotePath))
+		if err != nil {
+			return fmt.Errorf("failed to create remote folder %s: %w", path.Dir(remotePath), err)
+		}
+
+		file, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = copyFileToSftp(file, remotePath, sftpClient, sshClient, config)
+		if err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if config.RemoteCollisionStrategy == collisionOverwrite {
+		// a rename never replaces a folder
+		err = sftpClient.RemoveAll(remoteDir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove remote directory %s to overwrite it: %w", remoteDir, err)
+		}
+	}
+	err = sftpClient.Rename(tempDir, remoteDir)
+	if err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", tempDir, remoteDir, err)
+	}
+	slog.Info("Directory uploaded successfully", "dir", dir, "remote", remoteDir, "files", count)
+	if info, err := os.Stat(dir); err == nil {
+		err = state.markUploaded(dir, info, remoteDir)
+		if err != nil {
+			slog.Warn("Failed to record upload in state file", "dir", dir, "error", err)
+		}
+	}
+	return finishRecordedDirectory(dir, config)
+}
+
+// resolveRemoteDir applies RemoteCollisionStrategy to the remote directory
+// remoteDir.
+func resolveRemoteDir(sftpClient *sftp.Client, remoteDir string, config *Config) (string, error) {
+	strategy := config.RemoteCollisionStrategy
+	if strategy == collisionHashSuffix {
+		strategy = collisionCounter
+	}
+	exists := func(candidate string) (bool, error) {
+		return remoteFileExists(sftpClient, candidate)
+	}
+	resolved, err := resolveCollision(remoteDir, strategy, exists, nil)
+	if errors.Is(err, errNameTaken) {
+		return "", errRemoteExists
+	}
+	if err == nil && resolved != remoteDir {
+		slog.Info("Remote directory exists, uploading under a new name", "path", remoteDir, "remote", resolved, "strategy", strategy)
+	}
+	return resolved, err
+}
+
+// finishRecordedDirectory archives an uploaded directory and drops its
+// upload record.
+func finishRecordedDirectory(dir string, config *Config) error {
+	err := finishDirectory(dir, config)
+	if err != nil {
+		return err
+	}
+	err = state.forgetUploaded(dir)
+	if err != nil {
+		slog.Warn("Failed to update state file", "dir", dir, "error", err)
+	}
+	return nil
+}
+
+// finishDirectory moves an uploaded directory to the processed folder or
+// deletes it, following DefaultPostUploadAction. A taken name in the
+// processed folder is resolved with ProcessedCollisionStrategy, like for
+// files.
+func finishDirectory(dir string, config *Config) error {
+	if config.DefaultPostUploadAction == postUploadDelete {
+		return deleteDirectory(dir, "Directory deleted after upload")
+	}
+
+	target, err := moveLocalFile(dir, processedDirFor(dir, config), config.ProcessedCollisionStrategy)
+	if errors.Is(err, errNameTaken) {
+		return deleteDirectory(dir, "An archived directory of that name exists, deleted this one instead of archiving it")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to move directory to 'processed' folder: %w", err)
+	}
+	slog.Info("Directory moved to 'processed' folder", "dir", dir, "target", target)
+	return nil
+}
+
+// deleteDirectory removes an uploaded directory and logs message.
+func deleteDirectory(dir, message string) error {
+	err := removeSourceFileWith(dir, func() error { return os.RemoveAll(dir) })
+	if err != nil {
+		return fmt.Errorf("failed to delete directory: %w", err)
+	}
+	slog.Info(message, "dir", dir)
+	return nil
+}
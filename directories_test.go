@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFinishDirectoryCollision(t *testing.T) {
+	quietLogs(t)
+	tests := []struct {
+		strategy string
+		// want is the name the upload is archived under, "" when it is
+		// deleted
+		want string
+	}{
+		{collisionCounter, "batch_1"},
+		{collisionSkip, ""},
+		{collisionOverwrite, "batch"},
+		{collisionHashSuffix, "batch_"},
+	}
+	for _, test := range tests {
+		t.Run(test.strategy, func(t *testing.T) {
+			folder := t.TempDir()
+			processed := filepath.Join(folder, "processed")
+			config := testConfig(t, folder, map[string]string{
+				"general.WatchUnit":                  "directory",
+				"general.ProcessedCollisionStrategy": test.strategy,
+			})
+			old := filepath.Join(processed, "batch")
+			os.MkdirAll(old, 0755)
+			writeFile(t, filepath.Join(old, "a.csv"), "archived before")
+			dir := filepath.Join(folder, "batch")
+			os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+			writeFile(t, filepath.Join(dir, "sub", "a.csv"), "uploaded")
+
+			err := finishDirectory(dir, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("uploaded directory is still in the watch folder: %v", err)
+			}
+			matches, _ := filepath.Glob(filepath.Join(processed, test.want+"*", "sub", "a.csv"))
+			if test.want == "" {
+				if len(matches) != 0 {
+					t.Errorf("directory archived as %v, want it deleted", matches)
+				}
+			} else if len(matches) != 1 {
+				t.Errorf("archived copies %v, want one named %s", matches, test.want)
+			}
+			if test.strategy != collisionOverwrite {
+				if _, err := os.Stat(filepath.Join(old, "a.csv")); err != nil {
+					t.Errorf("the directory archived before is gone: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// TestCopyTree covers the copy moveLocalDir falls back to across file
+// systems, where a rename fails.
+func TestCopyTree(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "batch")
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	writeFile(t, filepath.Join(src, "sub", "a.csv"), "id;amount\n")
+	err := os.Symlink("sub/a.csv", filepath.Join(src, "latest"))
+	if err != nil {
+		t.Skip("no symbolic links:", err)
+	}
+	os.Chmod(filepath.Join(src, "sub", "a.csv"), 0600)
+
+	dst := filepath.Join(t.TempDir(), "batch")
+	err = copyTree(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dst, "latest"))
+	if err != nil || string(data) != "id;amount\n" {
+		t.Errorf("copied link reads %q, %v", data, err)
+	}
+	info, err := os.Stat(filepath.Join(dst, "sub", "a.csv"))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("copied file: %v, %v, want mode 0600", info, err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+)
+
+// errDiskSpaceUnknown is returned on platforms where free space can't be read.
+var errDiskSpaceUnknown = errors.New("free disk space is not available on this platform")
+
+// checkFreeSpace makes sure dir's volume can take needed more bytes while
+// keeping FreeSpaceMarginMB free. Platforms without free-space information
+// always pass.
+func checkFreeSpace(dir string, needed int64, config *Config) error {
+	available, err := availableDiskSpace(dir)
+	if errors.Is(err, errDiskSpaceUnknown) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check free disk space in %s: %w", dir, err)
+	}
+
+	required := uint64(needed) + uint64(config.FreeSpaceMarginMB)*1024*1024
+	if available < required {
+		return fmt.Errorf("not enough free disk space in %s: %d MB available, %d MB required", dir, available/1024/1024, required/1024/1024)
+	}
+	slog.Debug("Free disk space ok", "dir", dir, "availableMB", available/1024/1024, "requiredMB", required/1024/1024)
+	return nil
+}
+
+// lowInodesReported keeps a shortage from raising an alert for every file.
+var lowInodesReported atomic.Bool
+
+// checkFreeInodes makes sure the volume of dir has at least MinFreeInodes
+// free inodes. Many tiny files can exhaust them while space is left, which
+// otherwise surfaces as confusing ENOSPC errors when archiving.
+func checkFreeInodes(dir string, config *Config) error {
+	if config.MinFreeInodes <= 0 {
+		return nil
+	}
+	available, err := availableInodes(dir)
+	if errors.Is(err, errDiskSpaceUnknown) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check free inodes in %s: %w", dir, err)
+	}
+
+	if available < uint64(config.MinFreeInodes) {
+		err = fmt.Errorf("not enough free inodes in %s: %d available, %d required", dir, available, config.MinFreeInodes)
+		if !lowInodesReported.Swap(true) {
+			alert("Pausing uploads: " + err.Error())
+		}
+		return err
+	}
+	if lowInodesReported.Swap(false) {
+		slog.Info("Free inodes available again, resuming uploads", "dir", dir, "available", available)
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package main
+
+func availableDiskSpace(path string) (uint64, error) {
+	return 0, errDiskSpaceUnknown
+}
+
+func availableInodes(path string) (uint64, error) {
+	return 0, errDiskSpaceUnknown
+}
@@ -0,0 +1,21 @@
+package main
+
+import "golang.org/x/sys/windows"
+
+func availableDiskSpace(path string) (uint64, error) {
+	dir, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free uint64
+	err = windows.GetDiskFreeSpaceEx(dir, &available, &total, &free)
+	if err != nil {
+		return 0, err
+	}
+	return available, nil
+}
+
+// NTFS has no fixed inode table that could run out.
+func availableInodes(path string) (uint64, error) {
+	return 0, errDiskSpaceUnknown
+}
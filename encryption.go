@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"gopkg.in/ini.v1"
+)
+
+// encryptedSuffix is appended to the remote name of encrypted files.
+const encryptedSuffix = ".gpg"
+
+// loadEncryption reads EncryptWith, the armored OpenPGP public key files are
+// encrypted to before upload. The key must be able to encrypt now, an
+// expired or signing-only key is a configuration error.
+func loadEncryption(section *ini.Section, config *Config) error {
+	config.EncryptWith = section.Key("EncryptWith").String()
+	if config.EncryptWith == "" {
+		return nil
+	}
+	if config.UploadMode == uploadModeAppend {
+		return fmt.Errorf("EncryptWith cannot be used with UploadMode = append")
+	}
+	if config.UploadBackend == uploadBackendExternal {
+		return fmt.Errorf("EncryptWith cannot be used with UploadBackend = external")
+	}
+
+	file, err := os.Open(config.EncryptWith)
+	if err != nil {
+		return fmt.Errorf("failed to read EncryptWith key: %w", err)
+	}
+	defer file.Close()
+	recipients, err := openpgp.ReadArmoredKeyRing(file)
+	if err != nil {
+		return fmt.Errorf("failed to parse EncryptWith key %s: %w", config.EncryptWith, err)
+	}
+	for _, recipient := range recipients {
+		if _, ok := recipient.EncryptionKey(time.Now()); !ok {
+			return fmt.Errorf("EncryptWith key %s has no valid encryption key, it may have expired", config.EncryptWith)
+		}
+	}
+	config.encryptTo = recipients
+	return nil
+}
+
+// encryptedName adds encryptedSuffix to the remote name of a file when
+// uploads are encrypted.
+func encryptedName(remotePath string, config *Config) string {
+	if config.encryptTo == nil {
+		return remotePath
+	}
+	return remotePath + encryptedSuffix
+}
+
+// encryptingWriter returns a writer that encrypts everything written to it
+// for the EncryptWith recipients and passes the OpenPGP message on to w. It
+// must be closed to complete the message. name ends up in the literal data
+// packet, so the receiver gets the original file name back.
+func encryptingWriter(w io.Writer, name string, config *Config) (io.WriteCloser, error) {
+	hints := &openpgp.FileHints{IsBinary: true, FileName: filepath.Base(name), ModTime: time.Now()}
+	encrypted, err := openpgp.Encrypt(w, config.encryptTo, nil, hints, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start encryption: %w", err)
+	}
+	return encrypted, nil
+}
+
+// copyEncrypted encrypts src into w. The hashes see the encrypted data.
+func copyEncrypted(w io.Writer, src io.Reader, name string, hashes []io.Writer, config *Config) error {
+	if len(hashes) > 0 {
+		w = io.MultiWriter(append([]io.Writer{w}, hashes...)...)
+	}
+	encrypted, err := encryptingWriter(w, name, config)
+	if err != nil {
+		return err
+	}
+	_, err = copyBuffered(encrypted, src, config)
+	if err != nil {
+		return err
+	}
+	return encrypted.Close()
+}
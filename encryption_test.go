@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"gopkg.in/ini.v1"
+)
+
+// writePublicKey writes the armored public key of entity to a file in dir.
+func writePublicKey(t *testing.T, dir string, entity *openpgp.Entity) string {
+	t.Helper()
+	path := filepath.Join(dir, "partner.asc")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	armored, err := armor.Encode(file, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = entity.Serialize(armored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = armored.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	partner, err := openpgp.NewEntity("Partner", "", "partner@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig(t, t.TempDir(), map[string]string{"paths.EncryptWith": writePublicKey(t, t.TempDir(), partner)})
+	if got := encryptedName("in/report.csv", config); got != "in/report.csv.gpg" {
+		t.Errorf("encryptedName = %q, want in/report.csv.gpg", got)
+	}
+
+	content := strings.Repeat("id;amount\n1;42\n", 10000)
+	var uploaded bytes.Buffer
+	hash := sha256.New()
+	err = copyEncrypted(&uploaded, strings.NewReader(content), "in/report.csv", []io.Writer{hash}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the hash is of what was uploaded, so a verify can compare it remotely
+	if got := sha256.Sum256(uploaded.Bytes()); !bytes.Equal(hash.Sum(nil), got[:]) {
+		t.Error("the hash does not match the encrypted data")
+	}
+	if bytes.Contains(uploaded.Bytes(), []byte("id;amount")) {
+		t.Error("the upload contains the plain text")
+	}
+
+	message, err := openpgp.ReadMessage(&uploaded, openpgp.EntityList{partner}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := io.ReadAll(message.UnverifiedBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != content {
+		t.Errorf("decrypted %d bytes that differ from the %d bytes encrypted", len(decrypted), len(content))
+	}
+	if message.LiteralData.FileName != "report.csv" {
+		t.Errorf("file name %q in the message, want report.csv", message.LiteralData.FileName)
+	}
+}
+
+func TestLoadEncryptionErrors(t *testing.T) {
+	partner, err := openpgp.NewEntity("Partner", "", "partner@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := writePublicKey(t, t.TempDir(), partner)
+	notAKey := filepath.Join(t.TempDir(), "partner.asc")
+	writeFile(t, notAKey, "not a key")
+
+	tests := []struct {
+		name, key, uploadMode string
+	}{
+		{"missing key", filepath.Join(t.TempDir(), "missing.asc"), ""},
+		{"not a key", notAKey, ""},
+		{"append", key, uploadModeAppend},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			section := ini.Empty().Section("paths")
+			section.Key("EncryptWith").SetValue(test.key)
+			config := Config{UploadMode: test.uploadMode}
+			if err := loadEncryption(section, &config); err == nil {
+				t.Error("loadEncryption accepted the configuration")
+			}
+		})
+	}
+}
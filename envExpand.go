@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// expandEnv replaces ${VAR} and ${VAR:-default} in the value of the setting
+// name with environment variables, once at startup. A variable that is unset
+// or empty takes the default, without a default it is a configuration error,
+// so an instance never silently writes into a shared path. A $ that doesn't
+// start ${ is kept as it is, as are the date placeholders of templates.
+func expandEnv(name, value string) (string, error) {
+	var out strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			out.WriteString(value)
+			return out.String(), nil
+		}
+		end := strings.IndexByte(value[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("%s has an unterminated ${ in %q", name, value)
+		}
+		out.WriteString(value[:start])
+
+		variable, fallback, hasDefault := strings.Cut(value[start+2:start+end], ":-")
+		if variable == "" {
+			return "", fmt.Errorf("%s has an empty ${} in %q", name, value)
+		}
+		resolved := os.Getenv(variable)
+		if resolved == "" {
+			if !hasDefault {
+				return "", fmt.Errorf("%s uses environment variable %s, which is not set", name, variable)
+			}
+			resolved = fallback
+		}
+		out.WriteString(resolved)
+		value = value[start+end+1:]
+	}
+}
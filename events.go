@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"gopkg.in/ini.v1"
+)
+
+// Message buses accepted by [events] Type.
+const (
+	eventsNone = "none"
+	eventsNATS = "nats"
+)
+
+// eventsFlushTimeout bounds how long exit waits for queued events.
+const eventsFlushTimeout = 5 * time.Second
+
+// uploadEvent is the JSON message published for every uploaded file.
+type uploadEvent struct {
+	File      string    `json:"file"`
+	Remote    string    `json:"remote"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	// CorrelationID is set with CorrelationIDs
+	CorrelationID string `json:"correlationId,omitempty"`
+}
+
+// eventPublisher sends upload events from a bounded queue in the background,
+// so a slow or unreachable broker never holds up uploads. Events that don't
+// fit into the queue are dropped.
+type eventPublisher struct {
+	conn    *nats.Conn
+	subject string
+	queue   chan uploadEvent
+	done    chan struct{}
+}
+
+// publisher is started by initialize, nil when no events are configured.
+var publisher *eventPublisher
+
+// loadEvents reads the [events] section.
+func loadEvents(section *ini.Section, config *Config) error {
+	var err error
+	config.EventsType, err = oneOf(section.Key("Type"), eventsNone, eventsNATS)
+	if err != nil {
+		return err
+	}
+	config.EventsURL = section.Key("URL").MustString(nats.DefaultURL)
+	config.EventsSubject = section.Key("Subject").MustString("filewatcher.uploaded")
+	config.EventsBufferSize = section.Key("BufferSize").MustInt(1000)
+	if config.EventsBufferSize < 0 {
+		return fmt.Errorf("[events] BufferSize must not be negative, got %d", config.EventsBufferSize)
+	}
+	return nil
+}
+
+// startEventPublisher connects to the broker. The connection is retried in
+// the background, events queue up meanwhile.
+func startEventPublisher(config *Config) error {
+	if config.EventsType == eventsNone {
+		return nil
+	}
+
+	conn, err := nats.Connect(config.EventsURL,
+		nats.Name("filewatcher"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				slog.Warn("Lost connection to event broker", "error", err)
+			}
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			slog.Info("Reconnected to event broker", "url", conn.ConnectedUrl())
+		}),
+	)
+	if err != nil {
+		return err
+	}
+
+	publisher = &eventPublisher{
+		conn:    conn,
+		subject: config.EventsSubject,
+		queue:   make(chan uploadEvent, config.EventsBufferSize),
+		done:    make(chan struct{}),
+	}
+	go publisher.run()
+	slog.Info("Publishing upload events", "type", config.EventsType, "url", config.EventsURL, "subject", config.EventsSubject)
+	return nil
+}
+
+func (p *eventPublisher) run() {
+	defer close(p.done)
+	for event := range p.queue {
+		data, err := json.Marshal(event)
+		if err != nil {
+			slog.Error("Failed to encode upload event", "file", event.File, "error", err)
+			continue
+		}
+		err = p.conn.Publish(p.subject, data)
+		if err != nil {
+			slog.Warn("Failed to publish upload event", "file", event.File, "error", err)
+		}
+	}
+}
+
+// publishUploadEvent queues an event for an uploaded file without blocking.
+func publishUploadEvent(localPath, remotePath string, size int64, checksum []byte) {
+	if publisher == nil {
+		return
+	}
+	event := uploadEvent{File: localPath, Remote: remotePath, Size: size, SHA256: hex.EncodeToString(checksum), Timestamp: time.Now(), CorrelationID: correlationOf(localPath)}
+	select {
+	case publisher.queue <- event:
+	default:
+		slog.Warn("Event queue is full, dropping upload event", "file", localPath)
+	}
+}
+
+// stopEventPublisher gives queued events a moment to reach the broker before
+// the process exits.
+func stopEventPublisher() {
+	if publisher == nil {
+		return
+	}
+	close(publisher.queue)
+	select {
+	case <-publisher.done:
+		err := publisher.conn.FlushTimeout(eventsFlushTimeout)
+		if err != nil {
+			slog.Warn("Upload events may not have reached the broker", "error", err)
+		}
+	case <-time.After(eventsFlushTimeout):
+		slog.Warn("Upload events did not finish in time")
+	}
+	publisher.conn.Close()
+}
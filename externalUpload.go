@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"gopkg.in/ini.v1"
+)
+
+// Transfer backends accepted by UploadBackend.
+const (
+	uploadBackendSftp      = "sftp"
+	uploadBackendExternal  = "external"
+	uploadBackendAzureBlob = "azblob"
+	uploadBackendGCS       = "gcs"
+)
+
+// loadExternalUpload reads UploadBackend and, for the external backend, the
+// command and its timeout. The program the command names must be installed,
+// it is looked up at startup so a missing rsync or scp isn't discovered with
+// the first file.
+func loadExternalUpload(section *ini.Section, config *Config) error {
+	var err error
+	config.UploadBackend, err = oneOf(section.Key("UploadBackend"), uploadBackendSftp, uploadBackendExternal, uploadBackendAzureBlob, uploadBackendGCS)
+	if err != nil {
+		return err
+	}
+	if config.UploadBackend != uploadBackendExternal {
+		return nil
+	}
+
+	config.ExternalUploadCommand = section.Key("ExternalUploadCommand").String()
+	args := strings.Fields(config.ExternalUploadCommand)
+	if len(args) == 0 {
+		return fmt.Errorf("UploadBackend = external needs ExternalUploadCommand")
+	}
+	_, err = exec.LookPath(args[0])
+	if err != nil {
+		return fmt.Errorf("ExternalUploadCommand: %w", err)
+	}
+	config.ExternalUploadTimeout = time.Duration(section.Key("ExternalUploadTimeoutSeconds").MustInt(600)) * time.Second
+	return nil
+}
+
+// externalUploadProgram returns the program ExternalUploadCommand runs.
+func externalUploadProgram(config *Config) string {
+	args := strings.Fields(config.ExternalUploadCommand)
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+// runExternalUpload sends localPath to remotePath with ExternalUploadCommand.
+// Like PostUploadCommand the template is split into arguments before {file},
+// {remote}, {dest}, {host}, {port} and {user} are replaced, no shell is
+// involved. A non-zero exit status or a timeout is an upload error and goes
+// through the usual retries.
+func runExternalUpload(localPath, remotePath string, sftpClient *sftp.Client, config *Config) error {
+	waitForUploadSlot(config)
+	err := ensureRemoteParent(sftpClient, remotePath, config)
+	if err != nil {
+		return err
+	}
+
+	args := strings.Fields(config.ExternalUploadCommand)
+	values := map[string]string{
+		"file":   localPath,
+		"remote": remotePath,
+		"dest":   remotePath,
+		"host":   config.SftpServer,
+		"port":   strconv.Itoa(config.SftpPort),
+		"user":   config.SftpUser,
+	}
+	for i, arg := range args {
+		args[i] = expandTemplate(arg, values)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ExternalUploadTimeout)
+	defer cancel()
+	start := time.Now()
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s", config.ExternalUploadTimeout)
+	}
+	if err != nil {
+		slog.Error("External upload command failed", "file", localPath, "command", args[0], "error", err, "output", strings.TrimSpace(string(output)))
+		return fmt.Errorf("external upload command %s failed: %w", args[0], err)
+	}
+	slog.Info("File uploaded with external command", "file", localPath, "remote", remotePath, "command", args[0], "duration", time.Since(start).Round(time.Millisecond))
+	slog.Debug("External upload command output", "file", localPath, "output", strings.TrimSpace(string(output)))
+	return nil
+}
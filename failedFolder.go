@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// errorSidecarExt is appended to the name of a file in FailedFolder for the
+// text file explaining why it is there.
+const errorSidecarExt = ".error"
+
+// moveToFailed moves a source file that could not be delivered into
+// FailedFolder. Without a FailedFolder the file stays where it is.
+func moveToFailed(path string, reason error, config *Config) error {
+	failedFiles.Add(1)
+	if config.failedFolder == "" {
+		slog.Error("File could not be delivered and stays in place, set FailedFolder to move such files aside", "file", path, "error", reason)
+		postDeadLetter(path, "", reason, config)
+		return nil
+	}
+
+	target, err := moveLocalFile(path, config.failedFolder, config.FailedCollisionStrategy)
+	if errors.Is(err, errNameTaken) {
+		slog.Error("File could not be delivered and stays in place, its name is taken in the 'failed' folder", "file", path, "error", reason)
+		postDeadLetter(path, "", reason, config)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to move file to 'failed' folder: %w", err)
+	}
+	slog.Error("File could not be delivered, moved to 'failed' folder", "file", path, "target", target, "error", reason)
+	// an upload that could not be archived is not pending anymore
+	err = state.forgetUploaded(path)
+	if err != nil {
+		slog.Warn("Failed to update state file", "file", path, "error", err)
+	}
+	writeErrorSidecar(path, target, reason)
+	pruneEmptyDirs(filepath.Dir(path), config)
+	postDeadLetter(path, target, reason, config)
+	return nil
+}
+
+// writeErrorSidecar writes the reason why path could not be delivered next
+// to its copy target in the failed folder, for whoever looks into it later.
+// The file is already in place, so failing to write this is only logged.
+func writeErrorSidecar(path, target string, reason error) {
+	attempts := 1
+	var exhausted *retriesExhaustedError
+	if errors.As(reason, &exhausted) {
+		attempts = exhausted.attempts
+	}
+	text := fmt.Sprintf("file: %s\nfailed: %s\nattempts: %d\nerror: %v\n", path, time.Now().Format(time.RFC3339), attempts, reason)
+	err := os.WriteFile(target+errorSidecarExt, []byte(text), 0644)
+	if err != nil {
+		slog.Warn("Failed to write error file", "file", target+errorSidecarExt, "error", err)
+	}
+}
+
+// isErrorSidecar reports whether path is an error file in the failed
+// folder, also when the file it was written for is gone. Elsewhere files
+// ending in .error are ordinary data.
+func isErrorSidecar(path string, config *Config) bool {
+	if config.failedFolder == "" || !strings.HasSuffix(path, errorSidecarExt) {
+		return false
+	}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return false
+	}
+	failedFolder, err := filepath.Abs(config.failedFolder)
+	return err == nil && dir == failedFolder
+}
+
+// moveToQuarantine moves a file that must not be uploaded as it is into
+// QuarantineFolder. Without one it is handled like a failed file.
+func moveToQuarantine(path string, reason error, config *Config) error {
+	if config.quarantineFolder == "" {
+		return moveToFailed(path, reason, config)
+	}
+	target, err := moveLocalFile(path, config.quarantineFolder, config.FailedCollisionStrategy)
+	if err != nil {
+		return fmt.Errorf("failed to move file to quarantine folder: %w", err)
+	}
+	slog.Warn("File moved to quarantine folder", "file", path, "target", target, "reason", reason)
+	return finishSourceFile(path, config)
+}
+
+// moveLocalFile moves path into dir, creating dir when needed. A taken name
+// is resolved with strategy, errNameTaken means the file stays. A rename is
+// tried first, copying is the fallback for moves across file systems. path
+// may be a directory, see moveLocalDir.
+func moveLocalFile(path, dir, strategy string) (string, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	target, err := localTarget(path, dir, strategy)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Lstat(path); err == nil && info.IsDir() {
+		return target, moveLocalDir(path, target)
+	}
+
+	// record the removal first, the rename shows up as one for the watcher
+	err = removeSourceFileWith(path, func() error { return os.Rename(path, target) })
+	if err == nil {
+		return target, nil
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(target)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(dst, src)
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(target)
+		return "", err
+	}
+	src.Close()
+	return target, removeSourceFile(path)
+}
+
+// moveLocalDir moves the directory path to target. A directory already at
+// target, which only the overwrite and hash-suffix strategies leave there,
+// is replaced. Across file systems the tree is copied and then removed, a
+// copy that fails halfway is removed again.
+func moveLocalDir(path, target string) error {
+	err := os.RemoveAll(target)
+	if err != nil {
+		return err
+	}
+	err = removeSourceFileWith(path, func() error { return os.Rename(path, target) })
+	if err == nil {
+		return nil
+	}
+
+	err = copyTree(path, target)
+	if err != nil {
+		os.RemoveAll(target)
+		return err
+	}
+	return removeSourceFileWith(path, func() error { return os.RemoveAll(path) })
+}
+
+// copyTree copies the directory src to dst with the files, folders and
+// symbolic links in it, keeping their permissions.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(p string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case entry.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case entry.Type()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case entry.Type().IsRegular():
+			return copyLocalFile(p, target, info.Mode().Perm())
+		default:
+			return fmt.Errorf("can't copy %s, it is not a regular file", p)
+		}
+	})
+}
+
+func copyLocalFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
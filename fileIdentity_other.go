@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// fileIdentity is not supported here, hard-linked duplicates are not
+// detected.
+func fileIdentity(info os.FileInfo) (id fileID, links uint64, ok bool) {
+	return fileID{}, 0, false
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// fileOwner is not supported here, files have no numeric owner. Owner
+// filters are ignored.
+func fileOwner(path string) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
@@ -1,32 +1,353 @@
 package main
 
 import (
+	"crypto/sha256"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/fsnotify/fsnotify"
-	"github.com/gen2brain/beeep"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"gopkg.in/ini.v1"
 )
 
+// Exit codes, documented in the README. Orchestration relies on them to tell
+// a broken config (don't retry) from transient trouble (retry).
+const (
+	exitOK              = 0
+	exitRuntimeError    = 1
+	exitConfigError     = 2
+	exitConnectionError = 3
+	exitFileFailures    = 4
+)
+
+// scanBatchSize is how many directory entries the startup scan reads at once.
+const scanBatchSize = 1000
+
+// Bounds for the CopyBufferSizeKB setting. The default matches io.Copy.
+// BenchmarkCopyBuffered finds no gain from a larger buffer for uploads,
+// which are bound by the SFTP packets (see sftpCopyBufferKB), and about 10%
+// for local copies with 256 KB or more, so the default stays small.
+const (
+	defaultCopyBufferSizeKB = 32
+	minCopyBufferSizeKB     = 4
+	maxCopyBufferSizeKB     = 16 * 1024
+)
+
 type Config struct {
-	FolderToWatch      string
-	SftpServer         string
-	SftpUser           string
-	SftpPassword       string
-	PrivateKeyPath     string
-	WatchExtensions    []string
-	destionationFolder string
-	processedFolder    string
+	FolderToWatch   string
+	SftpServer      string
+	SftpPort        int
+	SftpUser        string
+	SftpPassword    string
+	PrivateKeyPath  string
+	WatchExtensions []string
+	WatchFiles      []string
+	StateFile       string
+	UploadMode      string
+	// delete remote files older than RemoteRetentionDays, see remoteRetention.go
+	RemoteRetentionDays     int
+	RemoteRetentionDryRun   bool
+	RemoteRetentionInterval time.Duration
+	WaitForWatchFolder      bool
+	WatchFolderMaxWait      time.Duration
+	CreateWatchFolder       bool
+	destionationFolder      string
+	RemoteUID               int
+	RemoteGID               int
+	StrictChown             bool
+	CopyBufferSizeKB        int
+	MirrorDeletions         bool
+	VerifyUpload            string
+	LogLevel                slog.Level
+	// upload a "<file>.<ChecksumAlgorithm>" sidecar next to every file
+	WriteRemoteChecksumSidecar bool
+	ChecksumAlgorithm          string
+	// per extension post-upload action, see postUpload.go
+	PostUploadActions       map[string]string
+	DefaultPostUploadAction string
+	processedFolder         string
+	failedFolder            string
+	// only process a data file once "<file><TriggerFileSuffix>" exists
+	TriggerFileSuffix string
+	TriggerFileAction string
+	// deliver related files as one tar, see groups.go
+	GroupPattern               *regexp.Regexp
+	GroupMembers               []string
+	GroupMemberCount           int
+	GroupTimeout               time.Duration
+	EnableDesktopNotifications string
+	FreeSpaceMarginMB          int
+	// SSH algorithm overrides for legacy servers
+	SshCiphers      []string
+	SshMACs         []string
+	SshKeyExchanges []string
+	configFile      string
+	configFiles     []string
+	// optional proxy for the SSH connection, see proxy.go
+	ProxyType     string
+	ProxyAddress  string
+	ProxyUser     string
+	ProxyPassword string
+	// extended attributes for uploaded files, see metadata.go
+	Metadata map[string]string
+	BatchID  string
+	// upload retries, see retry.go
+	MaxRetries            int
+	RetryDelay            time.Duration
+	RetryMaxDelay         time.Duration
+	RetryScheduling       string
+	MaxTotalRetryDuration time.Duration
+	// file name filters, see filter.go
+	MatchRegex  *regexp.Regexp
+	IgnoreRegex *regexp.Regexp
+	// remote completion protocol, see sidecar.go
+	AtomicUpload           bool
+	WriteRemoteReadyMarker bool
+	ReadyMarkerSuffix      string
+	// handling of taken names, see collisions.go
+	CollisionStrategy          string
+	RemoteCollisionStrategy    string
+	ProcessedCollisionStrategy string
+	FailedCollisionStrategy    string
+	duplicatesFolder           string
+	// integration hook, see postUploadCommand.go
+	PostUploadCommand               string
+	PostUploadCommandTimeout        time.Duration
+	AlertOnPostUploadCommandFailure bool
+	// uploads per minute, 0 is unlimited, see rateLimit.go
+	MaxFilesPerMinute int
+	// periodic write/read/delete canary, see selfTest.go
+	SelfTestInterval   time.Duration
+	SelfTestRemotePath string
+	// keep local paths below this root in remote names, see remotePathRoot.go
+	RemotePathRoot string
+	// upload archive members instead of archives, see archives.go
+	ExpandArchives bool
+	// follow a repointed FolderToWatch symlink, see watchSymlink.go
+	ResolveWatchSymlink  bool
+	SymlinkCheckInterval time.Duration
+	// activity log line, see heartbeat.go
+	HeartbeatInterval time.Duration
+	// for encrypted keys and certificates, see privateKey.go
+	PrivateKeyPassphrase string
+	PrivateKeyCertPath   string
+	// run on the server after each upload, see postUploadCommand.go
+	PostUploadRemoteCommand string
+	// free inodes required on the watch volume, see diskSpace.go
+	MinFreeInodes int64
+	// upload subfolders as a unit, see directories.go
+	WatchUnit      string
+	DirectoryQuiet time.Duration
+	// reports files given up on, see deadLetter.go
+	DeadLetterWebhookURL string
+	// publishes upload events, see events.go
+	EventsType       string
+	EventsURL        string
+	EventsSubject    string
+	EventsBufferSize int
+	// reaction to the server refusing writes, see remotePermission.go
+	OnRemotePermissionDenied string
+	// dated remote subfolders, see remoteDirTemplate.go
+	RemoteDirTemplate string
+	RemoteDirLocation *time.Location
+	// cancels uploads that take too long, see uploadDeadline.go
+	PerFileUploadDeadline time.Duration
+	slowFolder            string
+	// discards uploads of files still being written, see changedDuringTransfer.go
+	ReuploadIfChangedDuringTransfer bool
+	// tolerance for file times in the future, see clockSkew.go
+	MaxClockSkew time.Duration
+	// waiting out a full server, see serverBusy.go
+	ServerBusyMaxWait time.Duration
+	// separate upload and archive filters, see filter.go
+	UploadFilter  []string
+	ArchiveFilter []string
+	// group batches by time and deliver them as folders, see groups.go
+	GroupWindow         time.Duration
+	GroupDelivery       string
+	GroupCompleteMarker string
+	// explains skipped files, see skips.go
+	LogSkips bool
+	// transfers through rsync, scp and the like, see externalUpload.go
+	UploadBackend         string
+	ExternalUploadCommand string
+	ExternalUploadTimeout time.Duration
+	// limits for the processed folder, see processedRetention.go
+	ProcessedRetentionDays     int
+	ProcessedMaxFiles          int
+	ProcessedRetentionDryRun   bool
+	ProcessedRetentionInterval time.Duration
+	// OpenPGP encryption before upload, see encryption.go
+	EncryptWith string
+	encryptTo   openpgp.EntityList
+	// handling of empty files, see zeroByte.go
+	ZeroByteFilePolicy   string
+	ZeroByteWaitFallback string
+	ZeroByteWaitTimeout  time.Duration
+	// owner filters, see filter.go
+	AllowedOwnerUIDs []uint32
+	AllowedOwnerGIDs []uint32
+	// SSH key renegotiation and the first request, see rekey.go
+	RekeyThreshold   uint64
+	WarmUpConnection bool
+	// run statistics in heartbeat and shutdown logs, see throughput.go
+	LogThroughputStats bool
+	// staging area for intermediate files, see archives.go
+	TempDir string
+	// ignore files last modified before this window, see filter.go
+	OnlyProcessModifiedWithin time.Duration
+	// receiver acknowledgments before archiving, see acks.go
+	AckFolder       string
+	AckSuffix       string
+	AckTimeout      time.Duration
+	AckPollInterval time.Duration
+	// remove subfolders left empty by processing, see pruneDirs.go
+	PruneEmptyDirs bool
+	// SFTP request sizing, see sftpTuning.go
+	SftpMaxPacketKB           int
+	SftpMaxConcurrentRequests int
+	SftpConcurrentWrites      bool
+	// best-effort copies to a second server, see shadow.go
+	ShadowDestination string
+	ShadowQueueSize   int
+	shadow            *Config
+	// one remote folder per run, see runFolder.go
+	RunFolderTemplate string
+	RunFolderRollover time.Duration
+	// names of an already uploaded file, see hardLinks.go
+	HardLinkPolicy string
+	HardLinkWindow time.Duration
+	// PartFileRecovery handles .part temporaries left by a crash at
+	// startup, see partRecovery.go
+	PartFileRecovery string
+	PartFileMinAge   time.Duration
+	// EventBufferSize, InotifyMaxQueuedEvents and RescanInterval guard
+	// against lost events, see rescan.go
+	EventBufferSize        int
+	InotifyMaxQueuedEvents int
+	RescanInterval         time.Duration
+	// asks a command before each upload, see shouldUpload.go
+	ShouldUploadCommand        string
+	ShouldUploadCommandTimeout time.Duration
+	ShouldUploadRejected       string
+	quarantineFolder           string
+	// tags each file with a UUID, see correlation.go
+	CorrelationIDs bool
+	// uploads the output of a command instead of the file, see transform.go
+	TransformCommand        string
+	TransformCommandTimeout time.Duration
+	// turns messy local names into safe remote names, see filenames.go
+	NormalizeFilenames string
+	FilenameEncoding   string
+	FilenameMapFile    string
+	// tunes the write requests in flight per upload, see
+	// adaptiveConcurrency.go
+	AdaptiveConcurrency bool
+	MinConcurrency      int
+	MaxConcurrency      int
+	// names differing only in case collide on the server, see collisions.go
+	RemoteCaseInsensitive bool
+	// how long new files must stay unchanged before upload, see stabilization.go
+	StabilizationDelay time.Duration
+	StabilizationRules []stabilizationRule
+	// further watch folders from [watch:<name>] sections, see multiFolder.go
+	folders    []*Config
+	folderName string
+	// also watch the subfolders of FolderToWatch, see recursive.go
+	WatchRecursive bool
+	// host key check, see hostKey.go
+	KnownHostsPath       string
+	AllowInsecureHostKey bool
+	// keepalive requests on the SSH connection, see reconnect.go
+	KeepAliveInterval time.Duration
+	// uploads to Azure Blob and GCS, see cloudStorage.go
+	CloudContainer      string
+	CloudChunkSize      int
+	CloudRequestTimeout time.Duration
+	cloud               cloudStorage
 }
 
 func main() {
+	verbose := flag.Bool("verbose", false, "log debug output, overrides LogLevel")
+	quiet := flag.Bool("quiet", false, "only log warnings and errors, overrides LogLevel")
+	once := flag.Bool("once", false, "upload the files already in the folder and exit instead of watching")
+	install := flag.Bool("install-service", false, "install as a Windows service reading config.ini next to the executable and exit")
+	uninstall := flag.Bool("uninstall-service", false, "remove the Windows service and exit")
+	replayPattern := flag.String("replay", "", "upload the files in this folder or matching this glob again, e.g. from the processed folder, and exit")
+	force := flag.Bool("force", false, "with --replay, overwrite remote files that exist already")
+	manifest := flag.String("manifest", "", "upload the files listed in this file, one path per line, and exit")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration with defaults filled in and secrets redacted, and exit")
+	printDefaults := flag.Bool("print-defaults", false, "print a commented template of every setting with its default, and exit")
+	flag.Parse()
+
+	switch {
+	case *install:
+		err := installService()
+		if err != nil {
+			slog.Error("Failed to install service", "error", err)
+			os.Exit(exitRuntimeError)
+		}
+		return
+	case *uninstall:
+		err := uninstallService()
+		if err != nil {
+			slog.Error("Failed to remove service", "error", err)
+			os.Exit(exitRuntimeError)
+		}
+		return
+	case *replayPattern != "":
+		exitCode := replay(*replayPattern, *force, *verbose, *quiet)
+		flushAlerts()
+		os.Exit(exitCode)
+	case *manifest != "":
+		exitCode := uploadManifest(*manifest, *verbose, *quiet)
+		flushAlerts()
+		os.Exit(exitCode)
+	case *printConfig:
+		os.Exit(printEffectiveConfig(os.Stdout))
+	case *printDefaults:
+		os.Exit(printDefaultConfig(os.Stdout))
+	}
+
+	serve := func(stop <-chan struct{}) int {
+		return run(*verbose, *quiet, *once, stop)
+	}
+	if runningAsService() {
+		os.Exit(runService(serve))
+	}
+
+	// Ctrl+C and SIGTERM stop the watcher the way the service manager does.
+	// The file being uploaded is finished first, a second signal exits
+	// right away
+	stop := make(chan struct{})
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		close(stop)
+		<-interrupt
+		slog.Warn("Stopping without finishing the current upload")
+		os.Exit(exitRuntimeError)
+	}()
+	os.Exit(serve(stop))
+}
 
+// run uploads and watches until the watcher fails or stop is closed and
+// returns the exit code.
+func run(verbose, quiet, once bool, stop <-chan struct{}) int {
 	// Read private key file
 	// Create a new SSH signer
 	// Create SSH client config
@@ -35,92 +356,358 @@ func main() {
 	// Process existing files in the folder
 	// Create a new file watcher
 	// Start watching the specified folder without subfolders
-	config, sftpClient, sshClient, watcher, shouldReturn := initialize()
-	if shouldReturn {
-		return
+	stopping = stop
+	config, sftpClient, sshClient, watcher, exitCode := initialize(verbose, quiet, once)
+	if exitCode != exitOK || watcher == nil {
+		if stopRequested() {
+			slog.Info("Stopping")
+		}
+		if config != nil {
+			logThroughputSummary(config)
+		}
+		stopShadow()
+		stopEventPublisher()
+		flushAlerts()
+		return exitCode
 	}
 	defer watcher.Close()
-	defer sftpClient.Close()
-	defer sshClient.Close()
+	conn := newServerConnection(sftpClient, sshClient, config)
+	defer conn.close()
+	conn.startBackgroundJobs()
+
+	if processedRetentionEnabled(config) {
+		go runProcessedRetention(config)
+	}
+
+	groupCheck := time.NewTicker(groupCheckInterval)
+	defer groupCheck.Stop()
+	retryCheck := time.NewTicker(retryCheckInterval)
+	defer retryCheck.Stop()
+	symlinkCheck := time.NewTicker(config.SymlinkCheckInterval)
+	defer symlinkCheck.Stop()
+	dirCheck := time.NewTicker(dirCheckInterval)
+	defer dirCheck.Stop()
+	stableCheck := time.NewTicker(stableCheckInterval)
+	defer stableCheck.Stop()
+	var status heartbeat
+	heartbeatTicker := time.NewTicker(max(config.HeartbeatInterval, time.Minute))
+	defer heartbeatTicker.Stop()
+	rescanTicker := time.NewTicker(max(config.RescanInterval, time.Minute))
+	defer rescanTicker.Stop()
+
+	// SIGHUP reloads the configuration
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 
 	// Process file events
 	for {
+		sftpClient, sshClient = conn.clients()
 		select {
+		case <-groupCheck.C:
+			expireGroups(sftpClient, sshClient, config)
+		case <-retryCheck.C:
+			retryDueFiles(watcher, sftpClient, sshClient, config)
+			checkZeroByteFiles(sftpClient, sshClient, config)
+			checkAcks(sftpClient, config)
+		case <-dirCheck.C:
+			checkDirectories(sftpClient, sshClient, config)
+		case <-stableCheck.C:
+			checkStableFiles(sftpClient, sshClient, config)
+		case <-heartbeatTicker.C:
+			forgetFinishedCorrelations()
+			if config.HeartbeatInterval > 0 {
+				status.log(config)
+			}
+		case <-rescanTicker.C:
+			if config.RescanInterval > 0 {
+				rescanWatchFolder(sftpClient, sshClient, config)
+			}
+		case <-symlinkCheck.C:
+			checkWatchSymlink(watcher, sftpClient, sshClient, config)
+		case <-conn.closed:
+			conn.dropped()
 		case event, ok := <-watcher.Events:
 			if !ok {
-				return
-			}
-			if event.Op&fsnotify.Create == fsnotify.Create {
-
-				if hasExtension(event.Name, config.WatchExtensions) {
-					// A new file was created
-					fmt.Println("New file detected:", event.Name)
-
-					// Open the file
-					file, err := os.Open(event.Name)
-					if err != nil {
-						fmt.Println("Failed to open file:", err)
-						continue
-					}
-					defer file.Close()
-
-					err = copyFileToSftp(file, sftpClient, config.destionationFolder)
-					if err != nil {
-						fmt.Println("Error copying file to SFTP server:", err)
-						continue
-					}
-
-					// Check if the "processed" folder exists
-					if _, err := os.Stat(config.processedFolder); os.IsNotExist(err) {
-						// Create the "processed" folder
-						err := os.Mkdir(config.processedFolder, 0755)
-						if err != nil {
-							fmt.Println("Failed to create 'processed' folder:", err)
-							continue
-						}
-					}
-
-					processedFilePath := filepath.Join(config.processedFolder, filepath.Base(event.Name))
-					err = moveFileToProcessed(event.Name, file, processedFilePath)
-					if err != nil {
-						fmt.Println("Error moving file to 'processed' folder:", err)
-						continue
-					}
-				}
+				return exitOK
 			}
+			handleEvent(event, watcher, sftpClient, sshClient, config)
+		case <-reload:
+			config = reloadConfig(config, watcher, sftpClient, sshClient, verbose, quiet)
+			checkWatchSymlink(watcher, sftpClient, sshClient, config)
+		case <-stop:
+			slog.Info("Stopping")
+			logThroughputSummary(config)
+			stopShadow()
+			stopEventPublisher()
+			flushAlerts()
+			return exitOK
 		case err, ok := <-watcher.Errors:
 			if !ok {
+				return exitOK
+			}
+			handleWatcherError(err, sftpClient, sshClient, config)
+		}
+	}
+}
+
+// handleEvent reacts to a single file system event.
+func handleEvent(event fsnotify.Event, watcher *fsnotify.Watcher, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) {
+	config = folderConfig(event.Name, config)
+	if isWatchedFile(event.Name, config) {
+		if event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+			// in replace mode a burst of writes is sent once, when it ends
+			if config.UploadMode != uploadModeAppend && awaitStable(event.Name, config) {
 				return
 			}
-			beeep.Alert("Error", "File watcher error: "+err.Error(), "error")
+			err := uploadWatchedFile(event.Name, sftpClient, sshClient, config)
+			if err != nil {
+				slog.Error("Failed to upload watched file", "file", event.Name, "error", err)
+			}
 		}
+		return
+	}
+	if !isInWatchFolder(event.Name, config) {
+		return
+	}
+	if event.Op&fsnotify.Create == fsnotify.Create && isNewSubfolder(event.Name, config) {
+		watchSubfolder(watcher, event.Name, sftpClient, sshClient, config)
+		return
 	}
+	if config.UploadMode == uploadModeAppend {
+		handleAppendEvent(event, sftpClient, config)
+		return
+	}
+	if event.Op&fsnotify.Write == fsnotify.Write {
+		fileChanged(event.Name)
+	}
+	if event.Op&fsnotify.Create == fsnotify.Create {
+		if isInternalFolder(event.Name, config) {
+			return
+		}
+		if isDirectoryUnit(event.Name, config) {
+			addDirectory(event.Name, config)
+			return
+		}
+
+		// in trigger mode a data file waits for its trigger file
+		path := event.Name
+		if config.TriggerFileSuffix != "" {
+			var complete bool
+			path, complete = triggerTarget(event.Name, config)
+			if !complete {
+				logSkip(path, skipNoTrigger, config)
+				return
+			}
+		}
+
+		if matchesFilter(path, config) {
+			// A new file was created
+			correlationFor(path, config)
+			slog.Info("New file detected", "file", path)
+			if awaitStable(path, config) {
+				return
+			}
+			uploadNewFile(path, sftpClient, sshClient, config)
+		} else if isArchiveOnly(path, config) {
+			err := archiveWithoutUpload(path, config)
+			if err != nil {
+				slog.Error("Failed to archive file", "file", path, "error", err)
+			}
+		} else {
+			logSkip(path, skipReason(path, config), config)
+		}
+	}
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		if wasRemovedByTool(event.Name) || isInternalFolder(event.Name, config) {
+			return
+		}
+
+		if config.MirrorDeletions && matchesFilter(event.Name, config) {
+			mirrorDeletion(event.Name, sftpClient, config)
+		}
+	}
+}
+
+// uploadNewFile uploads a new file, or adds it to its group. Failed uploads
+// are retried later.
+func uploadNewFile(path string, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) {
+	if _, grouped := groupKey(path, config); grouped {
+		addToGroup(path, sftpClient, sshClient, config)
+		return
+	}
+
+	err := processFile(path, sftpClient, sshClient, config)
+	if err != nil {
+		scheduleRetry(path, err, config)
+		return
+	}
+	forgetRetry(path)
+}
+
+// initialize loads the config, connects to the server and uploads the files
+// already waiting in the folder. It returns exitOK when the tool should go on
+// watching, otherwise the exit code describing the failure. In once mode it
+// stops after the startup scan.
+func initialize(verbose, quiet, once bool) (*Config, *sftp.Client, *ssh.Client, *fsnotify.Watcher, int) {
+	config, exitCode := loadStartupConfig(verbose, quiet)
+	if exitCode != exitOK {
+		return nil, nil, nil, nil, exitCode
+	}
+
+	var err error
+	state, err = openStateStore(config.StateFile)
+	if err != nil {
+		alert("Failed to open state file: " + err.Error())
+		return nil, nil, nil, nil, exitRuntimeError
+	}
+	// in once mode the scan tries every file right away
+	if !once {
+		restoreRetries()
+		retryScanFailures = true
+	}
+
+	err = ensureWatchFolder(config)
+	if errors.Is(err, errStopped) {
+		return config, nil, nil, nil, exitOK
+	}
+	if err != nil {
+		alert("Failed to watch folder: " + err.Error())
+		return nil, nil, nil, nil, exitConfigError
+	}
+
+	err = startEventPublisher(config)
+	if err != nil {
+		alert("Failed to connect to event broker: " + err.Error())
+		return nil, nil, nil, nil, exitConfigError
+	}
+
+	sftpClient, sshClient, exitCode := connectServer(config)
+	if exitCode != exitOK && stopRequested() {
+		return config, nil, nil, nil, exitOK
+	}
+	if exitCode != exitOK {
+		return nil, nil, nil, nil, exitCode
+	}
+
+	recoverPartFiles(sftpClient, config)
+
+	failed := 0
+	for _, folder := range watchFolders(config) {
+		folderFailed, folderErr := processExistingFiles(folder.FolderToWatch, sftpClient, sshClient, *folder)
+		if folderErr != nil {
+			alert("Failed to process existing files: " + folderErr.Error())
+			folderFailed++
+		}
+		failed += folderFailed
+	}
+	if once {
+		failed += uploadWatchedFiles(sftpClient, sshClient, config)
+	}
+	if once || stopRequested() {
+		closeClients(sftpClient, sshClient)
+		if failed > 0 {
+			return config, nil, nil, nil, exitFileFailures
+		}
+		return config, nil, nil, nil, exitOK
+	}
+
+	watcher, err := newWatcher(config)
+	if err != nil {
+		alert("Failed to create file watcher: " + err.Error())
+		return nil, nil, nil, nil, exitRuntimeError
+	}
+
+	if config.FolderToWatch != "" {
+		resolveWatchFolder(config)
+		err = watchTree(watcher, config.FolderToWatch, config)
+		if err != nil {
+			alert("Failed to watch folder: " + err.Error())
+			return nil, nil, nil, nil, exitRuntimeError
+		}
+
+		slog.Info("Watching folder for new files", "folder", config.FolderToWatch)
+	}
+	for _, folder := range config.folders {
+		err = watchTree(watcher, folder.FolderToWatch, folder)
+		if err != nil {
+			alert("Failed to watch folder: " + err.Error())
+			return nil, nil, nil, nil, exitRuntimeError
+		}
+		slog.Info("Watching folder for new files", "folder", folder.FolderToWatch, "name", folder.folderName, "destination", folder.destionationFolder)
+	}
+
+	for _, dir := range watchFileDirs(config) {
+		err = watcher.Add(dir)
+		if err != nil {
+			alert("Failed to watch folder: " + err.Error())
+			return nil, nil, nil, nil, exitRuntimeError
+		}
+	}
+	if len(config.WatchFiles) > 0 {
+		slog.Info("Watching files for changes", "files", config.WatchFiles)
+	}
+
+	return config, sftpClient, sshClient, watcher, exitOK
 }
 
-func initialize() (*Config, *sftp.Client, *ssh.Client, *fsnotify.Watcher, bool) {
+// loadStartupConfig loads config.ini from the working directory and applies
+// its logging and notification settings.
+func loadStartupConfig(verbose, quiet bool) (*Config, int) {
 	workDir, err := os.Getwd()
 	if err != nil {
-		beeep.Alert("Error", "Failed to get working directory: "+err.Error(), "error")
-		return nil, nil, nil, nil, true
+		alert("Failed to get working directory: " + err.Error())
+		return nil, exitRuntimeError
 	}
 
 	config, err := loadConfig(filepath.Join(workDir, "config.ini"))
 	if err != nil {
-		beeep.Alert("Error", "Failed to load configuration: "+err.Error(), "error")
+		alert("Failed to load configuration: " + err.Error())
+		return nil, exitConfigError
 	}
+	applyLogLevel(config, verbose, quiet)
+	configureNotifications(config)
+	logConfigSummary(config)
+	return config, exitOK
+}
+
+// connectServer opens the SSH connection and the SFTP session on it. It
+// returns exitOK or the exit code describing the failure, which it has
+// already alerted. Cloud storage needs no connection, the clients are nil
+// then.
+func connectServer(config *Config) (*sftp.Client, *ssh.Client, int) {
+	if config.cloud != nil {
+		return nil, nil, exitOK
+	}
+	sftpClient, sshClient, exitCode, err := dialServer(config)
+	if err == nil && config.RunFolderTemplate != "" {
+		err = createRunFolder(sftpClient, config)
+		if err != nil {
+			sftpClient.Close()
+			sshClient.Close()
+			sftpClient, sshClient, exitCode = nil, nil, exitConnectionError
+		}
+	}
+	if err != nil && !errors.Is(err, errStopped) {
+		alert(err.Error())
+	}
+	return sftpClient, sshClient, exitCode
+}
+
+// dialServer is connectServer without the alert, for callers that report
+// failures their own way.
+func dialServer(config *Config) (*sftp.Client, *ssh.Client, int, error) {
 	var auth []ssh.AuthMethod
 	var user string
 	if config.PrivateKeyPath != "" {
-		privateKey, err := os.ReadFile(config.PrivateKeyPath)
+		signer, err := loadPrivateKey(config)
 		if err != nil {
-			beeep.Alert("Error", "Failed to read private key: "+config.PrivateKeyPath+" - "+err.Error(), "error")
-			return nil, nil, nil, nil, true
+			return nil, nil, exitConfigError, err
 		}
-
-		signer, err := ssh.ParsePrivateKey(privateKey)
-		if err != nil {
-			beeep.Alert("Error", "Failed to parse private key: "+err.Error(), "error")
-			return nil, nil, nil, nil, true
+		if config.PrivateKeyCertPath != "" {
+			signer, err = loadCertSigner(signer, config)
+			if err != nil {
+				return nil, nil, exitConfigError, err
+			}
 		}
 		auth = []ssh.AuthMethod{
 			ssh.PublicKeys(signer),
@@ -132,148 +719,982 @@ func initialize() (*Config, *sftp.Client, *ssh.Client, *fsnotify.Watcher, bool)
 		}
 		user = config.SftpUser
 	}
+	checkHostKey, err := hostKeyCallback(config)
+	if err != nil {
+		return nil, nil, exitConfigError, err
+	}
+	addr := sftpAddress(config)
 	sshConfig := &ssh.ClientConfig{
-		User:            user,
-		Auth:            auth,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		// empty lists keep Go's secure defaults
+		Config: ssh.Config{
+			Ciphers:      config.SshCiphers,
+			MACs:         config.SshMACs,
+			KeyExchanges: config.SshKeyExchanges,
+			// 0 keeps the library default. A failed key exchange closes
+			// the connection, the upload then waits for the reconnect
+			RekeyThreshold: config.RekeyThreshold,
+		},
+		User:              user,
+		Auth:              auth,
+		HostKeyCallback:   checkHostKey,
+		HostKeyAlgorithms: hostKeyAlgorithms(addr, config),
 	}
 
-	sshClient, err := ssh.Dial("tcp", config.SftpServer+":22", sshConfig)
+	sshClient, err := connectSSH(addr, sshConfig, config)
 	if err != nil {
-		beeep.Alert("Error", "Failed to connect to SFTP server: "+err.Error(), "error")
-		return nil, nil, nil, nil, true
+		return nil, nil, exitConnectionError, fmt.Errorf("Failed to connect to SFTP server: %w", err)
 	}
 
-	sftpClient, err := sftp.NewClient(sshClient)
+	sftpClient, err := sftp.NewClient(sshClient, sftpClientOptions(config)...)
 	if err != nil {
-		beeep.Alert("Error", "Failed to create SFTP client: "+err.Error(), "error")
-		return nil, nil, nil, nil, true
+		sshClient.Close()
+		return nil, nil, exitConnectionError, fmt.Errorf("Failed to create SFTP client: %w", err)
 	}
-
-	err = processExistingFiles(config.FolderToWatch, sftpClient, *config)
-	if err != nil {
-		beeep.Alert("Error", "Failed to process existing files: "+err.Error(), "error")
+	if config.WarmUpConnection {
+		err = warmUpConnection(sftpClient)
+		if err != nil {
+			sftpClient.Close()
+			sshClient.Close()
+			return nil, nil, exitConnectionError, err
+		}
 	}
+	keepAlive(sshClient, config)
+	return sftpClient, sshClient, exitOK, nil
+}
 
-	watcher, err := fsnotify.NewWatcher()
+// processExistingFiles uploads the files already waiting in folderToWatch and
+// returns how many of them failed.
+func processExistingFiles(folderToWatch string, sftpClient *sftp.Client, sshClient *ssh.Client, config Config) (int, error) {
+	// Process existing files in the folder. The listing is read in batches,
+	// so huge folders neither need the whole listing in memory nor wait for
+	// it before the first upload
+	dir, err := os.Open(folderToWatch)
 	if err != nil {
-		beeep.Alert("Error", "Failed to create file watcher: "+err.Error(), "error")
-		return nil, nil, nil, nil, true
+		return 0, fmt.Errorf("failed to read directory: %w", err)
 	}
+	defer dir.Close()
 
-	err = watcher.Add(config.FolderToWatch)
-	if err != nil {
-		beeep.Alert("Error", "Failed to watch folder: "+err.Error(), "error")
-		return nil, nil, nil, nil, true
+	failed := 0
+	for {
+		files, err := dir.ReadDir(scanBatchSize)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return failed, fmt.Errorf("failed to read directory: %w", err)
+		}
+		failed += processScannedFiles(folderToWatch, files, sftpClient, sshClient, &config)
+		if stopRequested() {
+			return failed, nil
+		}
 	}
 
-	fmt.Println("Watching " + config.FolderToWatch + " folder for new files...")
-
-	return config, sftpClient, sshClient, watcher, false
+	// directories that already settled go up right away
+	failed += checkDirectories(sftpClient, sshClient, &config)
+	return failed, nil
 }
 
-func processExistingFiles(folderToWatch string, sftpClient *sftp.Client, config Config) error {
-	// Process existing files in the folder
-	files, err := os.ReadDir(folderToWatch)
-	if err != nil {
-		return fmt.Errorf("failed to read directory: %w", err)
-	}
-
+// processScannedFiles handles one batch of the startup scan and returns how
+// many files failed.
+func processScannedFiles(folderToWatch string, files []os.DirEntry, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) int {
+	failed := 0
 	for _, fileInfo := range files {
-		if !fileInfo.IsDir() && hasExtension(fileInfo.Name(), config.WatchExtensions) {
-			// Open the file
-			file, err := os.Open(filepath.Join(folderToWatch, fileInfo.Name()))
-			if err != nil {
-				beeep.Alert("Error", fmt.Sprintf("Failed to open file: %s", err.Error()), "error")
+		if stopRequested() {
+			break
+		}
+		path := filepath.Join(folderToWatch, fileInfo.Name())
+		if isInternalFolder(path, config) {
+			continue
+		}
+		if _, waiting := pendingRetries[path]; waiting {
+			continue
+		}
+		if _, settling := pendingStable[path]; settling {
+			continue
+		}
+		if fileInfo.IsDir() {
+			if isDirectoryUnit(path, config) {
+				addDirectory(path, config)
+			} else if config.WatchRecursive {
+				subfolderFailed, err := processExistingFiles(path, sftpClient, sshClient, *config)
+				if err != nil {
+					slog.Error("Failed to process existing files", "dir", path, "error", err)
+					subfolderFailed++
+				}
+				failed += subfolderFailed
+			}
+			continue
+		}
+		if matchesFilter(path, config) && hasTriggerFile(path, config) {
+			if _, grouped := groupKey(path, config); grouped {
+				addToGroup(path, sftpClient, sshClient, config)
 				continue
 			}
-			defer file.Close()
 
-			err = copyFileToSftp(file, sftpClient, config.destionationFolder)
+			var err error
+			if config.UploadMode == uploadModeAppend {
+				err = appendNewData(path, sftpClient, config)
+			} else {
+				err = processFile(path, sftpClient, sshClient, config)
+			}
+			if err != nil && retryScanFailures {
+				scheduleRetry(path, err, config)
+				failed++
+				continue
+			}
+			if err != nil && isPermanentError(err, config) {
+				err = moveToFailed(path, err, config)
+			}
 			if err != nil {
-				log.Println("Error copying file to SFTP server:", err)
+				slog.Error("Failed to process file", "file", path, "error", err)
+				failed++
+			} else {
+				forgetRetry(path)
 			}
-
-			err = moveFileToProcessed(filepath.Join(folderToWatch, fileInfo.Name()), file, filepath.Join(config.processedFolder, fileInfo.Name()))
+		} else if config.UploadMode != uploadModeAppend && isArchiveOnly(path, config) && hasTriggerFile(path, config) {
+			err := archiveWithoutUpload(path, config)
 			if err != nil {
-				log.Println("Error moving file to 'processed' folder:", err)
+				slog.Error("Failed to archive file", "file", path, "error", err)
+				failed++
 			}
+		} else if reason := skipReason(path, config); reason != "" {
+			logSkip(path, reason, config)
+		} else {
+			logSkip(path, skipNoTrigger, config)
 		}
 	}
 
-	return nil
+	return failed
 }
 
-func copyFileToSftp(file *os.File, sftpClient *sftp.Client, destFolder string) error {
-	fmt.Println("creating remote file: " + destFolder + filepath.Base(file.Name()))
-	// Create remote file
-	remoteFile, err := sftpClient.Create(destFolder + filepath.Base(file.Name()))
+// processFile uploads a single file to the SFTP server and moves it to the
+// processed folder afterwards.
+func processFile(path string, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) error {
+	config = folderConfig(path, config)
+	if config.FolderToWatch != "" {
+		err := checkFreeInodes(config.FolderToWatch, config)
+		if err != nil {
+			return err
+		}
+	}
+	err := checkUploadsPaused()
 	if err != nil {
-		fmt.Println("Failed to create remote file:", err)
 		return err
 	}
 
-	// Copy the contents of the local file to the remote file
-	_, err = io.Copy(remoteFile, file)
+	if config.ExpandArchives && isArchive(path) {
+		return processArchive(path, sftpClient, sshClient, config)
+	}
+
+	if correlationFor(path, config) != "" {
+		defer func() {
+			if _, err := os.Lstat(path); os.IsNotExist(err) {
+				forgetCorrelation(path)
+			}
+		}()
+	}
+
+	// Open the file. It may have been taken by someone else while it waited
+	// for a retry or its trigger, that is not an error
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Debug("File is already gone, skipping it", "file", path)
+		forgetRetry(path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	// a crash between upload and archiving must not send the file twice
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	if info.Size() == 0 {
+		if !acceptZeroByte(path, config) {
+			return nil
+		}
+	} else {
+		delete(pendingZeroByte, path)
+	}
+	if remotePath, ok := state.alreadyUploaded(path, info); ok {
+		logSkip(path, skipAlreadyUploaded, config)
+		slog.Info("File was uploaded before the last restart, not sending it again", "file", path, "remote", remotePath)
+		if config.AckFolder != "" {
+			awaitAck(path, remotePath, state.uploadedAt(path), config)
+			return nil
+		}
+		return finishRecordedFile(path, file, config)
+	}
+
+	if err := checkRemoteName(path, config); err != nil {
+		alert(fmt.Sprintf("File name of %q can't be used on the server, moving the file to quarantine", path))
+		file.Close()
+		return moveToQuarantine(path, err, config)
+	}
+
+	if config.ShouldUploadCommand != "" {
+		ok, err := shouldUpload(path, config)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return handleRejectedFile(path, file, config)
+		}
+	}
+
+	if other, ok := uploadedUnderOtherName(path, info, config); ok {
+		logSkip(path, skipHardLink, config)
+		slog.Info("File is a hard link of a file uploaded before", "file", path, "uploadedAs", other)
+		return setAsideDuplicate(path, file, "Hard-linked duplicate, upload skipped", config)
+	}
+
+	// files already on the remote are handled according to RemoteCollisionStrategy
+	remotePath, err := resolveRemotePath(sftpClient, remotePathFor(path, config), path, config)
+	if errors.Is(err, errRemoteExists) {
+		return skipDuplicate(path, file, config)
+	}
 	if err != nil {
-		fmt.Println("Failed to upload file to SFTP server:", err)
 		return err
 	}
 
-	fmt.Println("File uploaded successfully")
+	checksum, err := uploadFile(file, remotePath, sftpClient, sshClient, config)
+	var deadline *uploadDeadlineError
+	if errors.As(err, &deadline) && config.slowFolder != "" {
+		file.Close()
+		return deferSlowFile(path, config)
+	}
+	var transformErr *transformError
+	if errors.As(err, &transformErr) {
+		file.Close()
+		return moveToQuarantine(path, transformErr, config)
+	}
+	if err != nil {
+		return fmt.Errorf("error copying file to SFTP server: %w", err)
+	}
+	err = state.markUploaded(path, info, remotePath)
+	if err != nil {
+		slog.Warn("Failed to record upload in state file", "file", path, "error", err)
+	}
+	rememberRemoteName(remotePath, config)
+	recordFilenameMapping(path, remotePath, config)
+	shadowCopy(path, remotePath, config)
+	rememberUploadedLink(path, info, config)
+
+	if config.AckFolder != "" {
+		awaitAck(path, remotePath, time.Now(), config)
+	} else {
+		err = finishRecordedFile(path, file, config)
+		if err != nil {
+			return err
+		}
+	}
+	publishUploadEvent(path, remotePath, info.Size(), checksum)
+	if config.PostUploadCommand != "" {
+		runPostUploadCommand(path, remotePath, checksum, config)
+	}
+	return nil
+}
+
+// finishRecordedFile finishes an uploaded file and drops its upload record.
+func finishRecordedFile(path string, file *os.File, config *Config) error {
+	err := finishUploadedFile(path, file, config)
+	if err != nil {
+		return err
+	}
+	err = state.forgetUploaded(path)
+	if err != nil {
+		slog.Warn("Failed to update state file", "file", path, "error", err)
+	}
 	return nil
+}
+
+// finishUploadedFile applies the post-upload action to a source file that was
+// uploaded successfully. file is the open source file.
+func finishUploadedFile(path string, file *os.File, config *Config) error {
+	if postUploadAction(path, config) == postUploadDelete {
+		err := deleteUploadedFile(path)
+		if err != nil {
+			return err
+		}
+		return finishSourceFile(path, config)
+	}
+
+	// Check if the "processed" folder exists
+	processedDir := processedDirFor(path, config)
+	if _, err := os.Stat(processedDir); os.IsNotExist(err) {
+		// Create the "processed" folder
+		err := os.MkdirAll(processedDir, 0755)
+		if err != nil {
+			return fmt.Errorf("failed to create 'processed' folder: %w", err)
+		}
+	}
+
+	// with the skip strategy the copy archived before wins, the uploaded file
+	// goes
+	processedFilePath, err := localTarget(path, processedDir, config.ProcessedCollisionStrategy)
+	if errors.Is(err, errNameTaken) {
+		slog.Info("An archived file of that name exists, deleting this one instead of archiving it", "file", path)
+		err = deleteUploadedFile(path)
+		if err != nil {
+			return err
+		}
+		return finishSourceFile(path, config)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to name file in 'processed' folder: %w", err)
+	}
+	err = moveFileToProcessed(path, file, processedFilePath, config)
+	if err != nil {
+		return fmt.Errorf("error moving file to 'processed' folder: %w", err)
+	}
+	return finishSourceFile(path, config)
+}
 
+func copyFileToSftp(file *os.File, remotePath string, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) ([]byte, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file: %w", err)
+	}
+	return copyToSftp(fileSource(file, info), remotePath, sftpClient, sshClient, config)
 }
 
-func moveFileToProcessed(srcFilePath string, file *os.File, processedPath string) error {
+// copyToSftp uploads source to remotePath. The data flows through the
+// transform, encryption and hashes as a chain of readers and writers, no
+// step keeps more than a buffer of it, whatever the size of the file.
+func copyToSftp(source uploadSource, remotePath string, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) ([]byte, error) {
+	waitForUploadSlot(config)
+	err := ensureRemoteParent(sftpClient, remotePath, config)
+	if err != nil {
+		slog.Error("Failed to create remote folder", "path", remotePath, "error", err)
+		return nil, err
+	}
+	slog.Debug("Creating remote file", "path", remotePath)
+
+	// Hash the data while uploading, for verification, the checksum sidecar,
+	// PostUploadCommand and upload events. Encrypted files are hashed as uploaded, after
+	// encryption, since that is what the receiver gets. With TransformCommand
+	// the command's output is uploaded and hashed
+	verifyHash := sha256.New()
+	sidecarHash := newChecksumHash(config.ChecksumAlgorithm)
+	var hashes []io.Writer
+	hashed := config.VerifyUpload != verifyNone || config.PostUploadCommand != "" || config.EventsType != eventsNone
+	if hashed {
+		hashes = append(hashes, verifyHash)
+	}
+	if config.WriteRemoteChecksumSidecar {
+		hashes = append(hashes, sidecarHash)
+	}
+
+	// Copy the contents of the local file to the remote file
+	upload := func(w io.Writer) error {
+		return writeUpload(w, source, hashes, config)
+	}
+	if config.AdaptiveConcurrency {
+		write := upload
+		upload = func(w io.Writer) error {
+			return adaptiveUpload(w, write, config)
+		}
+	}
+	if config.AtomicUpload {
+		err = uploadAtomically(sftpClient, remotePath, upload)
+	} else {
+		err = uploadDirectly(sftpClient, remotePath, upload)
+	}
+	var deadline *uploadDeadlineError
+	if errors.As(err, &deadline) {
+		slog.Warn("Upload deadline hit, upload cancelled", "file", source.name, "remote", remotePath, "deadline", deadline.deadline, "bytes", deadline.written)
+		if !config.AtomicUpload {
+			sftpClient.Remove(remotePath)
+		}
+		return nil, err
+	}
+	var transformErr *transformError
+	if errors.As(err, &transformErr) {
+		slog.Error("Transform failed, upload discarded", "file", source.name, "remote", remotePath, "error", err)
+		if !config.AtomicUpload {
+			sftpClient.Remove(remotePath)
+		}
+		return nil, err
+	}
+	if errors.Is(err, errChangedDuringTransfer) {
+		slog.Warn("File changed during upload, discarding the upload", "file", source.name, "remote", remotePath, "error", err)
+		if !config.AtomicUpload {
+			sftpClient.Remove(remotePath)
+		}
+		return nil, err
+	}
+	if isConnectionLost(err, sftpClient) {
+		slog.Error("Connection to the server lost, upload discarded", "file", source.name, "remote", remotePath, "error", err)
+		return nil, pauseForLostConnection(remotePath, err)
+	}
+	if isRemoteFull(err) {
+		slog.Error("Server is out of space, upload discarded", "file", source.name, "remote", remotePath, "error", err)
+		if !config.AtomicUpload {
+			sftpClient.Remove(remotePath)
+		}
+		return nil, pauseForRemoteFull(remotePath, err, config)
+	}
+	if err != nil {
+		slog.Error("Failed to upload file to SFTP server", "path", remotePath, "error", err)
+		return nil, classifyUploadError(remotePath, err, config)
+	}
+	remotePermissionRestored()
+	remoteSpaceRestored()
+
+	uploadedFiles.Add(1)
+	slog.Info("File uploaded successfully", "file", source.name, "remote", remotePath)
+
+	if config.VerifyUpload != verifyNone {
+		err = verifyUpload(sshClient, sftpClient, remotePath, verifyHash.Sum(nil), config)
+		if err != nil {
+			slog.Error("Failed to verify upload", "path", remotePath, "error", err)
+			return nil, err
+		}
+	}
+
+	err = applyRemoteOwnership(sftpClient, remotePath, config)
+	if err != nil {
+		if config.StrictChown {
+			slog.Error("Failed to change owner of remote file", "path", remotePath, "error", err)
+			return nil, err
+		}
+		slog.Warn("Failed to change owner of remote file", "path", remotePath, "error", err)
+	}
+
+	if len(config.Metadata) > 0 {
+		err = setRemoteMetadata(sshClient, remotePath, metadataValues(source.name, source.info, config), config)
+		if err != nil {
+			slog.Warn("Failed to attach metadata to remote file", "path", remotePath, "error", err)
+		}
+	}
+
+	if config.PostUploadRemoteCommand != "" {
+		runPostUploadRemoteCommand(sshClient, remotePath, config)
+	}
+
+	// The sidecar and the ready marker go up last, the receiver must never
+	// see them before their file
+	if config.WriteRemoteChecksumSidecar {
+		err = writeChecksumSidecar(sftpClient, remotePath, sidecarHash.Sum(nil), config)
+		if err != nil {
+			slog.Error("Failed to write checksum sidecar", "path", remotePath, "error", err)
+			return nil, err
+		}
+	}
+	if config.WriteRemoteReadyMarker {
+		err = writeReadyMarker(sftpClient, remotePath, config)
+		if err != nil {
+			slog.Error("Failed to write ready marker", "path", remotePath, "error", err)
+			return nil, err
+		}
+	}
+	if !hashed {
+		return nil, nil
+	}
+	return verifyHash.Sum(nil), nil
+
+}
+
+// writeUpload writes source to w, the remote file or cloud object, through
+// TransformCommand and EncryptWith, and feeds what is sent to hashes. With
+// ReuploadIfChangedDuringTransfer a file that changed meanwhile fails with
+// errChangedDuringTransfer after all of it was written, the caller discards
+// the upload then.
+func writeUpload(w io.Writer, source uploadSource, hashes []io.Writer, config *Config) error {
+	w, done := startTransfer(w)
+	defer done()
+	if config.PerFileUploadDeadline > 0 {
+		w = newDeadlineWriter(w, config.PerFileUploadDeadline)
+	}
+	var src io.Reader = diskReader{source.r}
+	var transform *transformStream
+	if config.TransformCommand != "" {
+		var err error
+		transform, err = startTransform(source.r, source.name, config)
+		if err != nil {
+			return err
+		}
+		defer transform.stop()
+		src = transform
+	}
+	if len(hashes) > 0 && config.encryptTo == nil {
+		src = io.TeeReader(src, io.MultiWriter(hashes...))
+	}
+
+	var err error
+	if config.encryptTo != nil {
+		err = copyEncrypted(w, src, source.name, hashes, config)
+	} else {
+		_, err = copyBuffered(w, src, config)
+	}
+	if err == nil && transform != nil {
+		err = transform.wait()
+	}
+	if err == nil && config.ReuploadIfChangedDuringTransfer && source.file != nil {
+		err = checkSourceUnchanged(source.file, source.info)
+	}
+	return err
+}
+
+// remotePathFor maps a local file to its path on the SFTP server. With
+// RemotePathRoot the path below that root is kept, otherwise only the name.
+// RunFolderTemplate and RemoteDirTemplate add subfolders in front.
+func remotePathFor(localPath string, config *Config) string {
+	return encryptedName(remoteFolderFor(localPath, config), config)
+}
+
+// remoteFolderFor maps a local folder to its path on the SFTP server, like
+// remotePathFor but without the suffix of encrypted files.
+func remoteFolderFor(localPath string, config *Config) string {
+	destination := config.destionationFolder + currentRunFolder(config)
+	if config.RemoteDirTemplate != "" {
+		destination += remoteDirFor(localPath, config)
+	}
+	if config.RemotePathRoot != "" {
+		if rel, ok := relativeToRoot(localPath, config); ok {
+			return destination + remoteRelPath(rel, config)
+		}
+	} else if config.WatchRecursive {
+		if rel, ok := relativeToWatchFolder(localPath, config); ok {
+			return destination + remoteRelPath(rel, config)
+		}
+	}
+	return destination + remoteName(filepath.Base(localPath), config)
+}
+
+// applyRemoteOwnership hands the uploaded file over to RemoteUID/RemoteGID.
+// An id that is not configured keeps the value the server assigned.
+func applyRemoteOwnership(sftpClient *sftp.Client, remotePath string, config *Config) error {
+	if config.RemoteUID < 0 && config.RemoteGID < 0 {
+		return nil
+	}
+
+	uid, gid := config.RemoteUID, config.RemoteGID
+	if uid < 0 || gid < 0 {
+		info, err := sftpClient.Stat(remotePath)
+		if err != nil {
+			return fmt.Errorf("failed to stat remote file: %w", err)
+		}
+		stat, ok := info.Sys().(*sftp.FileStat)
+		if !ok {
+			return fmt.Errorf("server did not report the current owner of %s", remotePath)
+		}
+		if uid < 0 {
+			uid = int(stat.UID)
+		}
+		if gid < 0 {
+			gid = int(stat.GID)
+		}
+	}
+
+	return sftpClient.Chown(remotePath, uid, gid)
+}
+
+func moveFileToProcessed(srcFilePath string, file *os.File, processedPath string, config *Config) error {
+	// The upload already consumed the file, start over from the beginning
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		slog.Error("Failed to rewind source file", "file", srcFilePath, "error", err)
+		return err
+	}
+
+	// Don't start a copy that would fill up the disk halfway through
+	info, err := file.Stat()
+	if err != nil {
+		slog.Error("Failed to stat source file", "file", srcFilePath, "error", err)
+		return err
+	}
+	err = checkFreeSpace(filepath.Dir(processedPath), info.Size(), config)
+	if err != nil {
+		alert("Not archiving " + srcFilePath + ", it stays in the watch folder: " + err.Error())
+		return err
+	}
 
 	// Create the destination file
 	dstFile, err := os.Create(processedPath)
 	if err != nil {
-		fmt.Println("Failed to create destination file:", err)
+		slog.Error("Failed to create destination file", "file", processedPath, "error", err)
 		return err
 	}
 	defer dstFile.Close()
 
 	// Copy the contents of the source file to the destination file
-	_, err = io.Copy(dstFile, file)
+	_, err = copyBuffered(dstFile, file, config)
 	if err != nil {
-		fmt.Println("Failed to copy file to 'processed' folder:", err)
+		slog.Error("Failed to copy file to 'processed' folder", "file", srcFilePath, "error", err)
 		return err
 	}
 
-	fmt.Println("File copied to 'processed' folder successfully")
-	err = os.Remove(srcFilePath) // delete sourceFile
+	slog.Info("File copied to 'processed' folder successfully", "file", processedPath)
+	err = removeSourceFile(srcFilePath) // delete sourceFile
 	if err != nil {
-		fmt.Println("Failed to delete source file:", err)
+		slog.Error("Failed to delete source file", "file", srcFilePath, "error", err)
 		return err
 	}
 	return nil
 }
 
+// copyBuffered copies src to dst through a buffer of CopyBufferSizeKB. The
+// ReaderFrom/WriterTo shortcuts of io.CopyBuffer are hidden on purpose,
+// otherwise the configured buffer would never be used.
+func copyBuffered(dst io.Writer, src io.Reader, config *Config) (int64, error) {
+	buf := make([]byte, config.CopyBufferSizeKB*1024)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, buf)
+}
+
 func loadConfig(filename string) (*Config, error) {
-	cfg, err := ini.Load(filename)
+	cfg, files, err := loadIniFiles(filename)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load configuration: %w", err)
 	}
+	return configFromIni(cfg, filename, files)
+}
 
-	config := &Config{}
+// configFromIni reads the settings from the loaded ini files. Keys that are
+// not set get their default written into cfg, so afterwards cfg holds every
+// setting read together with its effective value.
+func configFromIni(cfg *ini.File, filename string, files []string) (*Config, error) {
+	config := &Config{configFile: filename, configFiles: files}
+	var err error
 
 	// Read values from the ini file
 	config.FolderToWatch = cfg.Section("paths").Key("FolderToWatch").String()
-	config.SftpServer = cfg.Section("server").Key("SftpServer").String()
 	config.SftpUser = cfg.Section("server").Key("SftpUser").String()
 	config.SftpPassword = cfg.Section("server").Key("SftpPassword").String()
 	config.PrivateKeyPath = cfg.Section("paths").Key("PrivateKeyPath").String()
-	config.destionationFolder = cfg.Section("server").Key("DestinationFolder").String()
-	config.processedFolder = filepath.Join(config.FolderToWatch, "processed")
+	config.PrivateKeyCertPath = cfg.Section("paths").Key("PrivateKeyCertPath").String()
+	config.destionationFolder, err = expandEnv("DestinationFolder", cfg.Section("server").Key("DestinationFolder").String())
+	if err != nil {
+		return nil, err
+	}
+	err = loadSftpServer(cfg.Section("server"), config)
+	if err != nil {
+		return nil, err
+	}
+	err = loadPassphrase(cfg.Section("paths"), config)
+	if err != nil {
+		return nil, err
+	}
+	err = loadHostKey(cfg.Section("paths"), cfg.Section("server"), config)
+	if err != nil {
+		return nil, err
+	}
+	err = loadDestinationURL(cfg.Section("server"), config)
+	if err != nil {
+		return nil, err
+	}
+	config.SshCiphers = algorithmList(cfg.Section("server").Key("SshCiphers"))
+	config.SshMACs = algorithmList(cfg.Section("server").Key("SshMACs"))
+	config.SshKeyExchanges = algorithmList(cfg.Section("server").Key("SshKeyExchanges"))
+	err = loadSftpTuning(cfg.Section("server"), config)
+	if err != nil {
+		return nil, err
+	}
+	err = loadAdaptiveConcurrency(cfg.Section("server"), config)
+	if err != nil {
+		return nil, err
+	}
+	err = loadRekey(cfg.Section("server"), config)
+	if err != nil {
+		return nil, err
+	}
+	err = loadKeepAlive(cfg.Section("server"), config)
+	if err != nil {
+		return nil, err
+	}
+	err = loadProxy(cfg.Section("proxy"), config)
+	if err != nil {
+		return nil, err
+	}
+	config.SelfTestInterval = time.Duration(cfg.Section("server").Key("SelfTestIntervalMinutes").MustInt(0)) * time.Minute
+	config.SelfTestRemotePath = cfg.Section("server").Key("SelfTestRemotePath").MustString(config.destionationFolder + ".filewatcher-selftest")
+	config.RemoteRetentionDays = cfg.Section("server").Key("RemoteRetentionDays").MustInt(0)
+	config.RemoteRetentionDryRun = cfg.Section("server").Key("RemoteRetentionDryRun").MustBool(false)
+	config.RemoteRetentionInterval = time.Duration(cfg.Section("server").Key("RemoteRetentionIntervalMinutes").MustInt(60)) * time.Minute
+	if config.RemoteRetentionDays > 0 && config.RemoteRetentionInterval <= 0 {
+		return nil, fmt.Errorf("RemoteRetentionIntervalMinutes must be at least 1")
+	}
+	config.RemoteUID = cfg.Section("server").Key("RemoteUID").MustInt(-1)
+	config.RemoteGID = cfg.Section("server").Key("RemoteGID").MustInt(-1)
+	config.StrictChown = cfg.Section("server").Key("StrictChown").MustBool(false)
+	config.LogLevel, err = parseLogLevel(cfg.Section("general").Key("LogLevel").String())
+	if err != nil {
+		return nil, err
+	}
+	config.WriteRemoteChecksumSidecar = cfg.Section("general").Key("WriteRemoteChecksumSidecar").MustBool(false)
+	config.WatchUnit, err = oneOf(cfg.Section("general").Key("WatchUnit"), watchUnitFile, watchUnitDirectory)
+	if err != nil {
+		return nil, err
+	}
+	config.DirectoryQuiet = time.Duration(cfg.Section("general").Key("DirectoryQuietSeconds").MustInt(30)) * time.Second
+	err = loadRecursive(cfg.Section("general"), config)
+	if err != nil {
+		return nil, err
+	}
+	config.ExpandArchives = cfg.Section("general").Key("ExpandArchives").MustBool(false)
+	config.AtomicUpload = cfg.Section("general").Key("AtomicUpload").MustBool(false)
+	config.WriteRemoteReadyMarker = cfg.Section("general").Key("WriteRemoteReadyMarker").MustBool(false)
+	config.ReadyMarkerSuffix = cfg.Section("general").Key("ReadyMarkerSuffix").MustString(".ready")
+	config.ChecksumAlgorithm, err = oneOf(cfg.Section("general").Key("ChecksumAlgorithm"), checksumSHA256, checksumMD5)
+	if err != nil {
+		return nil, err
+	}
+	config.EnableDesktopNotifications, err = oneOf(cfg.Section("general").Key("EnableDesktopNotifications"), notificationsAuto, notificationsOn, notificationsOff)
+	if err != nil {
+		return nil, err
+	}
+	config.DeadLetterWebhookURL = cfg.Section("general").Key("DeadLetterWebhookURL").String()
+	err = loadEvents(cfg.Section("events"), config)
+	if err != nil {
+		return nil, err
+	}
+	err = loadExternalUpload(cfg.Section("general"), config)
+	if err != nil {
+		return nil, err
+	}
+	config.PostUploadCommand = cfg.Section("general").Key("PostUploadCommand").String()
+	config.PostUploadCommandTimeout = time.Duration(cfg.Section("general").Key("PostUploadCommandTimeoutSeconds").MustInt(60)) * time.Second
+	config.PostUploadRemoteCommand = cfg.Section("general").Key("PostUploadRemoteCommand").String()
+	config.AlertOnPostUploadCommandFailure = cfg.Section("general").Key("AlertOnPostUploadCommandFailure").MustBool(false)
+	config.HeartbeatInterval = time.Duration(cfg.Section("general").Key("HeartbeatIntervalMinutes").MustInt(60)) * time.Minute
+	config.LogThroughputStats = cfg.Section("general").Key("LogThroughputStats").MustBool(false)
+	config.MaxFilesPerMinute = cfg.Section("general").Key("MaxFilesPerMinute").MustInt(0)
+	config.MaxRetries = cfg.Section("general").Key("MaxRetries").MustInt(5)
+	config.RetryDelay = time.Duration(cfg.Section("general").Key("RetryDelaySeconds").MustInt(10)) * time.Second
+	config.RetryMaxDelay = time.Duration(cfg.Section("general").Key("RetryMaxDelaySeconds").MustInt(600)) * time.Second
+	err = loadHardLinks(cfg.Section("general"), config)
+	if err != nil {
+		return nil, err
+	}
+	err = loadRescan(cfg.Section("general"), config)
+	if err != nil {
+		return nil, err
+	}
+	config.RetryScheduling, err = oneOf(cfg.Section("general").Key("RetryScheduling"), retrySchedulingFIFO, retrySchedulingFair, retrySchedulingFreshFirst)
+	if err != nil {
+		return nil, err
+	}
+	config.OnRemotePermissionDenied, err = oneOf(cfg.Section("general").Key("OnRemotePermissionDenied"), onPermissionDeniedFail, onPermissionDeniedPause)
+	if err != nil {
+		return nil, err
+	}
+	config.MaxTotalRetryDuration = cfg.Section("general").Key("MaxTotalRetryDuration").MustDuration(time.Hour)
+	config.ServerBusyMaxWait = cfg.Section("server").Key("ServerBusyMaxWait").MustDuration(10 * time.Minute)
+	config.PerFileUploadDeadline = cfg.Section("general").Key("PerFileUploadDeadline").MustDuration(0)
+	config.LogSkips = cfg.Section("general").Key("LogSkips").MustBool(false)
+	config.MaxClockSkew = time.Duration(cfg.Section("general").Key("MaxClockSkewSeconds").MustInt(300)) * time.Second
+	config.ReuploadIfChangedDuringTransfer = cfg.Section("general").Key("ReuploadIfChangedDuringTransfer").MustBool(false)
+	config.BatchID = cfg.Section("general").Key("BatchID").MustString(runID)
+	config.CorrelationIDs = cfg.Section("general").Key("CorrelationIDs").MustBool(false)
+	loadMetadata(cfg.Section("metadata"), config)
+	err = loadStabilization(cfg.Section("general"), cfg.Section("stabilization"), config)
+	if err != nil {
+		return nil, err
+	}
+	config.MinFreeInodes = cfg.Section("general").Key("MinFreeInodes").MustInt64(0)
+	config.FreeSpaceMarginMB = cfg.Section("general").Key("FreeSpaceMarginMB").MustInt(100)
+	config.MirrorDeletions = cfg.Section("general").Key("MirrorDeletions").MustBool(false)
+	config.VerifyUpload, err = oneOf(cfg.Section("general").Key("VerifyUpload"), verifyNone, verifyReadback, verifyChecksum)
+	if err != nil {
+		return nil, err
+	}
+	config.processedFolder = cfg.Section("paths").Key("ProcessedFolder").String()
+	if config.processedFolder == "" && config.FolderToWatch != "" {
+		config.processedFolder = filepath.Join(config.FolderToWatch, "processed")
+	}
+	err = loadProcessedRetention(cfg.Section("paths"), config)
+	if err != nil {
+		return nil, err
+	}
+
+	config.StateFile = cfg.Section("paths").Key("StateFile").MustString(filepath.Join(filepath.Dir(filename), "filewatcher-state.json"))
+	config.TempDir = cfg.Section("paths").Key("TempDir").MustString(os.TempDir())
+	if info, err := os.Stat(config.TempDir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("TempDir %s is not an existing folder", config.TempDir)
+	}
+	config.PruneEmptyDirs = cfg.Section("paths").Key("PruneEmptyDirs").MustBool(false)
+	config.UploadMode, err = oneOf(cfg.Section("general").Key("UploadMode"), uploadModeReplace, uploadModeAppend)
+	if err != nil {
+		return nil, err
+	}
+	// a failed parallel write may leave a gap, which append mode would keep
+	if config.UploadMode == uploadModeAppend && config.SftpConcurrentWrites {
+		return nil, fmt.Errorf("SftpConcurrentWrites can't be used with UploadMode = append")
+	}
+	config.TriggerFileSuffix = cfg.Section("general").Key("TriggerFileSuffix").String()
+	config.TriggerFileAction, err = oneOf(cfg.Section("general").Key("TriggerFileAction"), triggerActionDelete, triggerActionArchive)
+	if err != nil {
+		return nil, err
+	}
+	config.WaitForWatchFolder = cfg.Section("paths").Key("WaitForWatchFolder").MustBool(false)
+	config.WatchFolderMaxWait = time.Duration(cfg.Section("paths").Key("WatchFolderMaxWaitSeconds").MustInt(300)) * time.Second
+	config.CreateWatchFolder = cfg.Section("paths").Key("CreateWatchFolder").MustBool(false)
+	config.ResolveWatchSymlink = cfg.Section("paths").Key("ResolveWatchSymlink").MustBool(false)
+	config.SymlinkCheckInterval = time.Duration(cfg.Section("paths").Key("SymlinkCheckIntervalSeconds").MustInt(30)) * time.Second
+	if config.SymlinkCheckInterval <= 0 {
+		return nil, fmt.Errorf("SymlinkCheckIntervalSeconds must be at least 1")
+	}
+
+	config.failedFolder = cfg.Section("paths").Key("FailedFolder").String()
+	config.duplicatesFolder = cfg.Section("paths").Key("DuplicatesFolder").String()
+	config.slowFolder = cfg.Section("paths").Key("SlowFolder").String()
+	config.quarantineFolder = cfg.Section("paths").Key("QuarantineFolder").String()
+	err = loadShouldUpload(cfg.Section("general"), config)
+	if err != nil {
+		return nil, err
+	}
+	err = loadFilenames(cfg.Section("server"), cfg.Section("paths"), config)
+	if err != nil {
+		return nil, err
+	}
+	err = loadTransform(cfg.Section("general"), config)
+	if err != nil {
+		return nil, err
+	}
+	err = loadCollisionStrategies(cfg.Section("general"), config)
+	if err != nil {
+		return nil, err
+	}
+	config.RemoteCaseInsensitive = cfg.Section("server").Key("RemoteCaseInsensitive").MustBool(false)
+
+	err = loadGrouping(cfg.Section("grouping"), config)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range cfg.Section("paths").Key("WatchFiles").Strings(",") {
+		config.WatchFiles = append(config.WatchFiles, filepath.Clean(file))
+	}
+	if config.FolderToWatch == "" && len(config.WatchFiles) == 0 && !hasWatchSections(cfg) {
+		return nil, fmt.Errorf("either FolderToWatch, WatchFiles or a [watch:<name>] section must be set")
+	}
+	err = loadAcks(cfg.Section("server"), config)
+	if err != nil {
+		return nil, err
+	}
+	err = loadRemoteDirTemplate(cfg.Section("server"), config)
+	if err != nil {
+		return nil, err
+	}
+	err = loadRunFolder(cfg.Section("server"), config)
+	if err != nil {
+		return nil, err
+	}
+	err = loadPartRecovery(cfg.Section("server"), config)
+	if err != nil {
+		return nil, err
+	}
+	err = loadRemotePathRoot(cfg.Section("paths").Key("RemotePathRoot").String(), config)
+	if err != nil {
+		return nil, err
+	}
 
 	// Read list of file extensions to watch
 	config.WatchExtensions = cfg.Section("general").Key("WatchFileExtension").Strings(",")
+	err = loadFilters(cfg.Section("general"), config)
+	if err != nil {
+		return nil, err
+	}
+	err = loadZeroBytePolicy(cfg.Section("general"), config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = loadPostUploadActions(cfg.Section("postupload"), config)
+	if err != nil {
+		return nil, err
+	}
+	err = loadEncryption(cfg.Section("paths"), config)
+	if err != nil {
+		return nil, err
+	}
+
+	config.CopyBufferSizeKB = cfg.Section("general").Key("CopyBufferSizeKB").MustInt(defaultCopyBufferSizeKB)
+	if config.CopyBufferSizeKB < minCopyBufferSizeKB || config.CopyBufferSizeKB > maxCopyBufferSizeKB {
+		return nil, fmt.Errorf("CopyBufferSizeKB must be between %d and %d, got %d", minCopyBufferSizeKB, maxCopyBufferSizeKB, config.CopyBufferSizeKB)
+	}
+	if minimum := sftpCopyBufferKB(config); config.CopyBufferSizeKB < minimum {
+		config.CopyBufferSizeKB = minimum
+		cfg.Section("general").Key("CopyBufferSizeKB").SetValue(strconv.Itoa(minimum))
+	}
+
+	err = loadCloudStorage(cfg.Section("cloud"), config)
+	if err != nil {
+		return nil, err
+	}
+
+	// last, the shadow destination starts from the complete configuration
+	err = loadShadow(cfg.Section("server"), config)
+	if err != nil {
+		return nil, err
+	}
+	err = loadWatchFolders(cfg, config)
+	if err != nil {
+		return nil, err
+	}
 
 	return config, nil
 }
 
+// algorithmList reads a comma separated list of SSH algorithms. An unset key
+// yields nil, which ssh.Config takes as "use the defaults", an empty slice
+// would disable every algorithm.
+func algorithmList(key *ini.Key) []string {
+	if key.String() == "" {
+		return nil
+	}
+	return key.Strings(",")
+}
+
+// internalFolders returns the working folders the tool itself writes into.
+// Their contents must never be treated as input.
+func (c *Config) internalFolders() []string {
+	var folders []string
+	for _, folder := range []string{c.processedFolder, c.failedFolder, c.duplicatesFolder, c.slowFolder, c.quarantineFolder} {
+		if folder != "" {
+			folders = append(folders, filepath.Clean(folder))
+		}
+	}
+	// TempDir only when it was put inside the watch folder, the default
+	// system temp folder rather holds the watch folder
+	if _, inside := relativeToWatchFolder(c.TempDir, c); inside {
+		folders = append(folders, filepath.Clean(c.TempDir))
+	}
+	return folders
+}
+
+// isInternalFolder reports whether path is one of the tool's internal folders
+// or lies inside one of them.
+func isInternalFolder(path string, config *Config) bool {
+	path = filepath.Clean(path)
+	for _, folder := range config.internalFolders() {
+		if path == folder || strings.HasPrefix(path, folder+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// oneOf reads an enumerated setting. An empty value selects the first allowed
+// value, which is written back like the Must* defaults, anything not in the
+// list is a configuration error.
+func oneOf(key *ini.Key, allowed ...string) (string, error) {
+	value := strings.ToLower(strings.TrimSpace(key.String()))
+	if value == "" {
+		key.SetValue(allowed[0])
+		return allowed[0], nil
+	}
+	for _, a := range allowed {
+		if value == a {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("invalid %s %q, expected one of: %s", key.Name(), key.String(), strings.Join(allowed, ", "))
+}
+
 func hasExtension(filename string, extensions []string) bool {
 	ext := filepath.Ext(filename)
 	for _, e := range extensions {
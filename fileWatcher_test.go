@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/ini.v1"
+)
+
+// testConfig runs the loader on a configuration watching folder, with
+// settings given as "section.Key" = value on top of the defaults.
+func testConfig(t testing.TB, folder string, settings map[string]string) *Config {
+	t.Helper()
+	cfg := ini.Empty()
+	cfg.Section("paths").Key("FolderToWatch").SetValue(folder)
+	for name, value := range settings {
+		section, key, _ := strings.Cut(name, ".")
+		cfg.Section(section).Key(key).SetValue(value)
+	}
+	config, err := configFromIni(cfg, "", nil)
+	if err != nil {
+		t.Fatalf("configFromIni: %v", err)
+	}
+	return config
+}
+
+// writeFile creates a test file with content.
+func writeFile(t testing.TB, path, content string) {
+	t.Helper()
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startSftpServer serves root over SFTP on a local port until the test ends,
+// for user "test" with password "test". wrap, if not nil, wraps every
+// accepted connection. It returns the settings to connect to it.
+func startSftpServer(t testing.TB, root string, wrap func(net.Conn) net.Conn) map[string]string {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() != "test" || string(password) != "test" {
+				return nil, fmt.Errorf("wrong password for %s", conn.User())
+			}
+			return nil, nil
+		},
+	}
+	serverConfig.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if wrap != nil {
+				conn = wrap(conn)
+			}
+			go serveSftp(conn, root, serverConfig)
+		}
+	}()
+
+	return map[string]string{
+		"server.SftpServer":           "127.0.0.1",
+		"server.SftpPort":             strconv.Itoa(listener.Addr().(*net.TCPAddr).Port),
+		"server.SftpUser":             "test",
+		"server.SftpPassword":         "test",
+		"server.AllowInsecureHostKey": "true",
+	}
+}
+
+// serveSftp runs the SFTP subsystem for the sessions of one connection.
+func serveSftp(conn net.Conn, root string, serverConfig *ssh.ServerConfig) {
+	defer conn.Close()
+	_, channels, requests, err := ssh.NewServerConn(conn, serverConfig)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for request := range channelRequests {
+				ok := request.Type == "subsystem" && string(request.Payload[4:]) == "sftp"
+				request.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(root))
+				if err != nil {
+					channel.Close()
+					return
+				}
+				go func() {
+					server.Serve()
+					server.Close()
+				}()
+			}
+		}()
+	}
+}
+
+// quietLogs discards log output for the rest of the test.
+func quietLogs(t testing.TB) {
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+}
+
+// BenchmarkStartupScan measures how fast the startup scan gets through a
+// large folder. None of the files match the filter, so the listing, not the
+// uploads, is what is measured.
+func BenchmarkStartupScan(b *testing.B) {
+	const files = 20000
+	quietLogs(b)
+	dir := b.TempDir()
+	for i := range files {
+		err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%06d.dat", i)), nil, 0644)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	config := testConfig(b, dir, map[string]string{"general.WatchFileExtension": ".csv"})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		failed, err := processExistingFiles(dir, nil, nil, *config)
+		if err != nil || failed != 0 {
+			b.Fatalf("scan failed: %d files, %v", failed, err)
+		}
+	}
+	b.ReportMetric(float64(files*b.N)/b.Elapsed().Seconds(), "files/s")
+}
+
+// BenchmarkCopyBuffered measures copyBuffered with several CopyBufferSizeKB
+// values, from a local file to another local file and to the test SFTP
+// server.
+func BenchmarkCopyBuffered(b *testing.B) {
+	const size = 32 << 20
+	quietLogs(b)
+	dir := b.TempDir()
+	src := filepath.Join(dir, "source.dat")
+	data := make([]byte, size)
+	rand.Read(data)
+	err := os.WriteFile(src, data, 0644)
+	if err != nil {
+		b.Fatal(err)
+	}
+	remote := b.TempDir()
+	config := testConfig(b, dir, startSftpServer(b, remote, nil))
+	sftpClient, sshClient, _, err := dialServer(config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { closeClients(sftpClient, sshClient) })
+
+	targets := map[string]func() (io.WriteCloser, error){
+		"disk": func() (io.WriteCloser, error) { return os.Create(filepath.Join(dir, "copy.dat")) },
+		"sftp": func() (io.WriteCloser, error) { return sftpClient.Create("copy.dat") },
+	}
+	for _, target := range []string{"disk", "sftp"} {
+		for _, kb := range []int{32, 256, 1024} {
+			b.Run(fmt.Sprintf("%s/%dKB", target, kb), func(b *testing.B) {
+				config.CopyBufferSizeKB = kb
+				b.SetBytes(size)
+				for range b.N {
+					in, err := os.Open(src)
+					if err != nil {
+						b.Fatal(err)
+					}
+					out, err := targets[target]()
+					if err != nil {
+						b.Fatal(err)
+					}
+					_, err = copyBuffered(out, in, config)
+					in.Close()
+					if closeErr := out.Close(); err == nil {
+						err = closeErr
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
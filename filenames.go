@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gopkg.in/ini.v1"
+)
+
+// NormalizeFilenames values.
+const (
+	normalizeOff           = "off"
+	normalizeStrict        = "strict"
+	normalizeTransliterate = "transliterate"
+	normalizePercent       = "percent"
+)
+
+// FilenameEncoding values.
+const (
+	encodingUTF8   = "utf-8"
+	encodingLatin1 = "latin1"
+)
+
+// unsafeNameChars are refused by common server file systems or shells, on
+// top of control characters.
+const unsafeNameChars = `\:*?"<>|`
+
+// transliterations maps letters of the Latin-1 and Latin Extended-A blocks
+// to their plain ASCII base letters.
+var transliterations = map[rune]string{
+	'À': "A", 'Á': "A", 'Â': "A", 'Ã': "A", 'Ä': "A", 'Å': "A", 'Æ': "AE", 'Ç': "C",
+	'È': "E", 'É': "E", 'Ê': "E", 'Ë': "E", 'Ì': "I", 'Í': "I", 'Î': "I", 'Ï': "I",
+	'Ð': "D", 'Ñ': "N", 'Ò': "O", 'Ó': "O", 'Ô': "O", 'Õ': "O", 'Ö': "O", 'Ø': "O",
+	'Ù': "U", 'Ú': "U", 'Û': "U", 'Ü': "U", 'Ý': "Y", 'Þ': "TH", 'ß': "ss",
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'æ': "ae", 'ç': "c",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ì': "i", 'í': "i", 'î': "i", 'ï': "i",
+	'ð': "d", 'ñ': "n", 'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ý': "y", 'þ': "th", 'ÿ': "y",
+	'Č': "C", 'č': "c", 'Ć': "C", 'ć': "c", 'Đ': "D", 'đ': "d", 'Ě': "E", 'ě': "e",
+	'Ł': "L", 'ł': "l", 'Ń': "N", 'ń': "n", 'Ň': "N", 'ň': "n", 'Œ': "OE", 'œ': "oe",
+	'Ř': "R", 'ř': "r", 'Ś': "S", 'ś': "s", 'Š': "S", 'š': "s", 'Ť': "T", 'ť': "t",
+	'Ů': "U", 'ů': "u", 'Ź': "Z", 'ź': "z", 'Ż': "Z", 'ż': "z", 'Ž': "Z", 'ž': "z",
+}
+
+// errUnsafeName is why a file whose name can't be used on the server is
+// quarantined.
+var errUnsafeName = errors.New("file name can't be used as a remote name")
+
+// loadFilenames reads NormalizeFilenames and FilenameEncoding from [server]
+// and FilenameMapFile from [paths].
+func loadFilenames(server, paths *ini.Section, config *Config) error {
+	var err error
+	config.NormalizeFilenames, err = oneOf(server.Key("NormalizeFilenames"), normalizeOff, normalizeStrict, normalizeTransliterate, normalizePercent)
+	if err != nil {
+		return err
+	}
+	config.FilenameEncoding, err = oneOf(server.Key("FilenameEncoding"), encodingUTF8, encodingLatin1)
+	if err != nil {
+		return err
+	}
+	config.FilenameMapFile = paths.Key("FilenameMapFile").String()
+	return nil
+}
+
+// remoteName turns one local path element into the name used on the
+// server. Names that are not valid UTF-8 are read as Latin-1 with
+// FilenameEncoding = latin1, then NormalizeFilenames applies.
+func remoteName(name string, config *Config) string {
+	if config.FilenameEncoding == encodingLatin1 && !utf8.ValidString(name) {
+		name = latin1ToUTF8(name)
+	}
+	switch config.NormalizeFilenames {
+	case normalizeTransliterate:
+		return transliterateName(name)
+	case normalizePercent:
+		return percentEncodeName(name)
+	}
+	return name
+}
+
+// remoteRelPath applies remoteName to each element of a slash separated
+// relative path.
+func remoteRelPath(rel string, config *Config) string {
+	if config.FilenameEncoding == encodingUTF8 && config.NormalizeFilenames == normalizeOff {
+		return rel
+	}
+	parts := strings.Split(rel, "/")
+	for i, part := range parts {
+		parts[i] = remoteName(part, config)
+	}
+	return strings.Join(parts, "/")
+}
+
+func latin1ToUTF8(name string) string {
+	runes := make([]rune, len(name))
+	for i := 0; i < len(name); i++ {
+		runes[i] = rune(name[i])
+	}
+	return string(runes)
+}
+
+// transliterateName replaces accented letters with their base letters and
+// everything else that is not plain printable ASCII, or unsafe on servers,
+// with "_".
+func transliterateName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == utf8.RuneError:
+			b.WriteByte('_')
+		case r < 0x80 && safeNameChar(byte(r)):
+			b.WriteRune(r)
+		case transliterations[r] != "":
+			b.WriteString(transliterations[r])
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// percentEncodeName writes every byte that is not plain printable ASCII,
+// and "%" itself, as %XX, so the original name can be decoded again.
+func percentEncodeName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c < 0x80 && c != '%' && c != ' ' && safeNameChar(c) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func safeNameChar(c byte) bool {
+	return c >= 0x20 && c != 0x7f && !strings.ContainsRune(unsafeNameChars, rune(c))
+}
+
+// checkRemoteName reports whether path can be uploaded under its remote
+// name. strict refuses every name that normalization would change, the
+// other modes only refuse names that end up as nothing, "." or "..".
+func checkRemoteName(path string, config *Config) error {
+	if config.NormalizeFilenames == normalizeOff {
+		return nil
+	}
+	name := filepath.Base(path)
+	normalized := remoteName(name, config)
+	if config.NormalizeFilenames == normalizeStrict {
+		if transliterateName(normalized) != normalized {
+			return errUnsafeName
+		}
+		return nil
+	}
+	if normalized == "" || normalized == "." || normalized == ".." {
+		return errUnsafeName
+	}
+	return nil
+}
+
+// filenameMapping is one line of FilenameMapFile. The local path is
+// percent-encoded like with NormalizeFilenames = percent, as JSON can't
+// hold names that aren't valid UTF-8.
+type filenameMapping struct {
+	Local     string    `json:"local"`
+	Remote    string    `json:"remote"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// recordFilenameMapping appends the original name of a file that was
+// uploaded under a different remote name to FilenameMapFile.
+func recordFilenameMapping(path, remotePath string, config *Config) {
+	name := filepath.Base(path)
+	if remoteName(name, config) == name {
+		return
+	}
+	slog.Info("File uploaded under a normalized name", "file", path, "remote", remotePath)
+	if config.FilenameMapFile == "" {
+		return
+	}
+	err := appendMapping(config.FilenameMapFile, filenameMapping{Local: percentEncodeName(path), Remote: remotePath, Timestamp: time.Now()})
+	if err != nil {
+		slog.Error("Failed to record file name mapping", "file", path, "error", err)
+	}
+}
+
+func appendMapping(file string, mapping filenameMapping) error {
+	line, err := json.Marshal(mapping)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// loadFilters reads MatchRegex, IgnoreRegex, UploadFilter and ArchiveFilter
+// from the [general] section.
+func loadFilters(section *ini.Section, config *Config) error {
+	config.UploadFilter = extensionList(section.Key("UploadFilter"))
+	config.ArchiveFilter = extensionList(section.Key("ArchiveFilter"))
+	var err error
+	config.MatchRegex, err = compileOptionalRegex(section.Key("MatchRegex"))
+	if err != nil {
+		return err
+	}
+	config.IgnoreRegex, err = compileOptionalRegex(section.Key("IgnoreRegex"))
+	if err != nil {
+		return err
+	}
+	config.OnlyProcessModifiedWithin = section.Key("OnlyProcessModifiedWithin").MustDuration(0)
+	if config.OnlyProcessModifiedWithin < 0 {
+		return fmt.Errorf("OnlyProcessModifiedWithin must not be negative, got %s", config.OnlyProcessModifiedWithin)
+	}
+	config.AllowedOwnerUIDs, err = idList(section.Key("AllowedOwnerUIDs"))
+	if err != nil {
+		return err
+	}
+	config.AllowedOwnerGIDs, err = idList(section.Key("AllowedOwnerGIDs"))
+	if err != nil {
+		return err
+	}
+	if (config.AllowedOwnerUIDs != nil || config.AllowedOwnerGIDs != nil) && runtime.GOOS == "windows" {
+		slog.Warn("AllowedOwnerUIDs and AllowedOwnerGIDs are ignored on Windows")
+	}
+	return nil
+}
+
+// idList reads a comma separated list of numeric user or group ids. An
+// unset key yields nil, which allows every owner.
+func idList(key *ini.Key) ([]uint32, error) {
+	if key.String() == "" {
+		return nil, nil
+	}
+	var ids []uint32
+	for _, value := range key.Strings(",") {
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q, expected a numeric id", key.Name(), value)
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
+
+// extensionList reads a comma separated list of extensions. An unset key
+// yields nil, so the filter falls back to WatchExtensions.
+func extensionList(key *ini.Key) []string {
+	if key.String() == "" {
+		return nil
+	}
+	return key.Strings(",")
+}
+
+func compileOptionalRegex(key *ini.Key) (*regexp.Regexp, error) {
+	if key.String() == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(key.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %w", key.Name(), key.String(), err)
+	}
+	return re, nil
+}
+
+// matchesFilter reports whether a file in the watch folder should be
+// uploaded.
+func matchesFilter(path string, config *Config) bool {
+	return skipReason(path, config) == ""
+}
+
+// skipReason returns why a file in the watch folder is not uploaded, or ""
+// when it is. The extension must be one of UploadFilter, which defaults to
+// WatchExtensions (not checked when only MatchRegex is configured), the file
+// name must match MatchRegex and must not match IgnoreRegex. With
+// AllowedOwnerUIDs or AllowedOwnerGIDs the file must belong to one of them,
+// with OnlyProcessModifiedWithin it must have been modified recently.
+func skipReason(path string, config *Config) string {
+	name := filepath.Base(path)
+	extensions := config.UploadFilter
+	if extensions == nil {
+		extensions = config.WatchExtensions
+	}
+	if (len(extensions) > 0 || config.MatchRegex == nil) && !extensionAllowed(name, extensions) {
+		return skipExtension
+	}
+	if config.MatchRegex != nil && !config.MatchRegex.MatchString(name) {
+		return skipNoMatch
+	}
+	if config.IgnoreRegex != nil && config.IgnoreRegex.MatchString(name) {
+		return skipIgnored
+	}
+	if !ownerAllowed(path, config) {
+		return skipOwner
+	}
+	if !modifiedRecently(path, config) {
+		return skipTooOld
+	}
+	return ""
+}
+
+// modifiedRecently checks OnlyProcessModifiedWithin. Files that can't be
+// read pass, processing them reports the actual problem.
+func modifiedRecently(path string, config *Config) bool {
+	if config.OnlyProcessModifiedWithin <= 0 {
+		return true
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return true
+	}
+	return time.Since(info.ModTime()) <= config.OnlyProcessModifiedWithin
+}
+
+// ownerAllowed checks the owner filters. Files whose owner cannot be read,
+// including every file on Windows, pass.
+func ownerAllowed(path string, config *Config) bool {
+	if config.AllowedOwnerUIDs == nil && config.AllowedOwnerGIDs == nil {
+		return true
+	}
+	uid, gid, ok := fileOwner(path)
+	if !ok {
+		return true
+	}
+	if config.AllowedOwnerUIDs != nil && !slices.Contains(config.AllowedOwnerUIDs, uid) {
+		return false
+	}
+	return config.AllowedOwnerGIDs == nil || slices.Contains(config.AllowedOwnerGIDs, gid)
+}
+
+// matchesArchiveFilter reports whether a file that is not uploaded is still
+// kept in the processed folder.
+func matchesArchiveFilter(path string, config *Config) bool {
+	if config.ArchiveFilter == nil {
+		return matchesFilter(path, config)
+	}
+	name := filepath.Base(path)
+	if config.IgnoreRegex != nil && config.IgnoreRegex.MatchString(name) || !ownerAllowed(path, config) || !modifiedRecently(path, config) {
+		return false
+	}
+	return extensionAllowed(name, config.ArchiveFilter)
+}
+
+// keptAfterUpload reports whether an uploaded file is kept in the processed
+// folder. Without ArchiveFilter that is every uploaded file. Only the
+// pattern counts: the file passed the upload filters already, checking its
+// age or owner again could delete a file that just aged past
+// OnlyProcessModifiedWithin during the upload.
+func keptAfterUpload(path string, config *Config) bool {
+	return config.ArchiveFilter == nil || extensionAllowed(filepath.Base(path), config.ArchiveFilter)
+}
+
+// isArchiveOnly reports whether a file is archived without being uploaded.
+func isArchiveOnly(path string, config *Config) bool {
+	return config.ArchiveFilter != nil && !matchesFilter(path, config) && matchesArchiveFilter(path, config)
+}
+
+// extensionAllowed is hasExtension with "*" standing for any file.
+func extensionAllowed(name string, extensions []string) bool {
+	return slices.Contains(extensions, "*") || hasExtension(name, extensions)
+}
+
+// archiveWithoutUpload moves a file that is only kept for the record into
+// the processed folder.
+func archiveWithoutUpload(path string, config *Config) error {
+	target, err := moveLocalFile(path, processedDirFor(path, config), config.ProcessedCollisionStrategy)
+	if err != nil {
+		return fmt.Errorf("failed to move file to 'processed' folder: %w", err)
+	}
+	slog.Info("File archived without upload", "file", path, "target", target)
+	err = state.markNotUploaded(target)
+	if err != nil {
+		slog.Warn("Failed to record archived file in state file", "file", target, "error", err)
+	}
+	return finishSourceFile(path, config)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"os"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+	"gopkg.in/ini.v1"
+)
+
+// gcs uploads objects with the resumable uploads of the storage client's
+// Writer, which sends them in chunks and creates the object with the last
+// one. Its CRC32C is then compared to the data written. An upload whose
+// context is cancelled creates no object.
+type gcs struct {
+	client    *storage.Client
+	bucket    string
+	chunkSize int
+	timeout   time.Duration
+	// endpoint and auth are for the configuration summary
+	endpoint string
+	auth     string
+}
+
+// newGCS reads CredentialsFile, the JSON key of a service account, which
+// defaults to GOOGLE_APPLICATION_CREDENTIALS. Without either the
+// application default credentials are used, e.g. of the VM. Endpoint, for
+// private endpoints, defaults to the public API, STORAGE_EMULATOR_HOST
+// points the client to an emulator.
+func newGCS(section *ini.Section, config *Config) (*gcs, error) {
+	g := &gcs{
+		bucket:    config.CloudContainer,
+		chunkSize: config.CloudChunkSize,
+		timeout:   config.CloudRequestTimeout,
+		endpoint:  "https://storage.googleapis.com",
+		auth:      "application default credentials",
+	}
+	var options []option.ClientOption
+	path := section.Key("CredentialsFile").MustString(os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"))
+	if path != "" {
+		options = append(options, option.WithCredentialsFile(path))
+		g.auth = "credentials file " + path
+	}
+	if endpoint := section.Key("Endpoint").String(); endpoint != "" {
+		options = append(options, option.WithEndpoint(endpoint))
+		g.endpoint = endpoint
+	}
+	if emulator := os.Getenv("STORAGE_EMULATOR_HOST"); emulator != "" {
+		g.endpoint, g.auth = emulator, "none, emulator"
+	}
+
+	var err error
+	g.client, err = storage.NewClient(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the Cloud Storage client: %w", err)
+	}
+	return g, nil
+}
+
+func (g *gcs) describe() (string, string) {
+	return g.endpoint + "/" + g.bucket, g.auth
+}
+
+func (g *gcs) newObject(name string) (cloudObject, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := g.client.Bucket(g.bucket).Object(name).NewWriter(ctx)
+	w.ChunkSize = g.chunkSize
+	w.ChunkTransferTimeout = g.timeout
+	w.ChunkRetryDeadline = g.timeout
+	w.ContentType = "application/octet-stream"
+	return &gcsObject{w: w, cancel: cancel, sum: crc32.New(crc32.MakeTable(crc32.Castagnoli))}, nil
+}
+
+type gcsObject struct {
+	w      *storage.Writer
+	cancel context.CancelFunc
+	// sum is the CRC32C of the data written
+	sum hash.Hash32
+}
+
+func (o *gcsObject) Write(p []byte) (int, error) {
+	n, err := o.w.Write(p)
+	o.sum.Write(p[:n])
+	return n, err
+}
+
+func (o *gcsObject) commit() error {
+	defer o.cancel()
+	err := o.w.Close()
+	if err != nil {
+		return err
+	}
+	if got := o.w.Attrs().CRC32C; got != o.sum.Sum32() {
+		return fmt.Errorf("checksum mismatch: sent CRC32C %08x, object %s has %08x", o.sum.Sum32(), o.w.Attrs().Name, got)
+	}
+	return nil
+}
+
+func (o *gcsObject) abort() {
+	o.cancel()
+	o.w.Close()
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/ini.v1"
+)
+
+// Files that belong together (rec123.xml, rec123.pdf, rec123.meta) can be
+// delivered as one tar archive, or as one remote folder that appears all at
+// once. GroupPattern extracts the group key from the file name (its first
+// capture group, or the whole match), the group is complete once a file for
+// every GroupMembers suffix, or GroupMemberCount files, arrived, or, with
+// only GroupWindowSeconds, once that window after its first file is over.
+// Groups that stay incomplete for GroupTimeout go to the failed folder.
+// A complete group whose delivery failed is retried as a whole, like a file.
+
+// How a complete group is delivered, see GroupDelivery.
+const (
+	groupDeliveryTar    = "tar"
+	groupDeliveryFolder = "folder"
+)
+
+// groupCheckInterval is how often incomplete groups are checked for timeouts.
+const groupCheckInterval = 5 * time.Second
+
+type fileGroup struct {
+	key     string
+	members map[string]bool
+	started time.Time
+	// set once a delivery failed, see retryGroup
+	attempts     int
+	firstFailure time.Time
+	next         time.Time
+	// remoteDir is set once the members arrived in their remote folder but
+	// GroupCompleteMarker could not be created, a retry only creates that.
+	// delivered are the members in it.
+	remoteDir string
+	delivered []string
+}
+
+// retrying reports whether the group is complete and waits for another
+// delivery.
+func (g *fileGroup) retrying() bool {
+	return !g.firstFailure.IsZero()
+}
+
+// pendingGroups holds the incomplete groups. It is only used from the main
+// goroutine.
+var pendingGroups = map[string]*fileGroup{}
+
+func loadGrouping(section *ini.Section, config *Config) error {
+	pattern := section.Key("GroupPattern").String()
+	if pattern == "" {
+		return nil
+	}
+	var err error
+	config.GroupPattern, err = regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid GroupPattern: %w", err)
+	}
+	config.GroupMembers = section.Key("GroupMembers").Strings(",")
+	config.GroupMemberCount = section.Key("GroupMemberCount").MustInt(0)
+	config.GroupWindow = time.Duration(section.Key("GroupWindowSeconds").MustInt(0)) * time.Second
+	if len(config.GroupMembers) == 0 && config.GroupMemberCount <= 0 && config.GroupWindow <= 0 {
+		return fmt.Errorf("GroupPattern needs GroupMembers, GroupMemberCount or GroupWindowSeconds")
+	}
+	config.GroupTimeout = time.Duration(section.Key("GroupTimeoutSeconds").MustInt(300)) * time.Second
+	config.GroupDelivery, err = oneOf(section.Key("GroupDelivery"), groupDeliveryTar, groupDeliveryFolder)
+	if err != nil {
+		return err
+	}
+	config.GroupCompleteMarker = section.Key("GroupCompleteMarker").String()
+	if strings.ContainsAny(config.GroupCompleteMarker, `/\`) {
+		return fmt.Errorf("GroupCompleteMarker must be a file name, got %q", config.GroupCompleteMarker)
+	}
+	return nil
+}
+
+// groupKey returns the group a file belongs to, if grouping is enabled and
+// the file name matches GroupPattern.
+func groupKey(path string, config *Config) (string, bool) {
+	if config.GroupPattern == nil {
+		return "", false
+	}
+	match := config.GroupPattern.FindStringSubmatch(filepath.Base(path))
+	if match == nil {
+		return "", false
+	}
+	if len(match) > 1 {
+		return match[1], true
+	}
+	return match[0], true
+}
+
+// addToGroup records a new group member and ships the group once complete.
+func addToGroup(path string, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) {
+	key, _ := groupKey(path, config)
+	group, ok := pendingGroups[key]
+	if !ok {
+		group = &fileGroup{key: key, members: map[string]bool{}, started: time.Now()}
+		pendingGroups[key] = group
+	}
+	group.members[filepath.Clean(path)] = true
+	slog.Debug("File added to group", "file", path, "group", key, "members", len(group.members))
+
+	// a group waiting for a retry goes with it, including late members
+	if group.retrying() || !groupComplete(group, config) {
+		return
+	}
+	shipGroup(group, sftpClient, sshClient, config)
+}
+
+// shipGroup delivers a complete group the configured way and schedules a
+// retry when that fails.
+func shipGroup(group *fileGroup, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) {
+	err := checkUploadsPaused()
+	if err == nil && config.GroupDelivery == groupDeliveryFolder {
+		err = uploadGroupFolder(group, sftpClient, sshClient, config)
+	} else if err == nil {
+		err = uploadGroup(group, sftpClient, config)
+	}
+	if err != nil && !retryScanFailures {
+		// --once leaves the members in place for the next run
+		delete(pendingGroups, group.key)
+		slog.Error("Failed to upload group", "group", group.key, "error", err)
+		return
+	}
+	if err != nil {
+		retryGroup(group, err, config)
+		return
+	}
+	delete(pendingGroups, group.key)
+	if group.retrying() {
+		slog.Info("Group upload succeeded after retry", "group", group.key, "attempts", group.attempts+1)
+	}
+	// members that arrived while only the marker was missing form a new group
+	if group.remoteDir != "" {
+		for _, member := range sortedMembers(group) {
+			if !slices.Contains(group.delivered, member) {
+				addToGroup(member, sftpClient, sshClient, config)
+			}
+		}
+	}
+}
+
+// retryGroup schedules another delivery of a group that failed, with the
+// backoff, limits and pauses of file retries. Groups are kept in memory
+// only, after a restart the startup scan collects them again.
+func retryGroup(group *fileGroup, reason error, config *Config) {
+	if isPermanentError(reason, config) {
+		failGroup(group, reason, config)
+		return
+	}
+	if !group.retrying() {
+		group.firstFailure = time.Now()
+	}
+	if connectionDown || time.Now().Before(pausedUntil) {
+		group.next = pausedUntil
+		slog.Debug("Uploads are paused, group waits", "group", group.key, "until", pausedUntil)
+		return
+	}
+	group.attempts++
+
+	elapsed := time.Since(group.firstFailure)
+	if group.attempts > config.MaxRetries || elapsed >= config.MaxTotalRetryDuration {
+		failGroup(group, &retriesExhaustedError{attempts: group.attempts, elapsed: elapsed, err: reason}, config)
+		return
+	}
+
+	delay := retryBackoff(group.attempts, config)
+	group.next = time.Now().Add(delay)
+	slog.Warn("Group upload failed, retrying", "group", group.key, "attempt", group.attempts, "in", delay.Round(time.Millisecond), "error", reason)
+}
+
+// failGroup gives up on a group and moves its members to the failed folder.
+func failGroup(group *fileGroup, reason error, config *Config) {
+	delete(pendingGroups, group.key)
+	slog.Error("Failed to upload group", "group", group.key, "error", reason)
+	for member := range group.members {
+		err := moveToFailed(member, reason, config)
+		if err != nil {
+			slog.Error("Failed to move group member to 'failed' folder", "file", member, "error", err)
+		}
+	}
+}
+
+// windowOnly reports whether groups complete by GroupWindow alone.
+func windowOnly(config *Config) bool {
+	return config.GroupWindow > 0 && len(config.GroupMembers) == 0 && config.GroupMemberCount <= 0
+}
+
+func groupComplete(group *fileGroup, config *Config) bool {
+	if len(config.GroupMembers) == 0 {
+		return config.GroupMemberCount > 0 && len(group.members) >= config.GroupMemberCount
+	}
+	for _, suffix := range config.GroupMembers {
+		found := false
+		for member := range group.members {
+			if strings.HasSuffix(member, suffix) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// uploadGroup streams all members into "<key>.tar" on the server and applies
+// the post-upload action to each member afterwards. An existing "<key>.tar"
+// is handled by RemoteCollisionStrategy.
+func uploadGroup(group *fileGroup, sftpClient *sftp.Client, config *Config) error {
+	members := sortedMembers(group)
+
+	remotePath := remotePathFor(filepath.Join(config.FolderToWatch, group.key+".tar"), config)
+	waitForUploadSlot(config)
+	err := ensureRemoteParent(sftpClient, remotePath, config)
+	if err != nil {
+		return err
+	}
+	// the archive is only written while it is uploaded, there is no content
+	// to hash beforehand
+	tarConfig := *config
+	if tarConfig.RemoteCollisionStrategy == collisionHashSuffix {
+		tarConfig.RemoteCollisionStrategy = collisionCounter
+	}
+	target, err := resolveRemotePath(sftpClient, remotePath, "", &tarConfig)
+	if errors.Is(err, errRemoteExists) {
+		setAsideGroup(members, "Remote group archive already exists, upload skipped", config)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	remotePath = target
+	err = uploadAtomically(sftpClient, remotePath, func(w io.Writer) error {
+		w, done := startTransfer(w)
+		defer done()
+		if config.encryptTo == nil {
+			return writeGroupTar(w, members, config)
+		}
+		encrypted, err := encryptingWriter(w, group.key+".tar", config)
+		if err != nil {
+			return err
+		}
+		err = writeGroupTar(encrypted, members, config)
+		if err != nil {
+			return err
+		}
+		return encrypted.Close()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", remotePath, err)
+	}
+	uploadedFiles.Add(int64(len(members)))
+	slog.Info("Group uploaded successfully", "group", group.key, "remote", remotePath, "members", len(members))
+
+	err = applyRemoteOwnership(sftpClient, remotePath, config)
+	if err != nil {
+		if config.StrictChown {
+			return err
+		}
+		slog.Warn("Failed to change owner of remote file", "path", remotePath, "error", err)
+	}
+	finishGroupMembers(members, config)
+	return nil
+}
+
+func writeGroupTar(w io.Writer, members []string, config *Config) error {
+	tw := tar.NewWriter(w)
+	for _, member := range members {
+		err := addTarMember(tw, member, config)
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// uploadGroupFolder uploads the members one by one into "<key>.part" and
+// renames that to "<key>" once all are there, so the receiver sees either
+// the whole group or nothing. An existing "<key>" is handled by
+// RemoteCollisionStrategy like a watched directory. GroupCompleteMarker is
+// created in the folder afterwards, when that fails the retry only creates
+// the marker. The temporary folder is removed when the upload fails, and
+// one left over by an earlier attempt before starting again.
+func uploadGroupFolder(group *fileGroup, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) error {
+	if group.remoteDir != "" {
+		return completeGroupFolder(group, sftpClient, config)
+	}
+	members := sortedMembers(group)
+	remoteDir := remoteFolderFor(filepath.Join(config.FolderToWatch, group.key), config)
+	resolved, err := resolveRemoteDir(sftpClient, remoteDir, config)
+	if errors.Is(err, errRemoteExists) {
+		setAsideGroup(members, "Remote group folder already exists, upload skipped", config)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	remoteDir = resolved
+	tempDir := remoteDir + remoteTempSuffix
+
+	removeGroupTemp(sftpClient, tempDir)
+	err = sftpClient.MkdirAll(tempDir)
+	if err != nil {
+		return fmt.Errorf("failed to create remote folder %s: %w", tempDir, err)
+	}
+	for _, member := range members {
+		err := uploadGroupMember(member, encryptedName(path.Join(tempDir, filepath.Base(member)), config), sftpClient, sshClient, config)
+		if err != nil {
+			removeGroupTemp(sftpClient, tempDir)
+			return err
+		}
+	}
+	err = sftpClient.Rename(tempDir, remoteDir)
+	if err != nil {
+		removeGroupTemp(sftpClient, tempDir)
+		return fmt.Errorf("failed to rename %s to %s: %w", tempDir, remoteDir, err)
+	}
+	group.remoteDir, group.delivered = remoteDir, members
+	return completeGroupFolder(group, sftpClient, config)
+}
+
+// completeGroupFolder creates GroupCompleteMarker in the remote folder the
+// members of group were delivered to and finishes them.
+func completeGroupFolder(group *fileGroup, sftpClient *sftp.Client, config *Config) error {
+	if config.GroupCompleteMarker != "" {
+		marker, err := sftpClient.Create(path.Join(group.remoteDir, config.GroupCompleteMarker))
+		if err == nil {
+			err = marker.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create group complete marker in %s: %w", group.remoteDir, err)
+		}
+	}
+	slog.Info("Group uploaded successfully", "group", group.key, "remote", group.remoteDir, "members", len(group.delivered))
+	finishGroupMembers(group.delivered, config)
+	return nil
+}
+
+// setAsideGroup handles the members of a group that is not uploaded
+// because it was delivered already, like duplicate files.
+func setAsideGroup(members []string, message string, config *Config) {
+	for _, member := range members {
+		file, err := os.Open(member)
+		if err != nil {
+			slog.Error("Failed to open group member", "file", member, "error", err)
+			continue
+		}
+		err = setAsideDuplicate(member, file, message, config)
+		file.Close()
+		if err != nil {
+			slog.Error("Failed to set aside group member", "file", member, "error", err)
+		}
+	}
+}
+
+// removeGroupTemp removes the temporary folder of a group upload, if there
+// is one.
+func removeGroupTemp(sftpClient *sftp.Client, tempDir string) {
+	if _, err := sftpClient.Stat(tempDir); err != nil {
+		return
+	}
+	err := sftpClient.RemoveAll(tempDir)
+	if err != nil {
+		slog.Warn("Failed to remove remote temporary folder", "path", tempDir, "error", err)
+	}
+}
+
+func uploadGroupMember(member, remotePath string, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) error {
+	file, err := os.Open(member)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = copyFileToSftp(file, remotePath, sftpClient, sshClient, config)
+	return err
+}
+
+func sortedMembers(group *fileGroup) []string {
+	members := make([]string, 0, len(group.members))
+	for member := range group.members {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// finishGroupMembers applies the post-upload action to each member of an
+// uploaded group.
+func finishGroupMembers(members []string, config *Config) {
+	for _, member := range members {
+		file, err := os.Open(member)
+		if err != nil {
+			slog.Error("Failed to open uploaded group member", "file", member, "error", err)
+			continue
+		}
+		err = finishUploadedFile(member, file, config)
+		file.Close()
+		if err != nil {
+			slog.Error("Failed to finish uploaded group member", "file", member, "error", err)
+		}
+	}
+}
+
+func addTarMember(tw *tar.Writer, path string, config *Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.Base(path)
+
+	err = tw.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	// the header promised info.Size() bytes, don't pick up later appends
+	_, err = copyBuffered(tw, io.LimitReader(file, info.Size()), config)
+	return err
+}
+
+// expireGroups ships the groups whose GroupWindow is over or whose retry is
+// due and moves the members of groups that did not complete within
+// GroupTimeout to the failed folder.
+func expireGroups(sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) {
+	for key, group := range pendingGroups {
+		if group.retrying() {
+			if !time.Now().Before(group.next) {
+				retryDueGroup(group, sftpClient, sshClient, config)
+			}
+			continue
+		}
+		if windowOnly(config) && time.Since(group.started) >= config.GroupWindow {
+			shipGroup(group, sftpClient, sshClient, config)
+			continue
+		}
+		if time.Since(group.started) < config.GroupTimeout {
+			continue
+		}
+		delete(pendingGroups, key)
+
+		reason := fmt.Errorf("group %s still incomplete after %s", key, config.GroupTimeout)
+		for member := range group.members {
+			err := moveToFailed(member, reason, config)
+			if err != nil {
+				slog.Error("Failed to move incomplete group member", "file", member, "error", err)
+			}
+		}
+	}
+}
+
+// retryDueGroup delivers a group again. Members that were removed meanwhile
+// are left out, a group without members is dropped.
+func retryDueGroup(group *fileGroup, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) {
+	for member := range group.members {
+		if !fileExists(member) {
+			slog.Info("Group member is gone, leaving it out of the retry", "file", member, "group", group.key)
+			delete(group.members, member)
+		}
+	}
+	if len(group.members) == 0 {
+		delete(pendingGroups, group.key)
+		return
+	}
+	shipGroup(group, sftpClient, sshClient, config)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadGroupCollision(t *testing.T) {
+	quietLogs(t)
+	tests := []struct {
+		delivery string
+		strategy string
+		// want is the remote name the group is uploaded under, "" when it
+		// is not uploaded
+		want string
+	}{
+		{groupDeliveryTar, collisionCounter, "rec1_1.tar"},
+		{groupDeliveryTar, collisionHashSuffix, "rec1_1.tar"},
+		{groupDeliveryTar, collisionSkip, ""},
+		{groupDeliveryFolder, collisionCounter, "rec1_1"},
+		{groupDeliveryFolder, collisionSkip, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.delivery+"/"+test.strategy, func(t *testing.T) {
+			remote := t.TempDir()
+			settings := startSftpServer(t, remote, nil)
+			settings["general.RemoteCollisionStrategy"] = test.strategy
+			settings["grouping.GroupPattern"] = `^(rec\d+)\.`
+			settings["grouping.GroupMembers"] = ".xml,.pdf"
+			settings["grouping.GroupDelivery"] = test.delivery
+			folder := t.TempDir()
+			config := testConfig(t, folder, settings)
+			sftpClient, sshClient, _, err := dialServer(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { closeClients(sftpClient, sshClient) })
+
+			existing := filepath.Join(remote, "rec1.tar")
+			if test.delivery == groupDeliveryFolder {
+				existing = filepath.Join(remote, "rec1")
+				os.Mkdir(existing, 0755)
+				existing = filepath.Join(existing, "rec1.xml")
+			}
+			writeFile(t, existing, "delivered before")
+			members := []string{filepath.Join(folder, "rec1.xml"), filepath.Join(folder, "rec1.pdf")}
+			group := &fileGroup{key: "rec1", members: map[string]bool{}}
+			for _, member := range members {
+				writeFile(t, member, "new")
+				group.members[member] = true
+			}
+
+			if test.delivery == groupDeliveryFolder {
+				err = uploadGroupFolder(group, sftpClient, sshClient, config)
+			} else {
+				err = uploadGroup(group, sftpClient, config)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(existing)
+			if err != nil || string(data) != "delivered before" {
+				t.Errorf("the group delivered before reads %q, %v", data, err)
+			}
+			entries, _ := os.ReadDir(remote)
+			if test.want == "" && len(entries) != 1 {
+				t.Errorf("remote folder has %d entries, want the group not uploaded", len(entries))
+			}
+			if _, err := os.Stat(filepath.Join(remote, test.want)); test.want != "" && err != nil {
+				t.Errorf("group not uploaded as %s: %v", test.want, err)
+			}
+			for _, member := range members {
+				if _, err := os.Stat(member); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("member %s is still in the watch folder: %v", member, err)
+				}
+			}
+		})
+	}
+}
+
+// TestGroupMarkerRetry covers a group folder whose marker could not be
+// created: the retry only creates the marker, the members are not uploaded
+// again.
+func TestGroupMarkerRetry(t *testing.T) {
+	quietLogs(t)
+	remote := t.TempDir()
+	settings := startSftpServer(t, remote, nil)
+	settings["grouping.GroupPattern"] = `^(rec\d+)\.`
+	settings["grouping.GroupMemberCount"] = "1"
+	settings["grouping.GroupDelivery"] = groupDeliveryFolder
+	settings["grouping.GroupCompleteMarker"] = "done"
+	folder := t.TempDir()
+	config := testConfig(t, folder, settings)
+	sftpClient, sshClient, _, err := dialServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeClients(sftpClient, sshClient) })
+
+	member := filepath.Join(folder, "rec1.xml")
+	writeFile(t, member, "<rec/>")
+	group := &fileGroup{key: "rec1", members: map[string]bool{member: true}}
+	err = uploadGroupFolder(group, sftpClient, sshClient, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteDir := group.remoteDir
+	os.Remove(filepath.Join(remote, "rec1", "done"))
+
+	// a folder in place of the marker makes creating it fail
+	writeFile(t, member, "<rec/>")
+	group = &fileGroup{key: "rec1", members: map[string]bool{member: true}}
+	group.remoteDir, group.delivered = remoteDir, []string{member}
+	os.Mkdir(filepath.Join(remote, "rec1", "done"), 0755)
+	err = uploadGroupFolder(group, sftpClient, sshClient, config)
+	if err == nil {
+		t.Fatal("marker created over a folder")
+	}
+	os.Remove(filepath.Join(remote, "rec1", "done"))
+	err = uploadGroupFolder(group, sftpClient, sshClient, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(remote, "rec1", "done")); err != nil {
+		t.Errorf("marker not created: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(remote, "rec1_1")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("group uploaded again: %v", err)
+	}
+	if _, err := os.Stat(member); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("member is still in the watch folder: %v", err)
+	}
+}
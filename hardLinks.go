@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// Policies for names of a file that was uploaded under another name, see
+// HardLinkPolicy.
+const (
+	hardLinkUpload = "upload"
+	hardLinkSkip   = "skip"
+)
+
+// fileID identifies a file independent of its name.
+type fileID struct {
+	dev, ino uint64
+}
+
+// uploadedLink is a hard-linked file that was uploaded. Size and modification
+// time guard against an inode number that was reused by a new file.
+type uploadedLink struct {
+	path     string
+	size     int64
+	modTime  time.Time
+	uploaded time.Time
+}
+
+// uploadedLinks remembers the hard-linked files uploaded within
+// HardLinkWindow. It is only used from the main goroutine.
+var uploadedLinks = map[fileID]uploadedLink{}
+
+// loadHardLinks reads HardLinkPolicy and HardLinkWindow from [general].
+func loadHardLinks(section *ini.Section, config *Config) error {
+	var err error
+	config.HardLinkPolicy, err = oneOf(section.Key("HardLinkPolicy"), hardLinkUpload, hardLinkSkip)
+	if err != nil {
+		return err
+	}
+	config.HardLinkWindow = section.Key("HardLinkWindow").MustDuration(time.Hour)
+	return nil
+}
+
+// uploadedUnderOtherName returns the name a hard link of info was uploaded
+// under within HardLinkWindow.
+func uploadedUnderOtherName(path string, info os.FileInfo, config *Config) (string, bool) {
+	if config.HardLinkPolicy != hardLinkSkip {
+		return "", false
+	}
+	// the uploaded name may be gone already, so any link count counts here
+	id, _, ok := fileIdentity(info)
+	if !ok || len(uploadedLinks) == 0 {
+		return "", false
+	}
+	for other, link := range uploadedLinks {
+		if time.Since(link.uploaded) >= config.HardLinkWindow {
+			delete(uploadedLinks, other)
+		}
+	}
+	link, ok := uploadedLinks[id]
+	if !ok || link.path == path || link.size != info.Size() || !link.modTime.Equal(info.ModTime()) {
+		return "", false
+	}
+	return link.path, true
+}
+
+// rememberUploadedLink records an uploaded file that has other names.
+func rememberUploadedLink(path string, info os.FileInfo, config *Config) {
+	if config.HardLinkPolicy != hardLinkSkip {
+		return
+	}
+	if id, links, ok := fileIdentity(info); ok && links > 1 {
+		uploadedLinks[id] = uploadedLink{path: path, size: info.Size(), modTime: info.ModTime(), uploaded: time.Now()}
+		slog.Debug("Uploaded file has more names", "file", path)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// Counters for the heartbeat, updated wherever files are uploaded or given up.
+var (
+	startTime     = time.Now()
+	uploadedFiles atomic.Int64
+	failedFiles   atomic.Int64
+)
+
+// heartbeat logs activity since startup and since the previous heartbeat, so
+// a quiet but healthy watcher can be told apart from a dead one. It is only
+// used from the main goroutine.
+type heartbeat struct {
+	uploaded int64
+	failed   int64
+}
+
+func (h *heartbeat) log(config *Config) {
+	uploaded, failed := uploadedFiles.Load(), failedFiles.Load()
+	attrs := []any{
+		"uptime", time.Since(startTime).Round(time.Second),
+		"uploaded", uploaded - h.uploaded,
+		"failed", failed - h.failed,
+		"queued", queuedFiles(),
+		"uploadedTotal", uploaded,
+		"failedTotal", failed,
+	}
+	if len(pendingAcks) > 0 {
+		attrs = append(attrs, "awaitingAck", len(pendingAcks))
+	}
+	if len(skipCounts) > 0 {
+		attrs = append(attrs, "skippedTotal", skipSummary())
+	}
+	if config.shadow != nil {
+		attrs = append(attrs, shadowAttrs()...)
+	}
+	if config.AdaptiveConcurrency {
+		attrs = append(attrs, concurrencyAttrs(config)...)
+	}
+	if config.LogThroughputStats {
+		attrs = append(attrs, throughputAttrs()...)
+	}
+	slog.Info("Heartbeat", attrs...)
+	h.uploaded, h.failed = uploaded, failed
+}
+
+// queuedFiles counts the files waiting for a retry or for their group.
+func queuedFiles() int {
+	queued := len(pendingRetries)
+	for _, group := range pendingGroups {
+		queued += len(group.members)
+	}
+	return queued
+}
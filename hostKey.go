@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"gopkg.in/ini.v1"
+)
+
+// loadHostKey reads KnownHostsPath from [paths] and AllowInsecureHostKey
+// from [server]. Without either, the known_hosts file of the user running
+// the watcher is used, like ssh does.
+func loadHostKey(paths, server *ini.Section, config *Config) error {
+	config.KnownHostsPath = paths.Key("KnownHostsPath").String()
+	config.AllowInsecureHostKey = server.Key("AllowInsecureHostKey").MustBool(false)
+	if config.AllowInsecureHostKey {
+		if config.KnownHostsPath != "" {
+			return fmt.Errorf("KnownHostsPath can't be combined with AllowInsecureHostKey = true")
+		}
+		return nil
+	}
+	if config.KnownHostsPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("no KnownHostsPath set and no home folder to look for known_hosts: %w", err)
+		}
+		config.KnownHostsPath = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	return nil
+}
+
+// hostKeyCallback returns the check of the server's host key. The
+// known_hosts file is read on every connect, so added keys are picked up
+// without a restart.
+func hostKeyCallback(config *Config) (ssh.HostKeyCallback, error) {
+	if config.AllowInsecureHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	check, err := knownhosts.New(config.KnownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts %s (set KnownHostsPath, or AllowInsecureHostKey = true to skip the check): %w", config.KnownHostsPath, err)
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		fingerprint := ssh.FingerprintSHA256(key)
+		if len(keyErr.Want) == 0 {
+			return fmt.Errorf("host key %s %s of %s is not in %s, add it after checking the fingerprint with the server's administrator", key.Type(), fingerprint, hostname, config.KnownHostsPath)
+		}
+		var known []string
+		for _, want := range keyErr.Want {
+			known = append(known, fmt.Sprintf("%s %s (%s:%d)", want.Key.Type(), ssh.FingerprintSHA256(want.Key), want.Filename, want.Line))
+		}
+		return fmt.Errorf("host key of %s does not match %s: server sent %s %s, expected %s. The server was reinstalled or the connection is intercepted", hostname, config.KnownHostsPath, key.Type(), fingerprint, strings.Join(known, ", "))
+	}, nil
+}
+
+// hostKeyAlgorithms returns the host key algorithms to ask the server at
+// addr for: those of the keys known_hosts lists for it. A server with keys
+// of several types would otherwise be free to present one known_hosts has
+// no entry of that type for, which the check takes for a changed key. Nil,
+// for Go's defaults, when known_hosts has no key for addr.
+func hostKeyAlgorithms(addr string, config *Config) []string {
+	if config.AllowInsecureHostKey {
+		return nil
+	}
+	check, err := knownhosts.New(config.KnownHostsPath)
+	if err != nil {
+		// hostKeyCallback reports it
+		return nil
+	}
+	// a key known_hosts doesn't have makes the check list the known ones
+	probe, err := ssh.NewPublicKey(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public())
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(check(addr, &net.TCPAddr{IP: net.IPv4zero}, probe), &keyErr) {
+		return nil
+	}
+
+	var types []string
+	for _, want := range keyErr.Want {
+		types = append(types, want.Key.Type())
+	}
+	slices.Sort(types)
+	var algorithms []string
+	for _, keyType := range types {
+		if keyType == ssh.KeyAlgoRSA {
+			// SHA-2 signatures first, ssh-rsa for servers without them
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+			continue
+		}
+		algorithms = append(algorithms, keyType)
+	}
+	return algorithms
+}
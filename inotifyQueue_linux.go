@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+const maxQueuedEventsFile = "/proc/sys/fs/inotify/max_queued_events"
+
+// raiseInotifyQueue raises the kernel limit of queued inotify events per
+// watcher to size. A higher current limit is kept. Writing the limit needs
+// root, an unprivileged user gets an error to log.
+func raiseInotifyQueue(size int) error {
+	data, err := os.ReadFile(maxQueuedEventsFile)
+	if err != nil {
+		return err
+	}
+	current, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err == nil && current >= size {
+		return nil
+	}
+	return os.WriteFile(maxQueuedEventsFile, []byte(strconv.Itoa(size)), 0644)
+}
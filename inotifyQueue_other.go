@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// raiseInotifyQueue only applies to inotify, which is Linux only.
+func raiseInotifyQueue(size int) error {
+	return errors.New("not supported on this platform")
+}
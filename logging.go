@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logLevel controls what the default slog logger emits. It starts at info so
+// everything logged before the config is read still shows up.
+var logLevel = new(slog.LevelVar)
+
+func init() {
+	slog.SetDefault(slog.New(correlationHandler{slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel})}))
+}
+
+// parseLogLevel maps the LogLevel setting to a slog level.
+func parseLogLevel(value string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("invalid LogLevel %q, expected one of: debug, info, warn, error", value)
+}
+
+// applyLogLevel sets the effective log level. --verbose and --quiet win over
+// the LogLevel from the config; quiet still lets warnings and errors through.
+func applyLogLevel(config *Config, verbose, quiet bool) {
+	switch {
+	case verbose:
+		logLevel.Set(slog.LevelDebug)
+	case quiet:
+		logLevel.Set(slog.LevelWarn)
+	default:
+		logLevel.Set(config.LogLevel)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// deferredFiles counts the files processFile set aside without uploading
+// them: empty files starting to wait for content and files moved to the
+// slow folder. The manifest reports them apart from the delivered ones.
+var deferredFiles atomic.Int64
+
+// uploadManifest uploads the files listed in the manifest file through the
+// normal pipeline, including duplicate checks, verification and archiving,
+// and returns the exit code. Every file is reported on its own, missing
+// files count as failures. Filters don't apply, the manifest names exactly
+// what to send.
+func uploadManifest(manifestPath string, verbose, quiet bool) int {
+	config, exitCode := loadStartupConfig(verbose, quiet)
+	if exitCode != exitOK {
+		return exitCode
+	}
+
+	files, err := readManifest(manifestPath)
+	if err != nil {
+		alert("Failed to read manifest: " + err.Error())
+		return exitConfigError
+	}
+	if len(files) == 0 {
+		alert("Manifest " + manifestPath + " lists no files")
+		return exitConfigError
+	}
+
+	state, err = openStateStore(config.StateFile)
+	if err != nil {
+		alert("Failed to open state file: " + err.Error())
+		return exitRuntimeError
+	}
+	err = startEventPublisher(config)
+	if err != nil {
+		alert("Failed to connect to event broker: " + err.Error())
+		return exitConfigError
+	}
+	defer stopEventPublisher()
+	defer stopShadow()
+
+	sftpClient, sshClient, exitCode := connectServer(config)
+	if exitCode != exitOK {
+		return exitCode
+	}
+	defer closeClients(sftpClient, sshClient)
+
+	failed, deferred := 0, 0
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if err == nil && !info.Mode().IsRegular() {
+			err = fmt.Errorf("not a regular file")
+		}
+		deferredBefore := deferredFiles.Load()
+		if err == nil {
+			err = processFile(path, sftpClient, sshClient, config)
+		}
+		if err != nil {
+			slog.Error("Manifest file failed", "file", path, "error", err)
+			failed++
+			continue
+		}
+		if deferredFiles.Load() != deferredBefore {
+			slog.Warn("Manifest file deferred, not uploaded", "file", path)
+			deferred++
+			continue
+		}
+		slog.Info("Manifest file done", "file", path)
+	}
+	slog.Info("Manifest finished", "manifest", manifestPath, "files", len(files), "failed", failed, "deferred", deferred)
+	if failed > 0 || deferred > 0 {
+		return exitFileFailures
+	}
+	return exitOK
+}
+
+// readManifest returns the paths listed in a manifest, one per line. Blank
+// lines and lines starting with # are ignored, relative paths are relative
+// to the manifest's folder.
+func readManifest(manifestPath string) ([]string, error) {
+	file, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var files []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(filepath.Dir(manifestPath), line)
+		}
+		files = append(files, filepath.Clean(line))
+	}
+	return files, scanner.Err()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	sshFxpSetstat           = 9
+	sshFileXferAttrExtended = 0x80000000
+)
+
+// runID identifies this run of the tool, it is the default {batch} value.
+var runID = time.Now().Format("20060102T150405")
+
+// loadMetadata reads the [metadata] section: every key is the name of an
+// extended attribute, its value a template that may use {filename},
+// {source}, {arrival}, {batch} and {correlation}.
+func loadMetadata(section *ini.Section, config *Config) {
+	config.Metadata = map[string]string{}
+	for _, key := range section.Keys() {
+		config.Metadata[key.Name()] = key.String()
+	}
+}
+
+// metadataValues returns the placeholder values for the local file path.
+func metadataValues(path string, info os.FileInfo, config *Config) map[string]string {
+	arrival := arrivalTime(path, info, config)
+	return map[string]string{
+		"filename":    filepath.Base(path),
+		"source":      path,
+		"arrival":     arrival.Format(time.RFC3339),
+		"batch":       config.BatchID,
+		"correlation": correlationOf(path),
+	}
+}
+
+// setRemoteMetadata attaches the [metadata] attributes to a remote file with
+// an SFTP SETSTAT carrying extended attributes. Servers are free to ignore
+// these, servers that reject them make this return an error.
+func setRemoteMetadata(sshClient *ssh.Client, remotePath string, values map[string]string, config *Config) error {
+	names := make([]string, 0, len(config.Metadata))
+	for name := range config.Metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	body := appendSftpString(nil, remotePath)
+	body = binary.BigEndian.AppendUint32(body, sshFileXferAttrExtended)
+	body = binary.BigEndian.AppendUint32(body, uint32(len(names)))
+	for _, name := range names {
+		body = appendSftpString(body, name)
+		body = appendSftpString(body, expandTemplate(config.Metadata[name], values))
+	}
+
+	channel, err := openRawSftpChannel(sshClient)
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+
+	_, _, err = channel.request(sshFxpSetstat, body)
+	if err != nil {
+		return fmt.Errorf("server did not accept extended attributes: %w", err)
+	}
+	slog.Debug("Set extended attributes", "path", remotePath, "attributes", names)
+	return nil
+}
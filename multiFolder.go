@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// watchSectionPrefix starts the names of the sections that add watch
+// folders, e.g. [watch:reports].
+const watchSectionPrefix = "watch:"
+
+// hasWatchSections reports whether cfg adds watch folders.
+func hasWatchSections(cfg *ini.File) bool {
+	for _, section := range cfg.Sections() {
+		if strings.HasPrefix(section.Name(), watchSectionPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadWatchFolders reads the [watch:<name>] sections. Each one adds a folder
+// with its own FolderToWatch, DestinationFolder, WatchFileExtension and
+// ProcessedFolder, all other settings are taken from config. Like the shadow
+// destination it starts from the complete configuration, so it is loaded
+// last.
+func loadWatchFolders(cfg *ini.File, config *Config) error {
+	seen := map[string]bool{}
+	if config.FolderToWatch != "" {
+		seen[filepath.Clean(config.FolderToWatch)] = true
+	}
+	for _, section := range cfg.Sections() {
+		name, ok := strings.CutPrefix(section.Name(), watchSectionPrefix)
+		if !ok {
+			continue
+		}
+		folder, err := watchFolderFrom(section, config)
+		if err != nil {
+			return fmt.Errorf("[%s]: %w", section.Name(), err)
+		}
+		if seen[folder.FolderToWatch] {
+			return fmt.Errorf("[%s]: %s is already watched", section.Name(), folder.FolderToWatch)
+		}
+		seen[folder.FolderToWatch] = true
+		folder.folderName = name
+		config.folders = append(config.folders, folder)
+	}
+	if len(config.folders) == 0 {
+		return nil
+	}
+
+	// these keep their state per folder on the main configuration
+	if config.UploadMode == uploadModeAppend || config.WatchUnit == watchUnitDirectory || config.GroupPattern != nil {
+		return fmt.Errorf("[watch:...] sections can't be combined with UploadMode = append, WatchUnit = directory or GroupPattern")
+	}
+	return nil
+}
+
+func watchFolderFrom(section *ini.Section, config *Config) (*Config, error) {
+	folder := *config
+	folder.folders = nil
+
+	folder.FolderToWatch = section.Key("FolderToWatch").String()
+	if folder.FolderToWatch == "" {
+		return nil, fmt.Errorf("FolderToWatch must be set")
+	}
+	folder.FolderToWatch = filepath.Clean(folder.FolderToWatch)
+
+	destination, err := expandEnv("DestinationFolder", section.Key("DestinationFolder").MustString(config.destionationFolder))
+	if err != nil {
+		return nil, err
+	}
+	if destination != "" && !strings.HasSuffix(destination, "/") {
+		destination += "/"
+	}
+	folder.destionationFolder = destination
+
+	if section.HasKey("WatchFileExtension") {
+		folder.WatchExtensions = section.Key("WatchFileExtension").Strings(",")
+		folder.UploadFilter = nil
+	}
+	folder.processedFolder = section.Key("ProcessedFolder").MustString(filepath.Join(folder.FolderToWatch, "processed"))
+	return &folder, nil
+}
+
+// watchFolders returns the configuration of every watch folder, FolderToWatch
+// first.
+func watchFolders(config *Config) []*Config {
+	var folders []*Config
+	if config.FolderToWatch != "" {
+		folders = append(folders, config)
+	}
+	return append(folders, config.folders...)
+}
+
+// folderConfig returns the configuration of the watch folder path is in,
+// the innermost one for nested folders with WatchRecursive, or config for
+// paths outside the added folders. A folder's configuration returns itself,
+// so calling this again is harmless.
+func folderConfig(path string, config *Config) *Config {
+	dir := filepath.Dir(filepath.Clean(path))
+	match := config
+	for _, folder := range config.folders {
+		if dir == folder.FolderToWatch {
+			return folder
+		}
+		if _, ok := relativeToWatchFolder(path, folder); ok && folder.WatchRecursive && (match == config || len(folder.FolderToWatch) > len(match.FolderToWatch)) {
+			match = folder
+		}
+	}
+	return match
+}
+
+// watchFolderConfig returns the configuration of the watch folder dir, or
+// nil when dir is not one.
+func watchFolderConfig(dir string, config *Config) *Config {
+	for _, folder := range watchFolders(config) {
+		if filepath.Clean(folder.FolderToWatch) == dir {
+			return folder
+		}
+	}
+	return nil
+}
+
+// processedFolders returns the distinct processed folders of all watch
+// folders.
+func processedFolders(config *Config) []*Config {
+	var folders []*Config
+	var seen []string
+	for _, folder := range watchFolders(config) {
+		if folder.processedFolder == "" || slices.Contains(seen, folder.processedFolder) {
+			continue
+		}
+		seen = append(seen, folder.processedFolder)
+		folders = append(folders, folder)
+	}
+	return folders
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/gen2brain/beeep"
+)
+
+// Values of the EnableDesktopNotifications setting.
+const (
+	notificationsAuto = "auto"
+	notificationsOn   = "true"
+	notificationsOff  = "false"
+)
+
+// notifyTimeout bounds how long exit waits for pending notifications.
+const notifyTimeout = 5 * time.Second
+
+var (
+	// desktopNotifications is decided once the config is loaded; until then
+	// (i.e. for config errors) the auto-detected default applies.
+	desktopNotifications = hasDesktop()
+	pendingAlerts        sync.WaitGroup
+)
+
+// hasDesktop guesses whether anybody could see a desktop notification. On
+// Linux and the BSDs that needs an X11 or Wayland session.
+func hasDesktop() bool {
+	switch runtime.GOOS {
+	case "windows", "darwin":
+		return true
+	}
+	return os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
+}
+
+func configureNotifications(config *Config) {
+	switch config.EnableDesktopNotifications {
+	case notificationsOn:
+		desktopNotifications = true
+	case notificationsOff:
+		desktopNotifications = false
+	default:
+		desktopNotifications = hasDesktop()
+	}
+}
+
+// alert logs an error and shows it as a desktop notification when enabled.
+// The notification is sent in the background: beeep may hang for seconds
+// looking for a notification daemon and must never stall file processing.
+func alert(message string) {
+	slog.Error(message)
+	if !desktopNotifications {
+		return
+	}
+
+	pendingAlerts.Add(1)
+	go func() {
+		defer pendingAlerts.Done()
+		err := beeep.Alert("Error", message, "error")
+		if err != nil {
+			slog.Warn("Failed to show desktop notification", "error", err)
+		}
+	}()
+}
+
+// flushAlerts gives notifications and webhooks still being sent a moment to
+// finish before the process exits.
+func flushAlerts() {
+	done := make(chan struct{})
+	go func() {
+		pendingAlerts.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(notifyTimeout):
+		slog.Warn("Notifications did not finish in time")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"gopkg.in/ini.v1"
+)
+
+// PartFileRecovery values.
+const (
+	partRecoveryOff       = "off"
+	partRecoveryDelete    = "delete"
+	partRecoveryReconcile = "reconcile"
+
+	// partRecoveryPromote is what reconcile decides for a complete
+	// temporary, it is not a setting value
+	partRecoveryPromote = "promote"
+)
+
+// loadPartRecovery reads PartFileRecovery and PartFileMinAge from [server].
+func loadPartRecovery(section *ini.Section, config *Config) error {
+	var err error
+	config.PartFileRecovery, err = oneOf(section.Key("PartFileRecovery"), partRecoveryOff, partRecoveryDelete, partRecoveryReconcile)
+	if err != nil {
+		return err
+	}
+	config.PartFileMinAge = section.Key("PartFileMinAge").MustDuration(10 * time.Minute)
+	if config.PartFileMinAge < 0 {
+		return fmt.Errorf("PartFileMinAge must not be negative, got %s", config.PartFileMinAge)
+	}
+	return nil
+}
+
+// recoverPartFiles looks for temporaries a crashed run left behind: files
+// and folders ending in .part directly in the DestinationFolder of every
+// watch folder and in the run folder. Temporaries newer than PartFileMinAge
+// may belong to an upload in progress and are left alone. Failures are
+// logged, they never stop the start.
+func recoverPartFiles(sftpClient *sftp.Client, config *Config) {
+	if config.PartFileRecovery == partRecoveryOff {
+		return
+	}
+	folders := watchFolders(config)
+	if len(folders) == 0 {
+		folders = []*Config{config}
+	}
+	seen := map[string]bool{}
+	for _, folder := range folders {
+		if !seen[folder.destionationFolder] {
+			seen[folder.destionationFolder] = true
+			recoverDestinationPartFiles(sftpClient, folder)
+		}
+	}
+}
+
+func recoverDestinationPartFiles(sftpClient *sftp.Client, config *Config) {
+	folders := []string{config.destionationFolder}
+	if run := currentRunFolder(config); run != "" {
+		folders = append(folders, config.destionationFolder+run)
+	}
+
+	for _, folder := range folders {
+		dir := strings.TrimSuffix(folder, "/")
+		if dir == "" {
+			dir = "."
+		}
+		entries, err := sftpClient.ReadDir(dir)
+		if err != nil {
+			slog.Warn("Failed to list remote folder for leftover temporaries", "folder", dir, "error", err)
+			continue
+		}
+		for _, entry := range entries {
+			if !strings.HasSuffix(entry.Name(), remoteTempSuffix) || time.Since(entry.ModTime()) < config.PartFileMinAge {
+				continue
+			}
+			recoverPartFile(sftpClient, path.Join(dir, entry.Name()), entry, config)
+		}
+	}
+}
+
+// recoverPartFile deletes or promotes one leftover temporary. With
+// reconcile the local side decides: a source still waiting in the watch
+// folder is uploaded again, so the temporary goes. A source that was
+// archived has a complete upload if the sizes match, so the temporary is
+// renamed to its final name. Encrypted temporaries can't be compared
+// with their source and are only deleted, never promoted. Folders of directory and group uploads are
+// never promoted, as their completeness can't be checked.
+func recoverPartFile(sftpClient *sftp.Client, tempPath string, info os.FileInfo, config *Config) {
+	finalPath := strings.TrimSuffix(tempPath, remoteTempSuffix)
+	name := path.Base(finalPath)
+
+	action := partRecoveryDelete
+	if config.PartFileRecovery == partRecoveryReconcile {
+		action = reconcilePartFile(sftpClient, finalPath, name, info, config)
+	}
+
+	var err error
+	switch action {
+	case partRecoveryDelete:
+		if info.IsDir() {
+			err = sftpClient.RemoveAll(tempPath)
+		} else {
+			err = sftpClient.Remove(tempPath)
+		}
+		if err == nil {
+			slog.Info("Removed leftover remote temporary", "path", tempPath)
+		}
+	case partRecoveryPromote:
+		err = renameRemote(sftpClient, tempPath, finalPath)
+		if err == nil {
+			slog.Info("Promoted leftover remote temporary", "path", tempPath, "final", finalPath)
+		}
+	default:
+		slog.Warn("Leaving remote temporary in place, no local source to decide on", "path", tempPath)
+	}
+	if err != nil {
+		slog.Warn("Failed to recover remote temporary", "path", tempPath, "error", err)
+	}
+}
+
+// reconcilePartFile returns what to do with a leftover temporary: delete,
+// promote, or "" to leave it.
+func reconcilePartFile(sftpClient *sftp.Client, finalPath, name string, info os.FileInfo, config *Config) string {
+	if config.encryptTo != nil {
+		name = strings.TrimSuffix(name, encryptedSuffix)
+	}
+	if config.FolderToWatch != "" {
+		if _, err := os.Lstat(filepath.Join(config.FolderToWatch, name)); err == nil {
+			return partRecoveryDelete
+		}
+	}
+	if _, err := sftpClient.Stat(finalPath); err == nil {
+		return partRecoveryDelete
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return ""
+	}
+	if info.IsDir() || config.encryptTo != nil || config.processedFolder == "" {
+		return ""
+	}
+	archived, err := os.Stat(filepath.Join(config.processedFolder, name))
+	if err == nil && archived.Mode().IsRegular() && archived.Size() == info.Size() {
+		return partRecoveryPromote
+	}
+	return ""
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// What happens to a local file once it has been uploaded.
+const (
+	postUploadMove   = "move"
+	postUploadDelete = "delete"
+)
+
+// loadPostUploadActions reads the [postupload] section, e.g.
+//
+//	[postupload]
+//	default = move
+//	csv = move
+//	zip = delete
+func loadPostUploadActions(section *ini.Section, config *Config) error {
+	config.PostUploadActions = map[string]string{}
+	config.DefaultPostUploadAction = postUploadMove
+
+	for _, key := range section.Keys() {
+		action, err := oneOf(key, postUploadMove, postUploadDelete)
+		if err != nil {
+			return err
+		}
+		if strings.EqualFold(key.Name(), "default") {
+			config.DefaultPostUploadAction = action
+			continue
+		}
+		config.PostUploadActions[normalizeExtension(key.Name())] = action
+	}
+	return nil
+}
+
+// postUploadAction returns the action configured for the extension of path.
+// Files ArchiveFilter doesn't keep are deleted.
+func postUploadAction(path string, config *Config) string {
+	if !keptAfterUpload(path, config) {
+		return postUploadDelete
+	}
+	if action, ok := config.PostUploadActions[normalizeExtension(filepath.Ext(path))]; ok {
+		return action
+	}
+	return config.DefaultPostUploadAction
+}
+
+// normalizeExtension turns "CSV", "csv" and ".csv" into ".csv".
+func normalizeExtension(ext string) string {
+	ext = strings.ToLower(strings.TrimSpace(ext))
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// deleteUploadedFile removes a source file whose post-upload action is delete.
+func deleteUploadedFile(path string) error {
+	err := removeSourceFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to delete uploaded file: %w", err)
+	}
+	slog.Info("Deleted uploaded file", "file", path)
+	return nil
+}
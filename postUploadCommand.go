@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// runPostUploadCommand runs PostUploadCommand for a delivered file. The
+// command is split into arguments before the placeholders {file}, {remote}
+// and {checksum} are replaced, so file names never need quoting. Failures
+// are reported but do not undo the upload.
+func runPostUploadCommand(localPath, remotePath string, checksum []byte, config *Config) {
+	args := strings.Fields(config.PostUploadCommand)
+	values := map[string]string{
+		"file":     localPath,
+		"remote":   remotePath,
+		"checksum": hex.EncodeToString(checksum),
+	}
+	for i, arg := range args {
+		args[i] = expandTemplate(arg, values)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.PostUploadCommandTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s", config.PostUploadCommandTimeout)
+	}
+	if err != nil {
+		message := fmt.Sprintf("Post-upload command failed for %s: %v", localPath, err)
+		if config.AlertOnPostUploadCommandFailure {
+			alert(message)
+		}
+		slog.Error("Post-upload command failed", "file", localPath, "command", args[0], "error", err, "output", string(output))
+		return
+	}
+	slog.Info("Post-upload command finished", "file", localPath, "command", args[0], "output", strings.TrimSpace(string(output)))
+}
+
+// runPostUploadRemoteCommand runs PostUploadRemoteCommand on the server over
+// an SSH exec session. {remote} is replaced by the shell quoted remote path.
+// Failures are logged, the upload stands.
+func runPostUploadRemoteCommand(sshClient *ssh.Client, remotePath string, config *Config) {
+	command := expandTemplate(config.PostUploadRemoteCommand, map[string]string{"remote": shellQuote(remotePath)})
+
+	session, err := sshClient.NewSession()
+	if err != nil {
+		slog.Error("Failed to open SSH session for remote command", "path", remotePath, "error", err)
+		return
+	}
+	defer session.Close()
+
+	type result struct {
+		output []byte
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		output, err := session.CombinedOutput(command)
+		done <- result{output, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			slog.Error("Remote command failed", "path", remotePath, "command", command, "error", r.err, "output", string(r.output))
+			return
+		}
+		slog.Info("Remote command finished", "path", remotePath, "output", strings.TrimSpace(string(r.output)))
+	case <-time.After(config.PostUploadCommandTimeout):
+		session.Signal(ssh.SIGKILL)
+		slog.Error("Remote command timed out", "path", remotePath, "command", command, "timeout", config.PostUploadCommandTimeout)
+	}
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
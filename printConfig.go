@@ -0,0 +1,197 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// exampleConfig is the documented example configuration. --print-defaults
+// takes the descriptions of the settings from it.
+//
+//go:embed example.config.ini
+var exampleConfig string
+
+// printEffectiveConfig loads config.ini from the working directory and
+// prints every setting the loader read, with the defaults of unset keys
+// filled in, in ini format. Secrets are redacted.
+func printEffectiveConfig(w io.Writer) int {
+	workDir, err := os.Getwd()
+	if err != nil {
+		slog.Error("Failed to get working directory", "error", err)
+		return exitRuntimeError
+	}
+	filename := filepath.Join(workDir, "config.ini")
+	cfg, files, err := loadIniFiles(filename)
+	if err == nil {
+		_, err = configFromIni(cfg, filename, files)
+	}
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		return exitConfigError
+	}
+
+	for _, section := range cfg.Sections() {
+		for _, key := range section.Keys() {
+			key.SetValue(redactSetting(key.Name(), key.Value()))
+		}
+	}
+	fmt.Fprintf(w, "; effective configuration of %s\n", strings.Join(files, ", "))
+	_, err = cfg.WriteTo(w)
+	if err != nil {
+		return exitRuntimeError
+	}
+	return exitOK
+}
+
+// redactSetting hides passwords and passphrases, and the user info and
+// query values of URLs, which may carry tokens. Values listing several URLs,
+// like the NATS servers, are redacted URL by URL.
+func redactSetting(name, value string) string {
+	if value == "" {
+		return value
+	}
+	lower := strings.ToLower(name)
+	if strings.Contains(lower, "password") || strings.Contains(lower, "passphrase") || strings.Contains(lower, "connectionstring") {
+		return "REDACTED"
+	}
+	if !strings.Contains(value, "://") {
+		return value
+	}
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		parts[i] = redactURL(part)
+	}
+	return strings.Join(parts, ",")
+}
+
+func redactURL(value string) string {
+	u, err := url.Parse(strings.TrimSpace(value))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return value
+	}
+	if u.User != nil {
+		u.User = url.User("REDACTED")
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			query[key] = []string{"REDACTED"}
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// settingDoc is the description of a setting in the example configuration.
+type settingDoc struct {
+	section     string
+	key         string
+	description []string
+	example     string
+}
+
+var (
+	exampleSectionLine = regexp.MustCompile(`^\[(\w+)\]$`)
+	exampleKeyLine     = regexp.MustCompile(`^#?([A-Za-z][A-Za-z0-9]*) *=(.*)$`)
+)
+
+// printDefaultConfig prints a template with every setting, commented out,
+// with its default and description. The settings and their defaults come
+// from running the loader on an empty configuration, which writes each
+// default it applies back into the ini data. Settings the loader only reads
+// when a feature is on show the value of the example configuration.
+func printDefaultConfig(w io.Writer) int {
+	// FolderToWatch is the only setting without a usable default
+	placeholder := ini.Empty()
+	placeholder.Section("paths").Key("FolderToWatch").SetValue(os.TempDir())
+	_, err := configFromIni(placeholder, "", nil)
+	if err != nil {
+		slog.Error("Failed to determine the defaults", "error", err)
+		return exitRuntimeError
+	}
+
+	docs := parseExampleConfig(exampleConfig)
+	documented := map[string]bool{}
+	var sections []string
+	for _, doc := range docs {
+		if !documented[doc.section] {
+			sections = append(sections, doc.section)
+		}
+		documented[doc.section] = true
+		documented[doc.section+"."+doc.key] = true
+	}
+	for _, section := range placeholder.Sections() {
+		if !documented[section.Name()] && len(section.Keys()) > 0 {
+			sections = append(sections, section.Name())
+			documented[section.Name()] = true
+		}
+	}
+
+	for _, name := range sections {
+		if name != ini.DefaultSection {
+			fmt.Fprintf(w, "[%s]\n", name)
+		}
+		for _, doc := range docs {
+			if doc.section != name {
+				continue
+			}
+			value := doc.example
+			if placeholder.Section(name).HasKey(doc.key) {
+				value = placeholder.Section(name).Key(doc.key).Value()
+			}
+			if doc.key == "FolderToWatch" && name == "paths" {
+				value = doc.example
+			}
+			writeSetting(w, doc.key, value, doc.description)
+		}
+		for _, key := range placeholder.Section(name).Keys() {
+			if !documented[name+"."+key.Name()] {
+				writeSetting(w, key.Name(), key.Value(), nil)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	return exitOK
+}
+
+func writeSetting(w io.Writer, key, value string, description []string) {
+	for _, line := range description {
+		fmt.Fprintf(w, "# %s\n", line)
+	}
+	fmt.Fprintf(w, "#%s = %s\n", key, value)
+}
+
+// parseExampleConfig returns the settings of the example configuration in
+// their order, each with the comment lines right above it. Of settings
+// listed right below each other only the first carries the shared comment.
+func parseExampleConfig(text string) []settingDoc {
+	var docs []settingDoc
+	section := ini.DefaultSection
+	var comment []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r ")
+		switch {
+		case line == "":
+			comment = nil
+		case exampleSectionLine.MatchString(line):
+			section = exampleSectionLine.FindStringSubmatch(line)[1]
+			comment = nil
+		case exampleKeyLine.MatchString(line):
+			m := exampleKeyLine.FindStringSubmatch(line)
+			docs = append(docs, settingDoc{section: section, key: m[1], description: comment, example: strings.TrimSpace(m[2])})
+			comment = nil
+		case strings.HasPrefix(line, "#"):
+			comment = append(comment, strings.TrimSpace(strings.TrimPrefix(line, "#")))
+		}
+	}
+	return docs
+}
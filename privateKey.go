@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"log/slog"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/youmark/pkcs8"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/ini.v1"
+)
+
+// errWrongPassphrase is returned for an encrypted key that PrivateKeyPassphrase
+// does not open.
+var errWrongPassphrase = errors.New("wrong PrivateKeyPassphrase")
+
+// loadPassphrase reads the passphrase of the private key, either as
+// PrivateKeyPassphrase or from the environment variable named by
+// PrivateKeyPassphraseEnv, so it doesn't have to be stored in the file.
+func loadPassphrase(section *ini.Section, config *Config) error {
+	config.PrivateKeyPassphrase = section.Key("PrivateKeyPassphrase").String()
+	variable := section.Key("PrivateKeyPassphraseEnv").String()
+	if variable == "" {
+		return nil
+	}
+	if config.PrivateKeyPassphrase != "" {
+		return fmt.Errorf("set either PrivateKeyPassphrase or PrivateKeyPassphraseEnv, not both")
+	}
+	passphrase, ok := os.LookupEnv(variable)
+	if !ok {
+		return fmt.Errorf("PrivateKeyPassphraseEnv names environment variable %s, which is not set", variable)
+	}
+	config.PrivateKeyPassphrase = passphrase
+	return nil
+}
+
+// loadPrivateKey reads PrivateKeyPath and returns a signer for it. Besides
+// the formats ssh.ParsePrivateKey understands (OpenSSH, PEM, unencrypted
+// PKCS#8) it reads encrypted PKCS#8 and PuTTY .ppk files. Errors name the
+// detected format.
+func loadPrivateKey(config *Config) (ssh.Signer, error) {
+	data, err := os.ReadFile(config.PrivateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key %s: %w", config.PrivateKeyPath, err)
+	}
+	passphrase := []byte(config.PrivateKeyPassphrase)
+
+	if bytes.HasPrefix(data, []byte("PuTTY-User-Key-File-")) {
+		if len(passphrase) == 0 && !bytes.Contains(data, []byte("\nEncryption: none")) {
+			return nil, fmt.Errorf("private key %s is encrypted, set PrivateKeyPassphrase", config.PrivateKeyPath)
+		}
+		signer, err := parsePuttyKey(data, passphrase)
+		if err != nil {
+			return nil, privateKeyError(config, "PuTTY ", err)
+		}
+		return signer, nil
+	}
+
+	if block, _ := pem.Decode(data); block != nil && block.Type == "ENCRYPTED PRIVATE KEY" {
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("private key %s is encrypted, set PrivateKeyPassphrase", config.PrivateKeyPath)
+		}
+		key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, passphrase)
+		if err != nil && strings.Contains(err.Error(), "incorrect password") {
+			err = errWrongPassphrase
+		}
+		if err != nil {
+			return nil, privateKeyError(config, "encrypted PKCS#8 ", err)
+		}
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			return nil, privateKeyError(config, "encrypted PKCS#8 ", err)
+		}
+		return signer, nil
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("private key %s is encrypted, set PrivateKeyPassphrase", config.PrivateKeyPath)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(data, passphrase)
+		if errors.Is(err, x509.IncorrectPasswordError) {
+			err = errWrongPassphrase
+		}
+	}
+	if err != nil {
+		return nil, privateKeyError(config, "", err)
+	}
+	return signer, nil
+}
+
+// privateKeyError describes why the key of the given format could not be
+// read. A wrong passphrase gets its own message, as it is fixed in the
+// configuration rather than in the key file.
+func privateKeyError(config *Config, format string, err error) error {
+	if errors.Is(err, errWrongPassphrase) {
+		return fmt.Errorf("private key %s: %w, check the passphrase of the key", config.PrivateKeyPath, err)
+	}
+	return fmt.Errorf("failed to parse %sprivate key: %w", format, err)
+}
+
+// certExpiryWarning is how close to its expiry a certificate gets a warning.
+const certExpiryWarning = time.Hour
+
+// loadCertSigner pairs signer with the OpenSSH user certificate in
+// PrivateKeyCertPath, so the certificate is presented during authentication.
+// Certificates for another key, host certificates and certificates outside
+// their validity period are rejected.
+func loadCertSigner(signer ssh.Signer, config *Config) (ssh.Signer, error) {
+	data, err := os.ReadFile(config.PrivateKeyCertPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate %s: %w", config.PrivateKeyCertPath, err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate %s: %w", config.PrivateKeyCertPath, err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is a public key, not a certificate", config.PrivateKeyCertPath)
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("%s is a host certificate, a user certificate is needed", config.PrivateKeyCertPath)
+	}
+
+	now := time.Now()
+	validAfter := time.Unix(int64(cert.ValidAfter), 0)
+	if now.Before(validAfter) {
+		return nil, fmt.Errorf("certificate %s is not valid before %s", config.PrivateKeyCertPath, validAfter.Format(time.RFC3339))
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		validBefore := time.Unix(int64(cert.ValidBefore), 0)
+		if !now.Before(validBefore) {
+			return nil, fmt.Errorf("certificate %s expired at %s", config.PrivateKeyCertPath, validBefore.Format(time.RFC3339))
+		}
+		if validBefore.Sub(now) < certExpiryWarning {
+			slog.Warn("Certificate expires soon", "certificate", config.PrivateKeyCertPath, "expires", validBefore.Format(time.RFC3339))
+		}
+	}
+
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("certificate %s does not belong to the private key: %w", config.PrivateKeyCertPath, err)
+	}
+	slog.Debug("Using certificate", "certificate", config.PrivateKeyCertPath, "keyId", cert.KeyId, "principals", cert.ValidPrincipals)
+	return certSigner, nil
+}
+
+// puttyKey is the content of a .ppk file.
+type puttyKey struct {
+	version    int
+	algorithm  string
+	encryption string
+	comment    string
+	public     []byte
+	private    []byte
+	mac        []byte
+	headers    map[string]string
+}
+
+// parsePuttyKey reads PuTTY key files of version 2 and 3, unencrypted or
+// encrypted with aes256-cbc.
+func parsePuttyKey(data, passphrase []byte) (ssh.Signer, error) {
+	key, err := readPuttyKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var cipherKey, iv, macKey []byte
+	var newMAC func() hash.Hash
+	switch key.version {
+	case 2:
+		newMAC = sha1.New
+		if key.encryption != "none" {
+			cipherKey = append(puttyV2Hash(0, passphrase), puttyV2Hash(1, passphrase)...)[:32]
+			iv = make([]byte, aes.BlockSize)
+		}
+		mk := sha1.Sum(append([]byte("putty-private-key-file-mac-key"), passphrase...))
+		macKey = mk[:]
+	case 3:
+		newMAC = sha256.New
+		if key.encryption != "none" {
+			derived, err := puttyV3Derive(key, passphrase)
+			if err != nil {
+				return nil, err
+			}
+			cipherKey, iv, macKey = derived[:32], derived[32:48], derived[48:]
+		}
+	default:
+		return nil, fmt.Errorf("unsupported .ppk version %d", key.version)
+	}
+
+	private := key.private
+	switch key.encryption {
+	case "none":
+	case "aes256-cbc":
+		if len(private)%aes.BlockSize != 0 {
+			return nil, fmt.Errorf("encrypted private key has an invalid length")
+		}
+		block, err := aes.NewCipher(cipherKey)
+		if err != nil {
+			return nil, err
+		}
+		private = make([]byte, len(key.private))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(private, key.private)
+	default:
+		return nil, fmt.Errorf("unsupported .ppk encryption %q", key.encryption)
+	}
+
+	mac := hmac.New(newMAC, macKey)
+	for _, field := range [][]byte{[]byte(key.algorithm), []byte(key.encryption), []byte(key.comment), key.public, private} {
+		mac.Write(appendSftpString(nil, string(field)))
+	}
+	if !hmac.Equal(mac.Sum(nil), key.mac) {
+		if key.encryption != "none" {
+			return nil, fmt.Errorf("%w or corrupted key file", errWrongPassphrase)
+		}
+		return nil, fmt.Errorf("key file is corrupted (MAC mismatch)")
+	}
+
+	signer, err := puttySigner(key.algorithm, key.public, private)
+	if err != nil {
+		return nil, fmt.Errorf("%s key: %w", key.algorithm, err)
+	}
+	return signer, nil
+}
+
+func readPuttyKey(data []byte) (*puttyKey, error) {
+	key := &puttyKey{headers: map[string]string{}}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	readBlob := func(count string) ([]byte, error) {
+		lines, err := strconv.Atoi(count)
+		if err != nil {
+			return nil, fmt.Errorf("invalid line count %q", count)
+		}
+		var encoded strings.Builder
+		for i := 0; i < lines && scanner.Scan(); i++ {
+			encoded.WriteString(strings.TrimSpace(scanner.Text()))
+		}
+		return base64.StdEncoding.DecodeString(encoded.String())
+	}
+
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		var err error
+		switch {
+		case strings.HasPrefix(name, "PuTTY-User-Key-File-"):
+			key.version, err = strconv.Atoi(strings.TrimPrefix(name, "PuTTY-User-Key-File-"))
+			key.algorithm = value
+		case name == "Encryption":
+			key.encryption = value
+		case name == "Comment":
+			key.comment = value
+		case name == "Public-Lines":
+			key.public, err = readBlob(value)
+		case name == "Private-Lines":
+			key.private, err = readBlob(value)
+		case name == "Private-MAC":
+			key.mac, err = hex.DecodeString(value)
+		default:
+			key.headers[name] = value
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	if key.public == nil || key.private == nil || key.mac == nil {
+		return nil, fmt.Errorf("incomplete key file")
+	}
+	return key, scanner.Err()
+}
+
+// puttyV2Hash derives the version 2 cipher key: SHA-1 of a counter and the
+// passphrase.
+func puttyV2Hash(counter uint32, passphrase []byte) []byte {
+	h := sha1.New()
+	binary.Write(h, binary.BigEndian, counter)
+	h.Write(passphrase)
+	return h.Sum(nil)
+}
+
+// puttyV3Derive derives the 80 bytes of cipher key, IV and MAC key of a
+// version 3 key with the Argon2 variant and parameters from its headers.
+func puttyV3Derive(key *puttyKey, passphrase []byte) ([]byte, error) {
+	memory, err1 := strconv.ParseUint(key.headers["Argon2-Memory"], 10, 32)
+	passes, err2 := strconv.ParseUint(key.headers["Argon2-Passes"], 10, 32)
+	parallelism, err3 := strconv.ParseUint(key.headers["Argon2-Parallelism"], 10, 8)
+	salt, err4 := hex.DecodeString(key.headers["Argon2-Salt"])
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		return nil, fmt.Errorf("invalid Argon2 parameters: %w", err)
+	}
+
+	switch key.headers["Key-Derivation"] {
+	case "Argon2id":
+		return argon2.IDKey(passphrase, salt, uint32(passes), uint32(memory), uint8(parallelism), 80), nil
+	case "Argon2i":
+		return argon2.Key(passphrase, salt, uint32(passes), uint32(memory), uint8(parallelism), 80), nil
+	default:
+		return nil, fmt.Errorf("unsupported key derivation %q, re-save the key with Argon2id", key.headers["Key-Derivation"])
+	}
+}
+
+// puttySigner builds a signer from the public and private blobs of a .ppk.
+func puttySigner(algorithm string, public, private []byte) (ssh.Signer, error) {
+	pub := &blobReader{data: public}
+	priv := &blobReader{data: private}
+	pub.string() // the algorithm again
+
+	var key any
+	switch {
+	case algorithm == ssh.KeyAlgoRSA:
+		e, n := pub.mpint(), pub.mpint()
+		d, p, q := priv.mpint(), priv.mpint(), priv.mpint()
+		if pub.err == nil && priv.err == nil {
+			rsaKey := &rsa.PrivateKey{
+				PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+				D:         d,
+				Primes:    []*big.Int{p, q},
+			}
+			rsaKey.Precompute()
+			key = rsaKey
+		}
+	case algorithm == ssh.KeyAlgoED25519:
+		seed := priv.string()
+		if priv.err == nil && len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid key length")
+		}
+		if priv.err == nil {
+			key = ed25519.NewKeyFromSeed(seed)
+		}
+	case strings.HasPrefix(algorithm, "ecdsa-sha2-"):
+		var curve elliptic.Curve
+		switch string(pub.string()) {
+		case "nistp256":
+			curve = elliptic.P256()
+		case "nistp384":
+			curve = elliptic.P384()
+		case "nistp521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve")
+		}
+		point := pub.string()
+		d := priv.mpint()
+		if pub.err == nil && priv.err == nil {
+			x, y := elliptic.Unmarshal(curve, point)
+			if x == nil {
+				return nil, fmt.Errorf("invalid public key")
+			}
+			key = &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y}, D: d}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type")
+	}
+	if err := errors.Join(pub.err, priv.err); err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+// blobReader reads SSH wire format fields, remembering the first error.
+type blobReader struct {
+	data []byte
+	err  error
+}
+
+func (r *blobReader) string() []byte {
+	if r.err != nil {
+		return nil
+	}
+	field, rest, ok := readSftpString(r.data)
+	if !ok {
+		r.err = fmt.Errorf("key data is truncated")
+		return nil
+	}
+	r.data = rest
+	return []byte(field)
+}
+
+func (r *blobReader) mpint() *big.Int {
+	return new(big.Int).SetBytes(r.string())
+}
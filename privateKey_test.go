@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/youmark/pkcs8"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestLoadEncryptedPKCS8Key(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := pkcs8.MarshalPrivateKey(key, []byte("secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	writeFile(t, path, string(pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der})))
+
+	signer, err := loadPrivateKey(&Config{PrivateKeyPath: path, PrivateKeyPassphrase: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(signer.PublicKey().Marshal(), public.Marshal()) {
+		t.Error("the signer does not belong to the key")
+	}
+
+	_, err = loadPrivateKey(&Config{PrivateKeyPath: path, PrivateKeyPassphrase: "wrong"})
+	if err == nil || !strings.Contains(err.Error(), "check the passphrase") {
+		t.Errorf("wrong passphrase: got %v", err)
+	}
+	_, err = loadPrivateKey(&Config{PrivateKeyPath: path})
+	if err == nil || !strings.Contains(err.Error(), "set PrivateKeyPassphrase") {
+		t.Errorf("no passphrase: got %v", err)
+	}
+}
+
+// TestLoadPuttyKey reads keys made by puttygen, see testdata/ppk/README.
+// Each signer must sign for the public key stored in its file.
+func TestLoadPuttyKey(t *testing.T) {
+	tests := []struct {
+		file       string
+		passphrase string
+	}{
+		{"v2-rsa-none.ppk", ""},
+		{"v2-rsa-aes.ppk", "testkey"},
+		{"v2-ecdsa-nistp256-aes.ppk", "testkey"},
+		{"v2-ecdsa-nistp384-aes.ppk", "testkey"},
+		{"v2-ecdsa-nistp521-aes.ppk", "testkey"},
+		{"v2-ed25519-aes.ppk", "testkey"},
+		{"v3-rsa-none.ppk", ""},
+		{"v3-rsa-argon2id.ppk", "testkey"},
+	}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			path := filepath.Join("testdata", "ppk", test.file)
+			signer, err := loadPrivateKey(&Config{PrivateKeyPath: path, PrivateKeyPassphrase: test.passphrase})
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := readPuttyKey(readTestFile(t, path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			public, err := ssh.ParsePublicKey(key.public)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(signer.PublicKey().Marshal(), public.Marshal()) {
+				t.Error("the signer has another public key than the file")
+			}
+			signature, err := signer.Sign(rand.Reader, []byte("session"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := public.Verify([]byte("session"), signature); err != nil {
+				t.Errorf("signature does not verify with the public key: %v", err)
+			}
+
+			if test.passphrase == "" {
+				return
+			}
+			_, err = loadPrivateKey(&Config{PrivateKeyPath: path, PrivateKeyPassphrase: "wrong"})
+			if !errors.Is(err, errWrongPassphrase) {
+				t.Errorf("wrong passphrase: got %v", err)
+			}
+			_, err = loadPrivateKey(&Config{PrivateKeyPath: path})
+			if err == nil || !strings.Contains(err.Error(), "set PrivateKeyPassphrase") {
+				t.Errorf("no passphrase: got %v", err)
+			}
+		})
+	}
+}
+
+// TestPuttyEd25519Seed checks the decrypted private key against the seed
+// kayrus/putty expects for the file, ed25519 signatures being deterministic.
+func TestPuttyEd25519Seed(t *testing.T) {
+	seed, _ := hex.DecodeString("00d8f775ba68aaf3a4a6a300defd4984aafd87090d2229e00f87a05fd73adaaf")
+	signer, err := parsePuttyKey(readTestFile(t, filepath.Join("testdata", "ppk", "v2-ed25519-aes.ppk")), []byte("testkey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := signer.Sign(rand.Reader, []byte("session"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ed25519.Sign(ed25519.NewKeyFromSeed(seed), []byte("session"))
+	if !bytes.Equal(signature.Blob, want) {
+		t.Error("the signature differs from the one of the expected seed")
+	}
+}
+
+func TestPuttyKeyCorrupted(t *testing.T) {
+	data := readTestFile(t, filepath.Join("testdata", "ppk", "v3-rsa-none.ppk"))
+	data = bytes.Replace(data, []byte("Comment: a@b"), []byte("Comment: a@c"), 1)
+	_, err := parsePuttyKey(data, nil)
+	if err == nil || !strings.Contains(err.Error(), "MAC mismatch") {
+		t.Errorf("changed comment: got %v, want a MAC mismatch", err)
+	}
+}
+
+func readTestFile(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
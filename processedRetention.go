@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// loadProcessedRetention reads the limits for the processed folder from
+// [paths].
+func loadProcessedRetention(section *ini.Section, config *Config) error {
+	config.ProcessedRetentionDays = section.Key("ProcessedRetentionDays").MustInt(0)
+	config.ProcessedMaxFiles = section.Key("ProcessedMaxFiles").MustInt(0)
+	config.ProcessedRetentionDryRun = section.Key("ProcessedRetentionDryRun").MustBool(false)
+	config.ProcessedRetentionInterval = time.Duration(section.Key("ProcessedRetentionIntervalMinutes").MustInt(60)) * time.Minute
+	if config.ProcessedRetentionDays < 0 || config.ProcessedMaxFiles < 0 {
+		return fmt.Errorf("ProcessedRetentionDays and ProcessedMaxFiles must not be negative")
+	}
+	if processedRetentionEnabled(config) && config.ProcessedRetentionInterval <= 0 {
+		return fmt.Errorf("ProcessedRetentionIntervalMinutes must be at least 1")
+	}
+	return nil
+}
+
+func processedRetentionEnabled(config *Config) bool {
+	return config.ProcessedRetentionDays > 0 || config.ProcessedMaxFiles > 0
+}
+
+// runProcessedRetention periodically deletes the oldest files from the
+// processed folder, those older than ProcessedRetentionDays and those beyond
+// ProcessedMaxFiles. In dry-run mode it only logs what it would delete.
+func runProcessedRetention(config *Config) {
+	for {
+		for _, folder := range processedFolders(config) {
+			sweepProcessedFolder(folder)
+		}
+		time.Sleep(config.ProcessedRetentionInterval)
+	}
+}
+
+// sweepProcessedFolder only deletes files that are confirmed uploaded: files
+// still recorded as in flight in the state file and files that were archived
+// without an upload are kept, and don't count towards ProcessedMaxFiles.
+// Folders, like archived directory units, are left alone. With
+// WatchRecursive the files in the subfolders count as well.
+func sweepProcessedFolder(config *Config) {
+	type archived struct {
+		path    string
+		modTime time.Time
+	}
+	var files []archived
+	protected := 0
+	err := walkProcessedFolder(config, func(path string, entry os.DirEntry) {
+		if state.uploadPending(entry.Name()) || state.wasNotUploaded(path) {
+			protected++
+			return
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return
+		}
+		files = append(files, archived{path, info.ModTime()})
+	})
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Processed retention: failed to list processed folder", "folder", config.processedFolder, "error", err)
+		}
+		return
+	}
+	// newest first, everything past the limits goes
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+
+	cutoff := time.Now().AddDate(0, 0, -config.ProcessedRetentionDays)
+	removed := 0
+	for i, file := range files {
+		tooOld := config.ProcessedRetentionDays > 0 && file.modTime.Before(cutoff)
+		tooMany := config.ProcessedMaxFiles > 0 && i >= config.ProcessedMaxFiles
+		if !tooOld && !tooMany {
+			continue
+		}
+
+		if config.ProcessedRetentionDryRun {
+			slog.Info("Processed retention (dry run): would delete", "file", file.path, "modified", file.modTime)
+			continue
+		}
+		err := os.Remove(file.path)
+		if err != nil {
+			slog.Error("Processed retention: failed to delete", "file", file.path, "error", err)
+			continue
+		}
+		slog.Debug("Processed retention: deleted", "file", file.path, "modified", file.modTime)
+		removed++
+	}
+
+	err = state.forgetNotUploaded(func(path string) bool {
+		_, err := os.Stat(path)
+		return !os.IsNotExist(err)
+	})
+	if err != nil {
+		slog.Warn("Failed to update state file", "error", err)
+	}
+	if removed > 0 {
+		slog.Info("Processed retention sweep finished", "deleted", removed, "kept", len(files)-removed, "protected", protected)
+	}
+}
+
+// walkProcessedFolder calls fn for the regular files in the processed
+// folder, with WatchRecursive also for those in its subfolders.
+func walkProcessedFolder(config *Config, fn func(path string, entry os.DirEntry)) error {
+	if !config.WatchRecursive {
+		entries, err := os.ReadDir(config.processedFolder)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() {
+				fn(filepath.Join(config.processedFolder, entry.Name()), entry)
+			}
+		}
+		return nil
+	}
+	return filepath.WalkDir(config.processedFolder, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() {
+			fn(path, entry)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/proxy"
+	"gopkg.in/ini.v1"
+)
+
+// Values of the [proxy] Type setting.
+const (
+	proxyNone   = "none"
+	proxySOCKS5 = "socks5"
+	proxyHTTP   = "http"
+)
+
+// proxyDialTimeout bounds connecting through the proxy, including the
+// CONNECT/SOCKS handshake.
+const proxyDialTimeout = 30 * time.Second
+
+func loadProxy(section *ini.Section, config *Config) error {
+	var err error
+	config.ProxyType, err = oneOf(section.Key("Type"), proxyNone, proxySOCKS5, proxyHTTP)
+	if err != nil {
+		return err
+	}
+	config.ProxyAddress = section.Key("Address").String()
+	config.ProxyUser = section.Key("User").String()
+	config.ProxyPassword = section.Key("Password").String()
+	if config.ProxyType != proxyNone && config.ProxyAddress == "" {
+		return fmt.Errorf("proxy Type %s needs an Address", config.ProxyType)
+	}
+	return nil
+}
+
+// dialSSH opens the SSH connection to addr, through the configured proxy if
+// there is one. Host key checking is part of sshConfig either way.
+func dialSSH(addr string, sshConfig *ssh.ClientConfig, config *Config) (*ssh.Client, error) {
+	if config.ProxyType == proxyNone {
+		return ssh.Dial("tcp", addr, sshConfig)
+	}
+
+	conn, err := dialProxy(addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect through %s proxy %s: %w", config.ProxyType, config.ProxyAddress, err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+func dialProxy(addr string, config *Config) (net.Conn, error) {
+	if config.ProxyType == proxySOCKS5 {
+		var auth *proxy.Auth
+		if config.ProxyUser != "" {
+			auth = &proxy.Auth{User: config.ProxyUser, Password: config.ProxyPassword}
+		}
+		dialer, err := proxy.SOCKS5("tcp", config.ProxyAddress, auth, &net.Dialer{Timeout: proxyDialTimeout})
+		if err != nil {
+			return nil, err
+		}
+		return dialer.Dial("tcp", addr)
+	}
+	return dialHTTPConnect(addr, config)
+}
+
+// dialHTTPConnect opens a tunnel to addr with an HTTP CONNECT request.
+func dialHTTPConnect(addr string, config *Config) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", config.ProxyAddress, proxyDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(proxyDialTimeout))
+
+	request := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if config.ProxyUser != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(config.ProxyUser + ":" + config.ProxyPassword))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	_, err = io.WriteString(conn, request+"\r\n")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT: %s", response.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	// the server's SSH banner may already sit in the reader's buffer
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// bufferedConn reads through the bufio.Reader used for the proxy handshake.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
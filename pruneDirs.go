@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// pruneLock serializes pruning, so two finished files of the same folder
+// don't race for removing it.
+var pruneLock sync.Mutex
+
+// finishSourceFile completes a data file that left the watch folder: its
+// trigger file is handled and, with PruneEmptyDirs, the folders it leaves
+// empty are removed.
+func finishSourceFile(path string, config *Config) error {
+	err := finishTriggerFile(path, config)
+	if err != nil {
+		return err
+	}
+	pruneEmptyDirs(filepath.Dir(path), config)
+	return nil
+}
+
+// pruneEmptyDirs removes dir and its parents as long as they are empty
+// subfolders of FolderToWatch. The watch folder itself and the internal
+// folders are never removed. Emptiness is checked again right before each
+// removal, and os.Remove refuses a folder that got a new file in between, so
+// a file arriving meanwhile keeps its folder.
+func pruneEmptyDirs(dir string, config *Config) {
+	if !config.PruneEmptyDirs || config.FolderToWatch == "" {
+		return
+	}
+	pruneLock.Lock()
+	defer pruneLock.Unlock()
+
+	root := filepath.Clean(config.FolderToWatch) + string(filepath.Separator)
+	for dir = filepath.Clean(dir); strings.HasPrefix(dir, root) && !isInternalFolder(dir, config); dir = filepath.Dir(dir) {
+		empty, err := isEmptyDir(dir)
+		if err != nil || !empty {
+			return
+		}
+		err = os.Remove(dir)
+		if err != nil {
+			slog.Debug("Folder was not pruned", "dir", dir, "error", err)
+			return
+		}
+		slog.Info("Removed empty folder", "dir", dir)
+	}
+}
+
+func isEmptyDir(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	_, err = f.Readdirnames(1)
+	if errors.Is(err, io.EOF) {
+		return true, nil
+	}
+	return false, err
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// nextUploadSlot is when the next upload may start under MaxFilesPerMinute.
+// It is only used from the main goroutine.
+var nextUploadSlot time.Time
+
+// waitForUploadSlot blocks until another file may be uploaded. It is a token
+// bucket holding a single token, refilled every minute/MaxFilesPerMinute, so
+// bursts are spread evenly instead of hitting the server all at once. Files
+// arriving meanwhile queue up in the watcher.
+func waitForUploadSlot(config *Config) {
+	if config.MaxFilesPerMinute <= 0 {
+		return
+	}
+	interval := time.Minute / time.Duration(config.MaxFilesPerMinute)
+
+	now := time.Now()
+	if wait := nextUploadSlot.Sub(now); wait > 0 {
+		slog.Info("Rate limit reached, waiting before the next upload", "wait", wait.Round(time.Millisecond), "maxFilesPerMinute", config.MaxFilesPerMinute)
+		time.Sleep(wait)
+		now = nextUploadSlot
+	}
+	nextUploadSlot = now.Add(interval)
+}
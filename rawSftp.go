@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP packet types and status codes used by rawSftpChannel. pkg/sftp does not
+// expose a way to send arbitrary extended requests, so the few extensions we
+// need are spoken on a separate sftp subsystem channel of the same connection.
+const (
+	sshFxpInit          = 1
+	sshFxpVersion       = 2
+	sshFxpStatus        = 101
+	sshFxpExtended      = 200
+	sshFxpExtendedReply = 201
+
+	sshFxOk            = 0
+	sshFxOpUnsupported = 8
+
+	rawSftpMaxPacket = 256 * 1024
+)
+
+var errSftpUnsupported = errors.New("operation not supported by the SFTP server")
+
+// rawSftpChannel is a minimal SFTP v3 client on its own subsystem channel.
+type rawSftpChannel struct {
+	session *ssh.Session
+	in      io.WriteCloser
+	out     io.Reader
+	nextID  uint32
+}
+
+func openRawSftpChannel(sshClient *ssh.Client) (*rawSftpChannel, error) {
+	session, err := sshClient.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ssh session: %w", err)
+	}
+	in, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	out, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	err = session.RequestSubsystem("sftp")
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to start sftp subsystem: %w", err)
+	}
+
+	c := &rawSftpChannel{session: session, in: in, out: out}
+	err = c.send(sshFxpInit, binary.BigEndian.AppendUint32(nil, 3))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	typ, _, err := c.recv()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if typ != sshFxpVersion {
+		c.Close()
+		return nil, fmt.Errorf("unexpected sftp packet %d during init", typ)
+	}
+	return c, nil
+}
+
+func (c *rawSftpChannel) Close() error {
+	c.in.Close()
+	return c.session.Close()
+}
+
+func (c *rawSftpChannel) send(typ byte, payload []byte) error {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	packet = append(packet, typ)
+	packet = append(packet, payload...)
+	_, err := c.in.Write(packet)
+	return err
+}
+
+func (c *rawSftpChannel) recv() (byte, []byte, error) {
+	var header [5]byte
+	_, err := io.ReadFull(c.out, header[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > rawSftpMaxPacket {
+		return 0, nil, fmt.Errorf("invalid sftp packet length %d", length)
+	}
+	payload := make([]byte, length-1)
+	_, err = io.ReadFull(c.out, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	return header[4], payload, nil
+}
+
+// request sends a request carrying a fresh id and waits for its response. The
+// returned payload has the id already stripped. SSH_FXP_STATUS responses are
+// converted to errors (nil for SSH_FX_OK).
+func (c *rawSftpChannel) request(typ byte, body []byte) (byte, []byte, error) {
+	c.nextID++
+	id := c.nextID
+	err := c.send(typ, append(binary.BigEndian.AppendUint32(nil, id), body...))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	respType, payload, err := c.recv()
+	if err != nil {
+		return 0, nil, err
+	}
+	respID, payload, ok := readSftpUint32(payload)
+	if !ok || respID != id {
+		return 0, nil, fmt.Errorf("unexpected sftp response id")
+	}
+	if respType == sshFxpStatus {
+		code, rest, _ := readSftpUint32(payload)
+		switch code {
+		case sshFxOk:
+			return respType, nil, nil
+		case sshFxOpUnsupported:
+			return respType, nil, errSftpUnsupported
+		}
+		msg, _, _ := readSftpString(rest)
+		return respType, nil, fmt.Errorf("sftp status %d: %s", code, msg)
+	}
+	return respType, payload, nil
+}
+
+func appendSftpString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func readSftpUint32(b []byte) (uint32, []byte, bool) {
+	if len(b) < 4 {
+		return 0, b, false
+	}
+	return binary.BigEndian.Uint32(b), b[4:], true
+}
+
+func readSftpString(b []byte) (string, []byte, bool) {
+	n, rest, ok := readSftpUint32(b)
+	if !ok || uint32(len(rest)) < n {
+		return "", b, false
+	}
+	return string(rest[:n]), rest[n:], true
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/ini.v1"
+)
+
+// keepAliveRequest is the global request OpenSSH uses for keepalives. Servers
+// that don't know it still answer with a failure, which counts as alive.
+const keepAliveRequest = "keepalive@openssh.com"
+
+// loadKeepAlive reads KeepAliveSeconds from [server].
+func loadKeepAlive(section *ini.Section, config *Config) error {
+	seconds := section.Key("KeepAliveSeconds").MustInt(30)
+	if seconds < 0 {
+		return fmt.Errorf("KeepAliveSeconds must not be negative, got %d", seconds)
+	}
+	config.KeepAliveInterval = time.Duration(seconds) * time.Second
+	return nil
+}
+
+// keepAlive sends a keepalive request every KeepAliveInterval until the
+// connection closes. A server that doesn't answer within another interval
+// is taken as gone and the connection is closed, which ends its SFTP
+// sessions and so fails hanging uploads as a lost connection.
+func keepAlive(sshClient *ssh.Client, config *Config) {
+	if config.KeepAliveInterval <= 0 {
+		return
+	}
+	closed := make(chan struct{})
+	go func() {
+		sshClient.Wait()
+		close(closed)
+	}()
+	go func() {
+		ticker := time.NewTicker(config.KeepAliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-closed:
+				return
+			case <-ticker.C:
+			}
+			reply := make(chan error, 1)
+			go func() {
+				_, _, err := sshClient.SendRequest(keepAliveRequest, true, nil)
+				reply <- err
+			}()
+			select {
+			case err := <-reply:
+				if err != nil {
+					// the connection closed meanwhile
+					return
+				}
+			case <-time.After(config.KeepAliveInterval):
+				slog.Warn("Server did not answer the keepalive, closing the connection", "timeout", config.KeepAliveInterval)
+				sshClient.Close()
+				return
+			}
+		}
+	}()
+}
+
+// connectionLostError reports an upload that failed because the connection
+// to the server dropped. The file waits for the reconnect without using up
+// a retry.
+type connectionLostError struct {
+	path string
+	err  error
+}
+
+func (e *connectionLostError) Error() string {
+	return fmt.Sprintf("connection to the server lost while uploading %s: %v", e.path, e.err)
+}
+
+func (e *connectionLostError) Unwrap() error {
+	return e.err
+}
+
+// connectionDown is set from losing the connection until the server was
+// dialed again, reconnectFailures counts the failed dials meanwhile. Both
+// are only used from the main goroutine.
+var (
+	connectionDown    bool
+	reconnectFailures int
+)
+
+// isConnectionLost reports whether err means the SSH connection or the SFTP
+// session is gone. An answer of the server means it is still there. Other
+// errors may come from the transport, like a failed key exchange that
+// closed the connection, or from the source, e.g. an EOF of a truncated
+// archive member, so they only count when the session no longer answers a
+// request either.
+func isConnectionLost(err error, sftpClient *sftp.Client) bool {
+	if errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	var status *sftp.StatusError
+	if err == nil || errors.As(err, &status) {
+		return false
+	}
+	_, probeErr := sftpClient.Getwd()
+	return probeErr != nil
+}
+
+// pauseForLostConnection pauses uploads until the server was dialed again
+// and raises the alert once per outage. remotePath is empty when the loss
+// was noticed outside an upload.
+func pauseForLostConnection(remotePath string, err error) error {
+	if remotePath != "" {
+		err = &connectionLostError{path: remotePath, err: err}
+	}
+	if connectionDown {
+		return err
+	}
+	connectionDown = true
+	// the first dial follows right away, at the next check
+	pausedUntil = time.Now().Add(retryCheckInterval)
+	pauseReason = "the connection to the server was lost"
+	alert("Connection to the server lost, reconnecting: " + err.Error())
+	return err
+}
+
+// serverConnection holds the clients of the main connection. Once the
+// connection dropped, clients dials the server again when the pause of the
+// uploads ended, with the retry backoff between failed dials. Files keep
+// waiting in the watch folder meanwhile. It is only used from the main
+// goroutine.
+type serverConnection struct {
+	sftp   *sftp.Client
+	ssh    *ssh.Client
+	config *Config
+	// closed is closed when the SFTP session ends, nil while it is down
+	closed <-chan struct{}
+	// stopJobs ends the background jobs running on the connection
+	stopJobs chan struct{}
+}
+
+func newServerConnection(sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) *serverConnection {
+	conn := &serverConnection{config: config}
+	conn.use(sftpClient, sshClient)
+	return conn
+}
+
+// use makes the clients the current ones and watches for the end of their
+// session.
+func (c *serverConnection) use(sftpClient *sftp.Client, sshClient *ssh.Client) {
+	c.sftp, c.ssh = sftpClient, sshClient
+	if sftpClient == nil {
+		// cloud storage, nothing to watch
+		return
+	}
+	closed := make(chan struct{})
+	go func() {
+		sftpClient.Wait()
+		close(closed)
+	}()
+	c.closed = closed
+}
+
+// clients returns the clients for the next uploads, dialing the server
+// again when it is due. Until that succeeds the old clients are returned,
+// uploads wait for the pause before using them.
+func (c *serverConnection) clients() (*sftp.Client, *ssh.Client) {
+	if connectionDown && !time.Now().Before(pausedUntil) {
+		c.redial()
+	}
+	return c.sftp, c.ssh
+}
+
+// startBackgroundJobs starts remote retention and the self-test, each on
+// its own session of the current connection. A reconnect restarts them on
+// the new one.
+func (c *serverConnection) startBackgroundJobs() {
+	c.stopJobs = make(chan struct{})
+	if c.config.RemoteRetentionDays > 0 {
+		go runRemoteRetention(openSftpSession(c.ssh, c.sftp, "remote retention", c.config), c.config, c.stopJobs)
+	}
+	if c.config.SelfTestInterval > 0 {
+		go runSelfTest(openSftpSession(c.ssh, c.sftp, "self-test", c.config), c.config, c.stopJobs)
+	}
+}
+
+// dropped handles the end of the SFTP session.
+func (c *serverConnection) dropped() {
+	c.closed = nil
+	// the SSH connection may outlive a crashed SFTP server process
+	c.ssh.Close()
+	pauseForLostConnection("", errors.New("SFTP session closed"))
+}
+
+func (c *serverConnection) redial() {
+	sftpClient, sshClient, _, err := dialServer(c.config)
+	if err != nil {
+		reconnectFailures++
+		pause := max(retryBackoff(reconnectFailures, c.config), c.config.RetryDelay)
+		pausedUntil = time.Now().Add(pause)
+		slog.Warn("Failed to reconnect to the server, trying again", "in", pause.Round(time.Second), "attempt", reconnectFailures, "error", err)
+		return
+	}
+
+	close(c.stopJobs)
+	c.sftp.Close()
+	c.ssh.Close()
+	c.use(sftpClient, sshClient)
+	c.startBackgroundJobs()
+	slog.Info("Reconnected to the server, uploads resumed", "failedAttempts", reconnectFailures)
+	connectionDown, reconnectFailures = false, 0
+	pausedUntil = time.Time{}
+}
+
+// close stops the background jobs and closes the current clients.
+func (c *serverConnection) close() {
+	if c.stopJobs != nil {
+		close(c.stopJobs)
+	}
+	closeClients(c.sftp, c.ssh)
+}
+
+// closeClients closes the SFTP session and the SSH connection, which are
+// nil for cloud storage.
+func closeClients(sftpClient *sftp.Client, sshClient *ssh.Client) {
+	if sftpClient != nil {
+		sftpClient.Close()
+	}
+	if sshClient != nil {
+		sshClient.Close()
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/ini.v1"
+)
+
+// loadRecursive reads WatchRecursive from [general]. Subfolders are either
+// watched for files or uploaded as a whole, not both.
+func loadRecursive(section *ini.Section, config *Config) error {
+	config.WatchRecursive = section.Key("WatchRecursive").MustBool(false)
+	if config.WatchRecursive && config.WatchUnit == watchUnitDirectory {
+		return fmt.Errorf("WatchRecursive can't be combined with WatchUnit = directory")
+	}
+	return nil
+}
+
+// relativeToWatchFolder returns path relative to FolderToWatch in slash
+// form, for paths below it.
+func relativeToWatchFolder(path string, config *Config) (string, bool) {
+	if config.FolderToWatch == "" {
+		return "", false
+	}
+	rel, err := filepath.Rel(filepath.Clean(config.FolderToWatch), filepath.Clean(path))
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// processedDirFor returns the folder path is archived in: the processed
+// folder, with WatchRecursive the same subfolder below it as path has below
+// FolderToWatch, so files of the same name in different subfolders are kept
+// apart.
+func processedDirFor(path string, config *Config) string {
+	if !config.WatchRecursive {
+		return config.processedFolder
+	}
+	rel, ok := relativeToWatchFolder(filepath.Dir(path), config)
+	if !ok {
+		return config.processedFolder
+	}
+	return filepath.Join(config.processedFolder, filepath.FromSlash(rel))
+}
+
+// watchTree adds dir to the watcher, with WatchRecursive together with
+// every folder below it except the internal folders.
+func watchTree(watcher *fsnotify.Watcher, dir string, config *Config) error {
+	if !config.WatchRecursive {
+		return watcher.Add(dir)
+	}
+	return filepath.WalkDir(dir, func(p string, entry os.DirEntry, err error) error {
+		if err != nil {
+			// a subfolder removed while walking is no reason to fail
+			if os.IsNotExist(err) && p != dir {
+				return nil
+			}
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if isInternalFolder(p, config) {
+			return filepath.SkipDir
+		}
+		err = watcher.Add(p)
+		if err != nil {
+			return fmt.Errorf("failed to watch %s: %w", p, err)
+		}
+		return nil
+	})
+}
+
+// unwatchTree removes dir and every folder below it from the watcher.
+func unwatchTree(watcher *fsnotify.Watcher, dir string) error {
+	prefix := dir + string(filepath.Separator)
+	for _, watched := range watcher.WatchList() {
+		if watched != dir && strings.HasPrefix(watched, prefix) {
+			watcher.Remove(watched)
+		}
+	}
+	return watcher.Remove(dir)
+}
+
+// isNewSubfolder reports whether path is a folder below FolderToWatch that
+// has to be watched in WatchRecursive mode.
+func isNewSubfolder(path string, config *Config) bool {
+	if !config.WatchRecursive || isInternalFolder(path, config) {
+		return false
+	}
+	if _, ok := relativeToWatchFolder(path, config); !ok {
+		return false
+	}
+	info, err := os.Lstat(path)
+	return err == nil && info.IsDir()
+}
+
+// watchSubfolder starts watching a folder created below FolderToWatch. Its
+// entries may have been created before the watch was in place, so each is
+// handled as if it was just created, subfolders again through this.
+func watchSubfolder(watcher *fsnotify.Watcher, dir string, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) {
+	err := watcher.Add(dir)
+	if err != nil {
+		alert("Failed to watch subfolder: " + err.Error())
+		return
+	}
+	slog.Info("Watching new subfolder", "dir", dir)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Error("Failed to read subfolder", "dir", dir, "error", err)
+		return
+	}
+	for _, entry := range entries {
+		handleEvent(fsnotify.Event{Name: filepath.Join(dir, entry.Name()), Op: fsnotify.Create}, watcher, sftpClient, sshClient, config)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/pkg/sftp"
+	"gopkg.in/ini.v1"
+)
+
+// loadRekey reads RekeyThresholdMB and WarmUpConnection from [server].
+func loadRekey(section *ini.Section, config *Config) error {
+	megabytes := section.Key("RekeyThresholdMB").MustInt(0)
+	if megabytes < 0 {
+		return fmt.Errorf("RekeyThresholdMB must not be negative, got %d", megabytes)
+	}
+	config.RekeyThreshold = uint64(megabytes) << 20
+	config.WarmUpConnection = section.Key("WarmUpConnection").MustBool(false)
+	return nil
+}
+
+// warmUpConnection makes a first round trip over a new SFTP session, so a
+// server that accepts the login but can't serve requests is noticed while
+// connecting rather than with the first upload.
+func warmUpConnection(sftpClient *sftp.Client) error {
+	start := time.Now()
+	dir, err := sftpClient.Getwd()
+	if err != nil {
+		return fmt.Errorf("connection warm-up failed: %w", err)
+	}
+	slog.Info("Connection ready", "loginFolder", dir, "roundTrip", time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// testUpload writes size random bytes to a local file and uploads it as
+// remotePath.
+func testUpload(t *testing.T, size int, remotePath string, settings map[string]string) ([]byte, error) {
+	t.Helper()
+	content := make([]byte, size)
+	rand.Read(content)
+	path := filepath.Join(t.TempDir(), "upload.bin")
+	writeFile(t, path, string(content))
+
+	config := testConfig(t, t.TempDir(), settings)
+	sftpClient, sshClient, _, err := dialServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sftpClient.Close()
+		sshClient.Close()
+	})
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	_, err = copyFileToSftp(file, remotePath, sftpClient, sshClient, config)
+	return content, err
+}
+
+func TestUploadThroughRekeys(t *testing.T) {
+	quietLogs(t)
+	remote := t.TempDir()
+	settings := startSftpServer(t, remote, nil)
+	// a key exchange after every MB, 8 during the upload
+	settings["server.RekeyThresholdMB"] = "1"
+
+	content, err := testUpload(t, 8<<20, "upload.bin", settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaded, err := os.ReadFile(filepath.Join(remote, "upload.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(uploaded, content) {
+		t.Errorf("uploaded %d bytes that differ from the %d bytes sent", len(uploaded), len(content))
+	}
+}
+
+// garbledConn sends garbage to the client once the client sent more than
+// after bytes, like a key exchange that went wrong.
+type garbledConn struct {
+	net.Conn
+	after int64
+	read  atomic.Int64
+}
+
+func (c *garbledConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *garbledConn) Write(b []byte) (int, error) {
+	if c.read.Load() > c.after {
+		rand.Read(b)
+	}
+	return c.Conn.Write(b)
+}
+
+func TestFailedRekeyIsConnectionLost(t *testing.T) {
+	quietLogs(t)
+	t.Cleanup(func() { connectionDown, pausedUntil = false, time.Time{} })
+	settings := startSftpServer(t, t.TempDir(), func(conn net.Conn) net.Conn {
+		return &garbledConn{Conn: conn, after: 1 << 20}
+	})
+	settings["server.RekeyThresholdMB"] = "1"
+
+	_, err := testUpload(t, 4<<20, "upload.bin", settings)
+	var lost *connectionLostError
+	if !errors.As(err, &lost) {
+		t.Fatalf("got %v, want a lost connection", err)
+	}
+	if !connectionDown {
+		t.Error("uploads were not paused for the reconnect")
+	}
+}
+
+func TestIsConnectionLost(t *testing.T) {
+	quietLogs(t)
+	config := testConfig(t, t.TempDir(), startSftpServer(t, t.TempDir(), nil))
+	sftpClient, sshClient, _, err := dialServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sftpClient.Close()
+
+	kexFailed := errors.New("ssh: no common algorithm for key exchange")
+	// SSH_FX_FAILURE, an answer of the server
+	statusErr := &sftp.StatusError{Code: 4}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"no error", nil, false},
+		{"server answer", statusErr, false},
+		{"source EOF", io.ErrUnexpectedEOF, false},
+		{"transport error", kexFailed, false},
+		{"connection lost", sftp.ErrSSHFxConnectionLost, true},
+	}
+	for _, test := range tests {
+		if got := isConnectionLost(test.err, sftpClient); got != test.want {
+			t.Errorf("%s while connected: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	sshClient.Close()
+	sftpClient.Wait()
+	if !isConnectionLost(kexFailed, sftpClient) {
+		t.Error("a transport error after the connection closed is not a lost connection")
+	}
+	if !isConnectionLost(io.ErrUnexpectedEOF, sftpClient) {
+		t.Error("an EOF after the connection closed is not a lost connection")
+	}
+	if isConnectionLost(statusErr, sftpClient) {
+		t.Error("an answer of the server is a lost connection")
+	}
+}
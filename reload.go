@@ -0,0 +1,146 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+	"slices"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// watchedDirs returns every directory the watcher has to cover for config.
+func watchedDirs(config *Config) []string {
+	var dirs []string
+	for _, folder := range watchFolders(config) {
+		dirs = append(dirs, filepath.Clean(folder.FolderToWatch))
+	}
+	return append(dirs, watchFileDirs(config)...)
+}
+
+// reloadConfig re-reads the config file on SIGHUP and returns the config to
+// use from now on; on errors the current one stays active.
+//
+// Folders that are no longer configured are drained: events that were already
+// queued for them are handled with the old config before the folder is
+// removed from the watcher, after that new files there are ignored. Groups
+// that are still collecting members keep going until they complete or time
+// out. Connection settings only take effect after a restart.
+func reloadConfig(current *Config, watcher *fsnotify.Watcher, sftpClient *sftp.Client, sshClient *ssh.Client, verbose, quiet bool) *Config {
+	slog.Info("Reloading configuration", "file", current.configFile)
+	config, err := loadConfig(current.configFile)
+	if err != nil {
+		alert("Failed to reload configuration, keeping the current one: " + err.Error())
+		return current
+	}
+	err = ensureWatchFolder(config)
+	if err != nil {
+		alert("Failed to reload configuration, keeping the current one: " + err.Error())
+		return current
+	}
+	if (current.cloud == nil) != (config.cloud == nil) {
+		alert("UploadBackend can't change between the SFTP server and cloud storage on reload, keeping the current configuration until a restart")
+		return current
+	}
+	if connectionSettingsChanged(current, config) {
+		slog.Warn("Server connection settings changed, restart to apply them")
+	}
+	if eventSettingsChanged(current, config) {
+		slog.Warn("Event settings changed, restart to apply them")
+	}
+
+	oldDirs, newDirs := watchedDirs(current), watchedDirs(config)
+	drainEvents(watcher, sftpClient, sshClient, current)
+	for _, dir := range oldDirs {
+		if slices.Contains(newDirs, dir) {
+			continue
+		}
+		err := unwatchTree(watcher, dir)
+		if err != nil {
+			slog.Warn("Failed to stop watching folder", "folder", dir, "error", err)
+			continue
+		}
+		slog.Info("Stopped watching folder", "folder", dir)
+	}
+
+	for _, dir := range newDirs {
+		if slices.Contains(oldDirs, dir) {
+			continue
+		}
+		var err error
+		if folder := watchFolderConfig(dir, config); folder != nil {
+			err = watchTree(watcher, dir, folder)
+		} else {
+			err = watcher.Add(dir)
+		}
+		if err != nil {
+			alert("Failed to watch folder: " + err.Error())
+			continue
+		}
+		slog.Info("Started watching folder", "folder", dir)
+	}
+
+	applyLogLevel(config, verbose, quiet)
+	configureNotifications(config)
+	logConfigSummary(config)
+
+	// like at startup, pick up what is already waiting in a new watch folder
+	for _, folder := range watchFolders(config) {
+		if slices.Contains(oldDirs, filepath.Clean(folder.FolderToWatch)) {
+			continue
+		}
+		_, err := processExistingFiles(folder.FolderToWatch, sftpClient, sshClient, *folder)
+		if err != nil {
+			alert("Failed to process existing files: " + err.Error())
+		}
+	}
+	return config
+}
+
+// drainEvents handles the events that are already waiting, so files from a
+// folder that is about to be dropped are still finished.
+func drainEvents(watcher *fsnotify.Watcher, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			handleEvent(event, watcher, sftpClient, sshClient, config)
+		default:
+			return
+		}
+	}
+}
+
+func connectionSettingsChanged(a, b *Config) bool {
+	return a.SftpServer != b.SftpServer ||
+		a.SftpPort != b.SftpPort ||
+		a.SftpUser != b.SftpUser ||
+		a.SftpPassword != b.SftpPassword ||
+		a.PrivateKeyPath != b.PrivateKeyPath ||
+		a.PrivateKeyPassphrase != b.PrivateKeyPassphrase ||
+		a.PrivateKeyCertPath != b.PrivateKeyCertPath ||
+		a.KnownHostsPath != b.KnownHostsPath ||
+		a.AllowInsecureHostKey != b.AllowInsecureHostKey ||
+		a.ProxyType != b.ProxyType ||
+		a.ProxyAddress != b.ProxyAddress ||
+		!slices.Equal(a.SshCiphers, b.SshCiphers) ||
+		!slices.Equal(a.SshMACs, b.SshMACs) ||
+		!slices.Equal(a.SshKeyExchanges, b.SshKeyExchanges) ||
+		a.RekeyThreshold != b.RekeyThreshold ||
+		a.WarmUpConnection != b.WarmUpConnection ||
+		a.KeepAliveInterval != b.KeepAliveInterval ||
+		a.SftpMaxPacketKB != b.SftpMaxPacketKB ||
+		a.SftpMaxConcurrentRequests != b.SftpMaxConcurrentRequests ||
+		a.SftpConcurrentWrites != b.SftpConcurrentWrites ||
+		a.ShadowDestination != b.ShadowDestination
+}
+
+func eventSettingsChanged(a, b *Config) bool {
+	return a.EventsType != b.EventsType ||
+		a.EventsURL != b.EventsURL ||
+		a.EventsSubject != b.EventsSubject ||
+		a.EventsBufferSize != b.EventsBufferSize
+}
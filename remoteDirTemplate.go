@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"gopkg.in/ini.v1"
+)
+
+// loadRemoteDirTemplate reads RemoteDirTemplate and RemoteDirTimezone and
+// renders the template once against a sample time, so mistakes show up at
+// startup instead of with the first file.
+func loadRemoteDirTemplate(section *ini.Section, config *Config) error {
+	template, err := expandEnv("RemoteDirTemplate", section.Key("RemoteDirTemplate").String())
+	if err != nil {
+		return err
+	}
+	config.RemoteDirTemplate = template
+	if config.RemoteDirTemplate == "" {
+		return nil
+	}
+
+	zone := section.Key("RemoteDirTimezone").MustString("Local")
+	location, err := time.LoadLocation(zone)
+	if err != nil {
+		return fmt.Errorf("invalid RemoteDirTimezone: %w", err)
+	}
+	config.RemoteDirLocation = location
+
+	sample, err := renderRemoteDir(config.RemoteDirTemplate, time.Date(2024, time.January, 15, 13, 4, 5, 0, location))
+	if err != nil {
+		return fmt.Errorf("invalid RemoteDirTemplate: %w", err)
+	}
+	if path.IsAbs(sample) || sample == ".." || strings.HasPrefix(sample, "../") {
+		return fmt.Errorf("RemoteDirTemplate must stay below DestinationFolder, got %s", sample)
+	}
+	return nil
+}
+
+// remoteDirFor returns the subdirectory of DestinationFolder, with a
+// trailing slash, that localPath goes into. It is rendered with the file's
+// arrival time, see arrivalTime. Files that are gone or never existed
+// locally, like group archives, use the current time.
+func remoteDirFor(localPath string, config *Config) string {
+	info, _ := os.Stat(localPath)
+	arrival := arrivalTime(localPath, info, config)
+	// the template was validated at load time
+	dir, _ := renderRemoteDir(config.RemoteDirTemplate, arrival.In(config.RemoteDirLocation))
+	if dir == "." {
+		return ""
+	}
+	return dir + "/"
+}
+
+// ensureRemoteParent creates the remote folder of remotePath when remote
+// names can contain subfolders.
+func ensureRemoteParent(sftpClient *sftp.Client, remotePath string, config *Config) error {
+	if config.RemotePathRoot == "" && config.RemoteDirTemplate == "" && config.RunFolderTemplate == "" && !config.WatchRecursive {
+		return nil
+	}
+	err := sftpClient.MkdirAll(path.Dir(remotePath))
+	if err != nil {
+		return fmt.Errorf("failed to create remote folder %s: %w", path.Dir(remotePath), err)
+	}
+	return nil
+}
+
+// renderRemoteDir expands a RemoteDirTemplate. Templates containing "%" use
+// strftime directives, including the ISO week fields %G, %V and %u that Go
+// layouts lack. Any other template is a Go layout like "2006/01/02".
+func renderRemoteDir(template string, t time.Time) (string, error) {
+	if !strings.Contains(template, "%") {
+		return path.Clean(t.Format(template)), nil
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' {
+			out.WriteByte(template[i])
+			continue
+		}
+		i++
+		if i == len(template) {
+			return "", fmt.Errorf("template ends with a lone %%")
+		}
+		switch template[i] {
+		case 'Y':
+			out.WriteString(strconv.Itoa(t.Year()))
+		case 'y':
+			out.WriteString(t.Format("06"))
+		case 'm':
+			out.WriteString(t.Format("01"))
+		case 'd':
+			out.WriteString(t.Format("02"))
+		case 'H':
+			out.WriteString(t.Format("15"))
+		case 'M':
+			out.WriteString(t.Format("04"))
+		case 'S':
+			out.WriteString(t.Format("05"))
+		case 'j':
+			out.WriteString(fmt.Sprintf("%03d", t.YearDay()))
+		case 'a':
+			out.WriteString(t.Format("Mon"))
+		case 'A':
+			out.WriteString(t.Format("Monday"))
+		case 'b':
+			out.WriteString(t.Format("Jan"))
+		case 'B':
+			out.WriteString(t.Format("January"))
+		case 'G':
+			year, _ := t.ISOWeek()
+			out.WriteString(strconv.Itoa(year))
+		case 'V':
+			_, week := t.ISOWeek()
+			out.WriteString(fmt.Sprintf("%02d", week))
+		case 'u':
+			weekday := int(t.Weekday())
+			if weekday == 0 {
+				weekday = 7
+			}
+			out.WriteString(strconv.Itoa(weekday))
+		case '%':
+			out.WriteByte('%')
+		default:
+			return "", fmt.Errorf("unknown directive %%%c", template[i])
+		}
+	}
+	return path.Clean(out.String()), nil
+}
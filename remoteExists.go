@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// errRemoteExists is returned for uploads skipped because the remote file
+// is already there.
+var errRemoteExists = errors.New("remote file already exists")
+
+// resolveRemotePath applies RemoteCollisionStrategy to the upload target of
+// localPath. It returns the path to upload to, or errRemoteExists when the
+// upload must be skipped.
+func resolveRemotePath(sftpClient *sftp.Client, remotePath, localPath string, config *Config) (string, error) {
+	exists := func(candidate string) (bool, error) {
+		if config.RemoteCaseInsensitive {
+			if _, ok := recentCaseVariant(candidate); ok {
+				return true, nil
+			}
+		}
+		return remoteFileExists(sftpClient, candidate)
+	}
+	hash := func() (string, error) {
+		return fileHashSuffix(localPath)
+	}
+
+	// overwriting a file of another name would lose it, so a name that only
+	// differs in case gets a counter instead
+	strategy := config.RemoteCollisionStrategy
+	if config.RemoteCaseInsensitive && strategy == collisionOverwrite {
+		other, err := caseOnlyCollision(sftpClient, remotePath)
+		if err != nil {
+			return "", err
+		}
+		if other != "" {
+			slog.Warn("Remote name differs only in case from an existing file", "path", remotePath, "existing", other)
+			strategy = collisionCounter
+		}
+	}
+
+	resolved, err := resolveCollision(remotePath, strategy, exists, hash)
+	if errors.Is(err, errNameTaken) {
+		return "", errRemoteExists
+	}
+	if err == nil && resolved != remotePath {
+		slog.Info("Remote file exists, uploading under a new name", "path", remotePath, "remote", resolved, "strategy", strategy)
+	}
+	return resolved, err
+}
+
+// caseOnlyCollision returns the existing remote file whose name differs
+// from remotePath only in case, or "". A case-insensitive server reports
+// remotePath as existing then, the listing of its folder tells the actual
+// name.
+func caseOnlyCollision(sftpClient *sftp.Client, remotePath string) (string, error) {
+	if other, ok := recentCaseVariant(remotePath); ok {
+		return other, nil
+	}
+	exists, err := remoteFileExists(sftpClient, remotePath)
+	if err != nil || !exists {
+		return "", err
+	}
+	entries, err := sftpClient.ReadDir(path.Dir(remotePath))
+	if err != nil {
+		return "", fmt.Errorf("failed to list remote folder %s: %w", path.Dir(remotePath), err)
+	}
+	name := path.Base(remotePath)
+	other := ""
+	for _, entry := range entries {
+		if entry.Name() == name {
+			return "", nil
+		}
+		if strings.EqualFold(entry.Name(), name) {
+			other = path.Join(path.Dir(remotePath), entry.Name())
+		}
+	}
+	return other, nil
+}
+
+func remoteFileExists(sftpClient *sftp.Client, remotePath string) (bool, error) {
+	_, err := sftpClient.Stat(remotePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check remote file %s: %w", remotePath, err)
+	}
+	return true, nil
+}
+
+// skipDuplicate finishes a source file whose upload was skipped because the
+// remote file exists: it goes to DuplicatesFolder, or is treated like an
+// uploaded file when that is not set.
+func skipDuplicate(localPath string, file *os.File, config *Config) error {
+	logSkip(localPath, skipRemoteExists, config)
+	return setAsideDuplicate(localPath, file, "Remote file already exists, upload skipped", config)
+}
+
+// setAsideDuplicate moves a source file that is not uploaded because it was
+// delivered already to DuplicatesFolder, or finishes it like an uploaded
+// file when that is not set. message is logged.
+func setAsideDuplicate(localPath string, file *os.File, message string, config *Config) error {
+	if config.duplicatesFolder == "" {
+		slog.Warn(message, "file", localPath)
+		return finishUploadedFile(localPath, file, config)
+	}
+
+	target, err := moveLocalFile(localPath, config.duplicatesFolder, config.CollisionStrategy)
+	if err != nil {
+		return fmt.Errorf("failed to move file to duplicates folder: %w", err)
+	}
+	slog.Warn(message, "file", localPath, "target", target)
+	return finishSourceFile(localPath, config)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// SFTP status codes for a full server, from draft-ietf-secsh-filexfer-13.
+// Servers speaking version 3 of the protocol only send a generic failure,
+// their message is checked instead.
+const (
+	sshFxNoSpaceOnFilesystem = 14
+	sshFxQuotaExceeded       = 15
+)
+
+// remoteFullMessages are what servers without the status codes above answer
+// when they are out of space.
+var remoteFullMessages = []string{
+	"no space left",
+	"quota exceeded",
+	"disk quota",
+	"disk full",
+}
+
+// remoteFullError reports that the server ran out of space or the SFTP user
+// hit its quota. Trying again only helps once space was freed, so uploads
+// pause instead of using up the retries of the files.
+type remoteFullError struct {
+	path string
+	err  error
+}
+
+func (e *remoteFullError) Error() string {
+	return fmt.Sprintf("no space on the server for %s: %v", e.path, e.err)
+}
+
+func (e *remoteFullError) Unwrap() error {
+	return e.err
+}
+
+// remoteFullPauses counts the pauses in a row while the server is full, each
+// lasts twice as long as the one before. It is only used from the main
+// goroutine.
+var remoteFullPauses int
+
+// isRemoteFull reports whether err is the server refusing data for lack of
+// space or quota.
+func isRemoteFull(err error) bool {
+	var status *sftp.StatusError
+	if !errors.As(err, &status) {
+		return false
+	}
+	if status.Code == sshFxNoSpaceOnFilesystem || status.Code == sshFxQuotaExceeded {
+		return true
+	}
+	message := strings.ToLower(status.Error())
+	for _, full := range remoteFullMessages {
+		if strings.Contains(message, full) {
+			return true
+		}
+	}
+	return false
+}
+
+// pauseForRemoteFull pauses uploads with the retry backoff and raises the
+// alert for the first failure, the files wait in the watch folder meanwhile.
+func pauseForRemoteFull(remotePath string, err error, config *Config) error {
+	err = &remoteFullError{path: remotePath, err: err}
+	remoteFullPauses++
+	pause := max(retryBackoff(remoteFullPauses, config), config.RetryDelay)
+	pausedUntil = time.Now().Add(pause)
+	pauseReason = "the server ran out of space"
+	if remoteFullPauses == 1 {
+		alert(fmt.Sprintf("Server is out of space or over quota, pausing uploads for %s: %v", pause.Round(time.Second), err))
+	} else {
+		slog.Warn("Server is still out of space, pausing uploads again", "for", pause.Round(time.Second), "error", err)
+	}
+	return err
+}
+
+// remoteSpaceRestored notes a successful upload after the server was full.
+func remoteSpaceRestored() {
+	if remoteFullPauses > 0 {
+		remoteFullPauses = 0
+		slog.Info("Server has space again, uploads resumed")
+	}
+}
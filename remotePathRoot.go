@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// loadRemotePathRoot reads RemotePathRoot and checks that everything watched
+// lies below it.
+func loadRemotePathRoot(root string, config *Config) error {
+	if root == "" {
+		return nil
+	}
+	config.RemotePathRoot = filepath.Clean(root)
+
+	watched := append([]string{}, config.WatchFiles...)
+	if config.FolderToWatch != "" {
+		watched = append(watched, config.FolderToWatch)
+	}
+	for _, p := range watched {
+		if _, ok := relativeToRoot(p, config); !ok {
+			return fmt.Errorf("%s is not below RemotePathRoot %s", p, config.RemotePathRoot)
+		}
+	}
+	return nil
+}
+
+// relativeToRoot returns localPath relative to RemotePathRoot in slash form.
+func relativeToRoot(localPath string, config *Config) (string, bool) {
+	rel, err := filepath.Rel(config.RemotePathRoot, filepath.Clean(localPath))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
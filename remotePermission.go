@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// Reactions accepted by OnRemotePermissionDenied.
+const (
+	onPermissionDeniedFail  = "fail"
+	onPermissionDeniedPause = "pause"
+)
+
+// remotePermissionError reports that the server refused to write a file.
+// Unlike a dropped connection this doesn't go away by trying again, it needs
+// someone to fix the permissions of DestinationFolder.
+type remotePermissionError struct {
+	path string
+	err  error
+}
+
+func (e *remotePermissionError) Error() string {
+	return fmt.Sprintf("no permission to write %s on the server: %v", e.path, e.err)
+}
+
+func (e *remotePermissionError) Unwrap() error {
+	return e.err
+}
+
+// remotePermissionDenied is set while the server refuses to create files.
+// pausedUntil holds the end of a pause of all uploads, in
+// OnRemotePermissionDenied=pause mode or while the server is full, and
+// pauseReason why. All are only used from the main goroutine.
+var (
+	remotePermissionDenied bool
+	pausedUntil            time.Time
+	pauseReason            string
+)
+
+// classifyUploadError wraps the error of uploading remotePath in a
+// remotePermissionError when the server denied it, and raises the alert for
+// the first such file.
+func classifyUploadError(remotePath string, err error, config *Config) error {
+	var status *sftp.StatusError
+	denied := errors.Is(err, os.ErrPermission) ||
+		errors.As(err, &status) && status.Code == uint32(sftp.ErrSSHFxPermissionDenied)
+	if !denied {
+		return err
+	}
+
+	err = &remotePermissionError{path: remotePath, err: err}
+	if config.OnRemotePermissionDenied == onPermissionDeniedPause {
+		pausedUntil = time.Now().Add(config.RetryMaxDelay)
+		pauseReason = "a permission error"
+	}
+	if !remotePermissionDenied {
+		remotePermissionDenied = true
+		if config.OnRemotePermissionDenied == onPermissionDeniedPause {
+			alert(fmt.Sprintf("Pausing uploads for %s, check the permissions of the SFTP user: %v", config.RetryMaxDelay, err))
+		} else {
+			alert("Moving files to 'failed', check the permissions of the SFTP user: " + err.Error())
+		}
+	}
+	return err
+}
+
+// checkUploadsPaused returns an error while uploads are paused or the
+// connection is down, so files wait without trying the server again.
+func checkUploadsPaused() error {
+	if connectionDown {
+		return errors.New("uploads wait for the connection to the server")
+	}
+	if time.Now().Before(pausedUntil) {
+		return fmt.Errorf("uploads are paused until %s after %s", pausedUntil.Format(time.TimeOnly), pauseReason)
+	}
+	return nil
+}
+
+// remotePermissionRestored notes a successful upload after permission errors.
+func remotePermissionRestored() {
+	if remotePermissionDenied {
+		remotePermissionDenied = false
+		slog.Info("Server accepts uploads again")
+	}
+}
+
+// isPermanentError reports whether retrying err is pointless, so the file
+// goes to the failed folder right away.
+func isPermanentError(err error, config *Config) bool {
+	var permission *remotePermissionError
+	return errors.As(err, &permission) && config.OnRemotePermissionDenied == onPermissionDeniedFail
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// runRemoteRetention periodically deletes files older than RemoteRetentionDays
+// from the destination folders until stop is closed. In dry-run mode it only logs
+// what it would delete.
+func runRemoteRetention(sftpClient *sftp.Client, config *Config, stop <-chan struct{}) {
+	if config.RemoteRetentionDays <= 0 {
+		return
+	}
+
+	for {
+		sweepRemoteFolder(sftpClient, config)
+		select {
+		case <-stop:
+			return
+		case <-time.After(config.RemoteRetentionInterval):
+		}
+	}
+}
+
+// maxRetentionDepth bounds how deep a sweep descends below a destination
+// folder, against a destination like "/" or links that loop.
+const maxRetentionDepth = 8
+
+// retentionFolder is a destination folder swept by remote retention.
+type retentionFolder struct {
+	path string
+	// recursive is set when uploads land in subfolders of it
+	recursive bool
+}
+
+// sweepRemoteFolder deletes the expired files below the destination folders
+// of all watch folders.
+func sweepRemoteFolder(sftpClient *sftp.Client, config *Config) {
+	cutoff := time.Now().AddDate(0, 0, -config.RemoteRetentionDays)
+	removed := 0
+	for _, folder := range retentionFolders(config) {
+		n, _ := sweepRemoteDir(sftpClient, folder.path, folder.recursive, 0, cutoff, config)
+		removed += n
+	}
+	if removed > 0 {
+		slog.Info("Remote retention sweep finished", "deleted", removed)
+	}
+}
+
+// retentionFolders returns the distinct destination folders of the watch
+// folders. Those of folders that upload into subfolders, by
+// RemoteDirTemplate, RunFolderTemplate, RemotePathRoot or WatchRecursive,
+// are swept recursively, a destination below one of them is left to that
+// sweep.
+func retentionFolders(config *Config) []retentionFolder {
+	recursive := map[string]bool{}
+	for _, folder := range watchFolders(config) {
+		dest := path.Clean(folder.destionationFolder)
+		subfolders := folder.RemoteDirTemplate != "" || folder.RunFolderTemplate != "" || folder.RemotePathRoot != "" || folder.WatchRecursive
+		recursive[dest] = recursive[dest] || subfolders
+	}
+
+	var folders []retentionFolder
+	for dest := range recursive {
+		covered := false
+		for other, deep := range recursive {
+			if deep && other != dest && remoteBelow(dest, other) {
+				covered = true
+			}
+		}
+		if !covered {
+			folders = append(folders, retentionFolder{path: dest, recursive: recursive[dest]})
+		}
+	}
+	sort.Slice(folders, func(i, j int) bool { return folders[i].path < folders[j].path })
+	return folders
+}
+
+// remoteBelow reports whether the cleaned remote path p is inside dir.
+func remoteBelow(p, dir string) bool {
+	switch dir {
+	case ".":
+		return !path.IsAbs(p) && p != "."
+	case "/":
+		return path.IsAbs(p) && p != "/"
+	}
+	return strings.HasPrefix(p, dir+"/")
+}
+
+// sweepRemoteDir deletes the expired files in dir, with recursive also in
+// its subfolders, and removes subfolders that this emptied. Uploads in
+// progress, named "*.part", are left alone. It returns the number of files
+// deleted and whether dir is empty afterwards.
+func sweepRemoteDir(sftpClient *sftp.Client, dir string, recursive bool, depth int, cutoff time.Time, config *Config) (int, bool) {
+	entries, err := sftpClient.ReadDir(dir)
+	if err != nil {
+		slog.Error("Remote retention: failed to list destination folder", "folder", dir, "error", err)
+		return 0, false
+	}
+
+	removed, left := 0, len(entries)
+	for _, entry := range entries {
+		remotePath := path.Join(dir, entry.Name())
+		if strings.HasSuffix(entry.Name(), remoteTempSuffix) {
+			continue
+		}
+
+		if entry.IsDir() {
+			if !recursive {
+				continue
+			}
+			if depth >= maxRetentionDepth {
+				slog.Debug("Remote retention: folder too deep, not swept", "folder", remotePath)
+				continue
+			}
+			n, empty := sweepRemoteDir(sftpClient, remotePath, recursive, depth+1, cutoff, config)
+			removed += n
+			if n == 0 || !empty {
+				continue
+			}
+			err := sftpClient.RemoveDirectory(remotePath)
+			if err != nil {
+				slog.Warn("Remote retention: failed to remove emptied folder", "folder", remotePath, "error", err)
+				continue
+			}
+			slog.Info("Remote retention: removed emptied folder", "folder", remotePath)
+			left--
+			continue
+		}
+
+		if !entry.Mode().IsRegular() || !entry.ModTime().Before(cutoff) {
+			continue
+		}
+		if config.RemoteRetentionDryRun {
+			slog.Info("Remote retention (dry run): would delete", "path", remotePath, "modified", entry.ModTime())
+			continue
+		}
+
+		err := sftpClient.Remove(remotePath)
+		if err != nil {
+			slog.Error("Remote retention: failed to delete", "path", remotePath, "error", err)
+			continue
+		}
+		slog.Info("Remote retention: deleted", "path", remotePath, "modified", entry.ModTime())
+		removed++
+		left--
+	}
+	return removed, left == 0
+}
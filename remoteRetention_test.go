@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSweepRemoteFolder(t *testing.T) {
+	quietLogs(t)
+	remote := t.TempDir()
+	settings := startSftpServer(t, remote, nil)
+	settings["server.RemoteRetentionDays"] = "7"
+	settings["server.RemoteDirTemplate"] = "2006/01/02"
+	settings["watch:reports.FolderToWatch"] = t.TempDir()
+	settings["watch:reports.DestinationFolder"] = "reports"
+	config := testConfig(t, t.TempDir(), settings)
+	sftpClient, sshClient, _, err := dialServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeClients(sftpClient, sshClient) })
+
+	old := time.Now().AddDate(0, 0, -30)
+	put := func(name string, modified time.Time) string {
+		t.Helper()
+		p := filepath.Join(remote, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		writeFile(t, p, name)
+		os.Chtimes(p, modified, modified)
+		return p
+	}
+	expired := []string{
+		put("2024/01/15/a.csv", old),
+		put("2024/01/16/b.csv", old),
+		put("reports/r.pdf", old),
+		put("reports/2024/01/15/nested.pdf", old),
+	}
+	kept := []string{
+		put("2024/01/16/new.csv", time.Now()),
+		put("2024/01/17/upload.csv.part", old),
+		put("reports/2024/01/15/new.pdf", time.Now()),
+	}
+
+	sweepRemoteFolder(sftpClient, config)
+	for _, p := range expired {
+		if _, err := os.Stat(p); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expired file %s not deleted: %v", p, err)
+		}
+	}
+	for _, p := range kept {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("%s deleted: %v", p, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(remote, "2024", "01", "15")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("emptied dated folder not removed: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// replay uploads the files matching pattern again, e.g. from the processed
+// folder after a partner lost a batch, and returns the exit code. pattern is
+// a folder, whose files are all sent, or a glob. The error files of the
+// failed folder are left out. Replayed files stay where
+// they are and don't go through the post-upload actions. Remote files that
+// exist already are handled by RemoteCollisionStrategy unless force
+// overwrites them.
+func replay(pattern string, force, verbose, quiet bool) int {
+	config, exitCode := loadStartupConfig(verbose, quiet)
+	if exitCode != exitOK {
+		return exitCode
+	}
+
+	files, err := replayFiles(pattern, config)
+	if err != nil {
+		alert("Failed to list files to replay: " + err.Error())
+		return exitConfigError
+	}
+	if len(files) == 0 {
+		alert("No files to replay match " + pattern)
+		return exitConfigError
+	}
+
+	sftpClient, sshClient, exitCode := connectServer(config)
+	if exitCode != exitOK {
+		return exitCode
+	}
+	defer closeClients(sftpClient, sshClient)
+
+	failed := 0
+	for _, path := range files {
+		err := replayFile(path, force, sftpClient, sshClient, config)
+		if err != nil {
+			slog.Error("Failed to replay file", "file", path, "error", err)
+			failed++
+		}
+	}
+	slog.Info("Replay finished", "files", len(files), "failed", failed)
+	if failed > 0 {
+		return exitFileFailures
+	}
+	return exitOK
+}
+
+// replayFiles returns the regular files in the folder pattern or matching
+// the glob pattern.
+func replayFiles(pattern string, config *Config) ([]string, error) {
+	var candidates []string
+	if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+		entries, err := os.ReadDir(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			candidates = append(candidates, filepath.Join(pattern, entry.Name()))
+		}
+	} else {
+		candidates, err = filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var files []string
+	for _, path := range candidates {
+		// replaying the failed folder sends the files, not why they failed
+		if isErrorSidecar(path, config) {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+	}
+	return files, nil
+}
+
+func replayFile(path string, force bool, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	remotePath := remotePathFor(path, config)
+	if !force {
+		remotePath, err = resolveRemotePath(sftpClient, remotePath, path, config)
+		if errors.Is(err, errRemoteExists) {
+			slog.Warn("Remote file already exists, not replayed. Use --force to overwrite it", "file", path)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = uploadFile(file, remotePath, sftpClient, sshClient, config)
+	if err != nil {
+		return err
+	}
+	slog.Info("File replayed", "file", path, "remote", remotePath)
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/ini.v1"
+)
+
+// eventOverflows counts the times the kernel dropped file system events.
+// Only used from the main goroutine.
+var eventOverflows int
+
+// loadRescan reads the event buffer and sweep settings from [general].
+func loadRescan(section *ini.Section, config *Config) error {
+	config.EventBufferSize = section.Key("EventBufferSize").MustInt(0)
+	if config.EventBufferSize < 0 {
+		return fmt.Errorf("EventBufferSize must not be negative, got %d", config.EventBufferSize)
+	}
+	config.InotifyMaxQueuedEvents = section.Key("InotifyMaxQueuedEvents").MustInt(0)
+	if config.InotifyMaxQueuedEvents < 0 {
+		return fmt.Errorf("InotifyMaxQueuedEvents must not be negative, got %d", config.InotifyMaxQueuedEvents)
+	}
+	config.RescanInterval = section.Key("RescanInterval").MustDuration(0)
+	if config.RescanInterval < 0 {
+		return fmt.Errorf("RescanInterval must not be negative, got %s", config.RescanInterval)
+	}
+	return nil
+}
+
+// newWatcher creates the file watcher. The kernel queue is raised first, as
+// it only applies to watchers created afterwards.
+func newWatcher(config *Config) (*fsnotify.Watcher, error) {
+	if config.InotifyMaxQueuedEvents > 0 {
+		err := raiseInotifyQueue(config.InotifyMaxQueuedEvents)
+		if err != nil {
+			slog.Warn("Failed to raise the inotify event queue", "size", config.InotifyMaxQueuedEvents, "error", err)
+		}
+	}
+	return fsnotify.NewBufferedWatcher(uint(config.EventBufferSize))
+}
+
+// handleWatcherError reports an error of the file watcher. When the kernel
+// queue overflowed, events were lost and the watch folder is swept at once
+// to pick up the files they announced.
+func handleWatcherError(err error, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) {
+	if !errors.Is(err, fsnotify.ErrEventOverflow) {
+		alert("File watcher error: " + err.Error())
+		return
+	}
+	eventOverflows++
+	alert(fmt.Sprintf("File system events were lost (queue overflow %d), rescanning the watch folder", eventOverflows))
+	rescanWatchFolder(sftpClient, sshClient, config)
+}
+
+// rescanWatchFolder uploads what waits in the watch folder like the startup
+// scan does, for files whose events were missed. Files already waiting for
+// a retry are left to it.
+func rescanWatchFolder(sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) {
+	for _, folder := range watchFolders(config) {
+		start := time.Now()
+		failed, err := processExistingFiles(folder.FolderToWatch, sftpClient, sshClient, *folder)
+		if err != nil {
+			alert("Failed to rescan watch folder: " + err.Error())
+			continue
+		}
+		slog.Debug("Rescanned watch folder", "folder", folder.FolderToWatch, "failed", failed, "took", time.Since(start).Round(time.Millisecond))
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// retryCheckInterval is how often files waiting for a retry are checked.
+const retryCheckInterval = time.Second
+
+// Policies for sharing the uploads between retries and new files, see
+// RetryScheduling.
+const (
+	retrySchedulingFIFO       = "fifo"
+	retrySchedulingFair       = "fair"
+	retrySchedulingFreshFirst = "fresh-first"
+)
+
+// retryEntry tracks a file whose upload failed and will be tried again.
+type retryEntry struct {
+	attempts     int
+	firstFailure time.Time
+	next         time.Time
+}
+
+// pendingRetries holds the files waiting for another upload attempt. It is
+// only used from the main goroutine. Every change is written to the state
+// file, see restoreRetries.
+var pendingRetries = map[string]*retryEntry{}
+
+// retryScanFailures is set outside --once mode, where files that fail during
+// a scan of the watch folder get a retry like new files. Without it they
+// would only be tried again by the next rescan, if any.
+var retryScanFailures bool
+
+// restoreRetries picks up the retries of the previous run, with their
+// attempts and backoff, so a restart neither resets the attempt count nor
+// retries early. Files that are gone meanwhile are dropped, retries that
+// fell due while the tool was down run at the first retry check. The
+// startup scan leaves restored files to their retry.
+func restoreRetries() {
+	for path, record := range state.retries() {
+		if !retryTargetExists(path) {
+			forgetRetry(path)
+			continue
+		}
+		pendingRetries[path] = &retryEntry{attempts: record.Attempts, firstFailure: record.FirstFailure, next: record.Next}
+	}
+	if len(pendingRetries) > 0 {
+		slog.Info("Resuming retries of the previous run", "files", len(pendingRetries))
+	}
+}
+
+// retryTargetExists reports whether the file or directory unit waiting for
+// a retry is still there.
+func retryTargetExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && (info.Mode().IsRegular() || info.IsDir())
+}
+
+// saveRetry records the current state of a retry in the state file.
+func saveRetry(path string, entry *retryEntry) {
+	err := state.setRetry(path, entry)
+	if err != nil {
+		slog.Warn("Failed to record retry in state file", "file", path, "error", err)
+	}
+}
+
+// forgetRetry drops a file from the retries, when it was delivered or
+// given up on.
+func forgetRetry(path string) {
+	delete(pendingRetries, path)
+	err := state.forgetRetry(path)
+	if err != nil {
+		slog.Warn("Failed to remove retry from state file", "file", path, "error", err)
+	}
+}
+
+// scheduleRetry records a failed upload of path. The file is tried again
+// after a randomized backoff, unless MaxRetries or MaxTotalRetryDuration is
+// exhausted or the error is permanent, then it is moved to the failed folder.
+// While uploads are paused the file waits for the pause to end without using
+// up an attempt.
+func scheduleRetry(path string, reason error, config *Config) {
+	if isPermanentError(reason, config) {
+		forgetRetry(path)
+		err := moveToFailed(path, reason, config)
+		if err != nil {
+			slog.Error("Failed to move file to 'failed' folder", "file", path, "error", err)
+		}
+		return
+	}
+
+	entry, ok := pendingRetries[path]
+	if !ok {
+		entry = &retryEntry{firstFailure: time.Now()}
+		pendingRetries[path] = entry
+	}
+	if connectionDown || time.Now().Before(pausedUntil) {
+		entry.next = pausedUntil
+		saveRetry(path, entry)
+		slog.Debug("Uploads are paused, file waits", "file", path, "until", pausedUntil)
+		return
+	}
+	entry.attempts++
+
+	elapsed := time.Since(entry.firstFailure)
+	if entry.attempts > config.MaxRetries || elapsed >= config.MaxTotalRetryDuration {
+		forgetRetry(path)
+		err := moveToFailed(path, &retriesExhaustedError{attempts: entry.attempts, elapsed: elapsed, err: reason}, config)
+		if err != nil {
+			slog.Error("Failed to move file to 'failed' folder", "file", path, "error", err)
+		}
+		return
+	}
+
+	delay := retryBackoff(entry.attempts, config)
+	entry.next = time.Now().Add(delay)
+	saveRetry(path, entry)
+	slog.Warn("Upload failed, retrying", "file", path, "attempt", entry.attempts, "in", delay.Round(time.Millisecond), "error", reason)
+}
+
+// retryBackoff returns the delay before the given retry attempt. The backoff
+// doubles with every attempt up to RetryMaxDelay, full jitter spreads files
+// that failed together over the whole interval.
+func retryBackoff(attempt int, config *Config) time.Duration {
+	backoff := config.RetryDelay
+	for i := 1; i < attempt && backoff < config.RetryMaxDelay; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, config.RetryMaxDelay)
+	if backoff <= 0 {
+		return 0
+	}
+	return rand.N(backoff + 1)
+}
+
+// retryDueFiles tries the uploads whose backoff has passed, longest due
+// first. How they share the time with new files depends on RetryScheduling:
+// fifo retries all due files in one go, fair handles one waiting watcher
+// event before every retry and fresh-first handles all waiting events before
+// every retry.
+func retryDueFiles(watcher *fsnotify.Watcher, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) {
+	now := time.Now()
+	var due []string
+	for path, entry := range pendingRetries {
+		if !now.Before(entry.next) {
+			due = append(due, path)
+		}
+	}
+	slices.SortFunc(due, func(a, b string) int {
+		return pendingRetries[a].next.Compare(pendingRetries[b].next)
+	})
+
+	for _, path := range due {
+		switch config.RetryScheduling {
+		case retrySchedulingFair:
+			handleWaitingEvent(watcher, sftpClient, sshClient, config)
+		case retrySchedulingFreshFirst:
+			// a steady stream of new files must not hold up a stop
+			for !stopRequested() && handleWaitingEvent(watcher, sftpClient, sshClient, config) {
+			}
+		}
+		if stopRequested() {
+			return
+		}
+		// the events handled meanwhile may have finished the file already
+		entry, ok := pendingRetries[path]
+		if !ok {
+			continue
+		}
+		if !retryTargetExists(path) {
+			forgetRetry(path)
+			continue
+		}
+
+		var err error
+		if info, statErr := os.Stat(path); statErr == nil && info.IsDir() {
+			err = checkUploadsPaused()
+			if err == nil {
+				err = uploadDirectory(path, sftpClient, sshClient, config)
+			}
+		} else {
+			err = processFile(path, sftpClient, sshClient, config)
+		}
+		if err != nil {
+			scheduleRetry(path, err, config)
+			continue
+		}
+		forgetRetry(path)
+		slog.Info("Upload succeeded after retry", "file", path, "attempts", entry.attempts+1)
+	}
+}
+
+// handleWaitingEvent handles one watcher event if one is waiting and reports
+// whether there was one.
+func handleWaitingEvent(watcher *fsnotify.Watcher, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) bool {
+	select {
+	case event, ok := <-watcher.Events:
+		if ok {
+			handleEvent(event, watcher, sftpClient, sshClient, config)
+		}
+		return ok
+	default:
+		return false
+	}
+}
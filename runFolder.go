@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"gopkg.in/ini.v1"
+)
+
+// The run folder in use and when it was started. Only used from the main
+// goroutine.
+var (
+	runFolder      string
+	runFolderStart time.Time
+)
+
+// loadRunFolder reads RunFolderTemplate and RunFolderRollover from [server]
+// and renders the template once, so mistakes show up at startup.
+func loadRunFolder(section *ini.Section, config *Config) error {
+	template, err := expandEnv("RunFolderTemplate", section.Key("RunFolderTemplate").String())
+	if err != nil {
+		return err
+	}
+	config.RunFolderTemplate = template
+	config.RunFolderRollover = section.Key("RunFolderRollover").MustDuration(0)
+	if config.RunFolderTemplate == "" {
+		return nil
+	}
+	if config.RunFolderRollover < 0 {
+		return fmt.Errorf("RunFolderRollover must not be negative, got %s", config.RunFolderRollover)
+	}
+
+	sample, err := renderRunFolder(startTime, config)
+	if err != nil {
+		return fmt.Errorf("invalid RunFolderTemplate: %w", err)
+	}
+	if sample == "." || path.IsAbs(sample) || sample == ".." || strings.HasPrefix(sample, "../") {
+		return fmt.Errorf("RunFolderTemplate must name a folder below DestinationFolder, got %s", sample)
+	}
+	return nil
+}
+
+// renderRunFolder expands a RunFolderTemplate for the run starting at t.
+// {batch} is replaced with BatchID, the rest is a date template like
+// RemoteDirTemplate.
+func renderRunFolder(t time.Time, config *Config) (string, error) {
+	template := strings.ReplaceAll(config.RunFolderTemplate, "{batch}", config.BatchID)
+	return renderRemoteDir(template, t)
+}
+
+// currentRunFolder returns the run folder, with a trailing slash, that
+// uploads go into. The first run starts with the tool. With a
+// RunFolderRollover a new run starts once the current one is that old.
+func currentRunFolder(config *Config) string {
+	if config.RunFolderTemplate == "" {
+		return ""
+	}
+	now := time.Now()
+	if runFolder == "" || (config.RunFolderRollover > 0 && now.Sub(runFolderStart) >= config.RunFolderRollover) {
+		start := startTime
+		if runFolder != "" {
+			start = now
+		}
+		folder, err := renderRunFolder(start, config)
+		if err != nil {
+			// the template was checked at startup
+			slog.Error("Failed to render run folder", "error", err)
+			return runFolder
+		}
+		if runFolder != "" && runFolder != folder+"/" {
+			slog.Info("Starting a new run folder", "previous", runFolder, "folder", folder+"/")
+		}
+		runFolder, runFolderStart = folder+"/", start
+	}
+	return runFolder
+}
+
+// createRunFolder creates the run folder on the server, so it exists from
+// the start of the run even before the first file arrives.
+func createRunFolder(sftpClient *sftp.Client, config *Config) error {
+	folder := config.destionationFolder + currentRunFolder(config)
+	err := sftpClient.MkdirAll(strings.TrimSuffix(folder, "/"))
+	if err != nil {
+		return fmt.Errorf("failed to create run folder %s: %w", folder, err)
+	}
+	slog.Info("Uploading into run folder", "folder", folder)
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// runSelfTest periodically writes a small file to SelfTestRemotePath, reads
+// it back and deletes it, so a broken connection is noticed even when no
+// files arrive. It runs until stop is closed.
+func runSelfTest(sftpClient *sftp.Client, config *Config, stop <-chan struct{}) {
+	if config.SelfTestInterval <= 0 {
+		return
+	}
+
+	healthy := true
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(config.SelfTestInterval):
+		}
+
+		err := selfTestRoundTrip(sftpClient, config.SelfTestRemotePath)
+		switch {
+		case err != nil:
+			alert(fmt.Sprintf("SFTP self-test failed: %v", err))
+			healthy = false
+		case !healthy:
+			slog.Info("SFTP self-test passed again", "path", config.SelfTestRemotePath)
+			healthy = true
+		default:
+			slog.Debug("SFTP self-test passed", "path", config.SelfTestRemotePath)
+		}
+	}
+}
+
+// selfTestRoundTrip uploads, reads back, verifies and removes a test file.
+func selfTestRoundTrip(sftpClient *sftp.Client, remotePath string) error {
+	payload := []byte("filewatcher self-test " + time.Now().Format(time.RFC3339Nano) + "\n")
+
+	remoteFile, err := sftpClient.Create(remotePath)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	_, err = remoteFile.Write(payload)
+	if err != nil {
+		remoteFile.Close()
+		return fmt.Errorf("write: %w", err)
+	}
+	err = remoteFile.Close()
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	remoteFile, err = sftpClient.Open(remotePath)
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	content, err := io.ReadAll(remoteFile)
+	remoteFile.Close()
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if !bytes.Equal(content, payload) {
+		return fmt.Errorf("read: content differs from what was written")
+	}
+
+	err = sftpClient.Remove(remotePath)
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	return nil
+}
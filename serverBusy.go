@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// serverBusyMessages are what servers at their connection limit answer.
+// Unlike authentication failures these go away by waiting.
+var serverBusyMessages = []string{
+	"too many connections",
+	"too many users",
+	"too many sessions",
+	"maximum number of connections",
+}
+
+// isServerBusy reports whether err is a server refusing connections because
+// it is full.
+func isServerBusy(err error) bool {
+	message := strings.ToLower(err.Error())
+	for _, busy := range serverBusyMessages {
+		if strings.Contains(message, busy) {
+			return true
+		}
+	}
+	return false
+}
+
+// connectSSH dials the server. While the server is full it keeps trying with
+// the retry backoff for up to ServerBusyMaxWait, every other error is
+// returned right away.
+func connectSSH(addr string, sshConfig *ssh.ClientConfig, config *Config) (*ssh.Client, error) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		client, err := dialSSH(addr, sshConfig, config)
+		if err == nil || !isServerBusy(err) || time.Since(start) >= config.ServerBusyMaxWait {
+			return client, err
+		}
+		delay := max(retryBackoff(attempt, config), time.Second)
+		slog.Warn("Server is busy, connecting again later", "server", addr, "attempt", attempt, "in", delay.Round(time.Millisecond), "error", err)
+		if err := sleepUnlessStopped(delay); err != nil {
+			return nil, err
+		}
+	}
+}
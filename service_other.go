@@ -0,0 +1,23 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+var errServiceUnsupported = errors.New("running as a service is only supported on Windows, use systemd or launchd here")
+
+func runningAsService() bool {
+	return false
+}
+
+func runService(run func(stop <-chan struct{}) int) int {
+	return run(nil)
+}
+
+func installService() error {
+	return errServiceUnsupported
+}
+
+func uninstallService() error {
+	return errServiceUnsupported
+}
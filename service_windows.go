@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName is the name in the Services console and the Event Log source.
+const serviceName = "AlpineGlowFileWatcher"
+
+// runningAsService reports whether the service control manager started us.
+func runningAsService() bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		slog.Warn("Failed to detect whether running as a service", "error", err)
+		return false
+	}
+	return isService
+}
+
+// runService runs as a Windows service until it is stopped. Services start
+// in the system folder, so config.ini is read from the executable's folder
+// and logs go to the Event Log.
+func runService(run func(stop <-chan struct{}) int) int {
+	exe, err := os.Executable()
+	if err == nil {
+		err = os.Chdir(filepath.Dir(exe))
+	}
+	if err != nil {
+		slog.Error("Failed to change to the executable's folder", "error", err)
+		return exitRuntimeError
+	}
+
+	log, err := eventlog.Open(serviceName)
+	if err != nil {
+		slog.Error("Failed to open the Event Log", "error", err)
+		return exitRuntimeError
+	}
+	defer log.Close()
+	slog.SetDefault(slog.New(correlationHandler{newEventLogHandler(log)}))
+
+	service := &fileWatcherService{run: run}
+	err = svc.Run(serviceName, service)
+	if err != nil {
+		slog.Error("Service failed", "error", err)
+		return exitRuntimeError
+	}
+	return service.exitCode
+}
+
+// fileWatcherService adapts run to the service control manager.
+type fileWatcherService struct {
+	run      func(stop <-chan struct{}) int
+	exitCode int
+}
+
+func (s *fileWatcherService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	stop := make(chan struct{})
+	done := make(chan int, 1)
+	go func() { done <- s.run(stop) }()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case s.exitCode = <-done:
+			// a non-zero code lets the recovery actions restart the service
+			return s.exitCode != exitOK, uint32(s.exitCode)
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				close(stop)
+				s.exitCode = <-done
+				return false, 0
+			}
+		}
+	}
+}
+
+// installService registers the executable as an automatically started
+// service that is restarted when it fails, and as an Event Log source.
+func installService() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	manager, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer manager.Disconnect()
+
+	service, err := manager.OpenService(serviceName)
+	if err == nil {
+		service.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+	service, err = manager.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "AlpineGlow File Watcher",
+		Description: "Uploads new files to the SFTP server. Reads config.ini from " + filepath.Dir(exe),
+		StartType:   mgr.StartAutomatic,
+	})
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+
+	restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: time.Minute}
+	err = service.SetRecoveryActions([]mgr.RecoveryAction{restart, restart, restart}, uint32((24 * time.Hour).Seconds()))
+	if err == nil {
+		// also restart after exiting with an error code, not only on crashes
+		err = service.SetRecoveryActionsOnNonCrashFailures(true)
+	}
+	if err != nil {
+		service.Delete()
+		return fmt.Errorf("failed to set recovery actions: %w", err)
+	}
+	err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil {
+		service.Delete()
+		return fmt.Errorf("failed to register Event Log source: %w", err)
+	}
+	slog.Info("Service installed, start it in the Services console or with 'sc start'", "name", serviceName, "config", filepath.Join(filepath.Dir(exe), "config.ini"))
+	return nil
+}
+
+// uninstallService removes the service and its Event Log source.
+func uninstallService() error {
+	manager, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer manager.Disconnect()
+
+	service, err := manager.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer service.Close()
+	err = service.Delete()
+	if err != nil {
+		return err
+	}
+	err = eventlog.Remove(serviceName)
+	if err != nil {
+		slog.Warn("Failed to remove Event Log source", "error", err)
+	}
+	slog.Info("Service removed", "name", serviceName)
+	return nil
+}
+
+// eventLogHandler writes log records to the Windows Event Log with a
+// matching event type. The text handler formats the record, the shared
+// writer learns its level first.
+type eventLogHandler struct {
+	slog.Handler
+	writer *eventLogWriter
+}
+
+func newEventLogHandler(log *eventlog.Log) *eventLogHandler {
+	writer := &eventLogWriter{log: log}
+	options := &slog.HandlerOptions{
+		Level: logLevel,
+		// the Event Log records the time itself
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}
+	return &eventLogHandler{Handler: slog.NewTextHandler(writer, options), writer: writer}
+}
+
+func (h *eventLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	h.writer.mu.Lock()
+	defer h.writer.mu.Unlock()
+	h.writer.level = record.Level
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *eventLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &eventLogHandler{Handler: h.Handler.WithAttrs(attrs), writer: h.writer}
+}
+
+func (h *eventLogHandler) WithGroup(name string) slog.Handler {
+	return &eventLogHandler{Handler: h.Handler.WithGroup(name), writer: h.writer}
+}
+
+type eventLogWriter struct {
+	mu    sync.Mutex
+	log   *eventlog.Log
+	level slog.Level
+}
+
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	message := strings.TrimSuffix(string(p), "\n")
+	var err error
+	switch {
+	case w.level >= slog.LevelError:
+		err = w.log.Error(1, message)
+	case w.level >= slog.LevelWarn:
+		err = w.log.Warning(1, message)
+	default:
+		err = w.log.Info(1, message)
+	}
+	return len(p), err
+}
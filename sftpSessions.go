@@ -0,0 +1,22 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// openSftpSession opens another SFTP subsystem on the existing SSH
+// connection. Background jobs use their own session so a long directory
+// listing does not hold up uploads, without a second SSH handshake or
+// connection. When the server refuses another channel the shared client is
+// used instead.
+func openSftpSession(sshClient *ssh.Client, shared *sftp.Client, purpose string, config *Config) *sftp.Client {
+	client, err := sftp.NewClient(sshClient, sftpClientOptions(config)...)
+	if err != nil {
+		slog.Warn("Failed to open a separate SFTP session, sharing the upload session", "purpose", purpose, "error", err)
+		return shared
+	}
+	return client
+}
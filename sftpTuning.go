@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/sftp"
+	"gopkg.in/ini.v1"
+)
+
+// Bounds for SftpMaxPacketKB. 32 KB is what every server must accept and
+// the library default. OpenSSH takes messages of up to 256 KB, header
+// included, so 255 KB of payload is the most any server handles.
+const (
+	defaultSftpMaxPacketKB = 32
+	maxSftpMaxPacketKB     = 255
+)
+
+// loadSftpTuning reads the SFTP request settings from [server].
+func loadSftpTuning(section *ini.Section, config *Config) error {
+	config.SftpMaxPacketKB = section.Key("SftpMaxPacketKB").MustInt(defaultSftpMaxPacketKB)
+	if config.SftpMaxPacketKB < 1 || config.SftpMaxPacketKB > maxSftpMaxPacketKB {
+		return fmt.Errorf("SftpMaxPacketKB must be between 1 and %d, got %d", maxSftpMaxPacketKB, config.SftpMaxPacketKB)
+	}
+	config.SftpMaxConcurrentRequests = section.Key("SftpMaxConcurrentRequests").MustInt(64)
+	if config.SftpMaxConcurrentRequests < 1 {
+		return fmt.Errorf("SftpMaxConcurrentRequests must be at least 1, got %d", config.SftpMaxConcurrentRequests)
+	}
+	config.SftpConcurrentWrites = section.Key("SftpConcurrentWrites").MustBool(false)
+	return nil
+}
+
+// sftpWritePackets is how many packets the copy buffer holds at least when
+// the packets of one write are sent in parallel.
+const sftpWritePackets = 16
+
+// sftpCopyBufferKB returns the smallest CopyBufferSizeKB that makes use of
+// the SFTP settings. Uploads write to the server one buffer at a time, a
+// buffer below SftpMaxPacketKB sends smaller packets, and only the packets
+// of one buffer go out in parallel.
+func sftpCopyBufferKB(config *Config) int {
+	if config.SftpConcurrentWrites || config.AdaptiveConcurrency {
+		return min(config.SftpMaxPacketKB*sftpWritePackets, maxCopyBufferSizeKB)
+	}
+	return config.SftpMaxPacketKB
+}
+
+// sftpClientOptions returns the options every SFTP session is opened with.
+// Packets above 32 KB are not guaranteed by the protocol, the check of the
+// library is skipped on purpose since the limit was validated at load time.
+func sftpClientOptions(config *Config) []sftp.ClientOption {
+	return []sftp.ClientOption{
+		sftp.MaxPacketUnchecked(config.SftpMaxPacketKB * 1024),
+		sftp.MaxConcurrentRequestsPerFile(config.SftpMaxConcurrentRequests),
+		sftp.UseConcurrentWrites(config.SftpConcurrentWrites),
+	}
+}
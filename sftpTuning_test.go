@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestCopyBufferHoldsSftpPackets(t *testing.T) {
+	tests := []struct {
+		settings map[string]string
+		want     int
+	}{
+		{map[string]string{}, defaultCopyBufferSizeKB},
+		{map[string]string{"server.SftpMaxPacketKB": "255"}, 255},
+		{map[string]string{"server.SftpMaxPacketKB": "64", "general.CopyBufferSizeKB": "1024"}, 1024},
+		{map[string]string{"server.SftpConcurrentWrites": "true"}, 32 * sftpWritePackets},
+		{map[string]string{"server.SftpMaxPacketKB": "255", "server.AdaptiveConcurrency": "true"}, 255 * sftpWritePackets},
+	}
+	for _, test := range tests {
+		config := testConfig(t, t.TempDir(), test.settings)
+		if config.CopyBufferSizeKB != test.want {
+			t.Errorf("%v: CopyBufferSizeKB = %d, want %d", test.settings, config.CopyBufferSizeKB, test.want)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	// shadowRedialInterval is the least time between two connection attempts
+	// to the shadow server. Files arriving meanwhile are not copied.
+	shadowRedialInterval = time.Minute
+	// shadowDrainTimeout is how long shutdown waits for queued shadow copies.
+	shadowDrainTimeout = time.Minute
+)
+
+// Counters for the shadow destination, reported by the heartbeat.
+var (
+	shadowUploaded atomic.Int64
+	shadowFailed   atomic.Int64
+	shadowDropped  atomic.Int64
+)
+
+// shadowJob is an uploaded file waiting for its copy to the shadow server.
+// staged is a link to or copy of the source, which the primary flow may
+// archive or delete in the meantime. Where no link can be made, held keeps
+// the source open instead, its data stays readable after it was moved or
+// deleted. relativePath is the remote path below the destination folder of
+// the watch folder the file came from.
+type shadowJob struct {
+	local        string
+	staged       string
+	held         *os.File
+	relativePath string
+}
+
+var (
+	shadowQueue chan shadowJob
+	shadowDone  chan struct{}
+	shadowStart sync.Once
+)
+
+// loadShadow reads ShadowDestination from [server]. The shadow server is
+// reached with the primary's credentials, proxy and SSH settings unless
+// ShadowPassword is set.
+func loadShadow(section *ini.Section, config *Config) error {
+	raw := section.Key("ShadowDestination").String()
+	if raw == "" {
+		return nil
+	}
+	raw, err := expandEnv("ShadowDestination", raw)
+	if err != nil {
+		return err
+	}
+	shadow := *config
+	shadow.shadow = nil
+	err = applySftpURL("ShadowDestination", raw, &shadow)
+	if err != nil {
+		return err
+	}
+	if password := section.Key("ShadowPassword").String(); password != "" {
+		shadow.SftpPassword = password
+		shadow.PrivateKeyPath = ""
+	}
+	config.ShadowDestination = raw
+	config.ShadowQueueSize = section.Key("ShadowQueueSize").MustInt(100)
+	if config.ShadowQueueSize < 1 {
+		return fmt.Errorf("ShadowQueueSize must be at least 1, got %d", config.ShadowQueueSize)
+	}
+	config.shadow = &shadow
+	return nil
+}
+
+// shadowCopy queues a copy of an uploaded file for the shadow destination.
+// It never fails the primary delivery: a full queue or a file that can't be
+// staged only counts as a dropped copy.
+func shadowCopy(localPath, remotePath string, config *Config) {
+	if config.shadow == nil {
+		return
+	}
+	shadowStart.Do(func() {
+		shadowQueue = make(chan shadowJob, config.ShadowQueueSize)
+		shadowDone = make(chan struct{})
+		go runShadow(config.shadow)
+	})
+
+	job, err := stageShadowFile(localPath, config)
+	if err != nil {
+		shadowDropped.Add(1)
+		slog.Warn("Failed to stage file for the shadow destination", "file", localPath, "error", err)
+		return
+	}
+	// config is the one of the file's watch folder, each has its own
+	// destination folder
+	job.relativePath = strings.TrimPrefix(remotePath, config.destionationFolder)
+	select {
+	case shadowQueue <- job:
+	default:
+		job.release()
+		shadowDropped.Add(1)
+		slog.Warn("Shadow queue is full, file not copied to the shadow destination", "file", localPath)
+	}
+}
+
+// stageShadowFile links the source into TempDir. When TempDir is on another
+// file system the source is held open, so large files need no room in
+// TempDir. Only on Windows, where an open file can't be moved, it is
+// copied, if TempDir has room for it.
+func stageShadowFile(localPath string, config *Config) (shadowJob, error) {
+	job := shadowJob{local: localPath}
+	tmp, err := os.CreateTemp(config.TempDir, "filewatcher-shadow-")
+	if err != nil {
+		return job, err
+	}
+	staged := tmp.Name()
+	tmp.Close()
+	os.Remove(staged)
+	if os.Link(localPath, staged) == nil {
+		job.staged = staged
+		return job, nil
+	}
+
+	src, err := os.Open(localPath)
+	if err != nil {
+		return job, err
+	}
+	if runtime.GOOS != "windows" {
+		job.held = src
+		return job, nil
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err == nil {
+		err = checkFreeSpace(config.TempDir, info.Size(), config)
+	}
+	if err != nil {
+		return job, err
+	}
+	dst, err := os.Create(staged)
+	if err != nil {
+		return job, err
+	}
+	_, err = io.Copy(dst, src)
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(staged)
+		return job, err
+	}
+	job.staged = staged
+	return job, nil
+}
+
+// open returns the data of the job from the start.
+func (job shadowJob) open() (*os.File, error) {
+	if job.held != nil {
+		_, err := job.held.Seek(0, io.SeekStart)
+		return job.held, err
+	}
+	return os.Open(job.staged)
+}
+
+// release removes what stageShadowFile left.
+func (job shadowJob) release() {
+	if job.held != nil {
+		job.held.Close()
+		return
+	}
+	os.Remove(job.staged)
+}
+
+// runShadow uploads the queued copies one by one over its own connection.
+// Failed copies are logged and counted, never retried. After a connection
+// failure the server is tried again at most every shadowRedialInterval.
+func runShadow(config *Config) {
+	defer close(shadowDone)
+	var sftpClient *sftp.Client
+	var sshClient *ssh.Client
+	var lastDial time.Time
+	defer func() {
+		if sftpClient != nil {
+			sftpClient.Close()
+			sshClient.Close()
+		}
+	}()
+
+	for job := range shadowQueue {
+		if sftpClient == nil && time.Since(lastDial) >= shadowRedialInterval {
+			lastDial = time.Now()
+			var err error
+			sftpClient, sshClient, _, err = dialServer(config)
+			if err != nil {
+				slog.Warn("Shadow destination unreachable", "server", config.SftpServer, "error", err)
+			}
+		}
+
+		err := errors.New("shadow server not connected")
+		remotePath := config.destionationFolder + job.relativePath
+		if sftpClient != nil {
+			err = uploadShadow(job, remotePath, sftpClient, config)
+		}
+		job.release()
+		if err != nil {
+			shadowFailed.Add(1)
+			slog.Warn("Shadow upload failed", "file", job.local, "remote", remotePath, "error", err)
+			if sftpClient != nil {
+				sftpClient.Close()
+				sshClient.Close()
+				sftpClient, sshClient = nil, nil
+			}
+			continue
+		}
+		shadowUploaded.Add(1)
+		slog.Debug("File copied to shadow destination", "file", job.local, "remote", remotePath)
+	}
+}
+
+// uploadShadow writes the file of job to remotePath on the shadow server,
+// encrypted like the primary copy when EncryptWith is set.
+func uploadShadow(job shadowJob, remotePath string, sftpClient *sftp.Client, config *Config) error {
+	src, err := job.open()
+	if err != nil {
+		return err
+	}
+	if job.held == nil {
+		defer src.Close()
+	}
+
+	if dir := path.Dir(remotePath); dir != "." {
+		err = sftpClient.MkdirAll(dir)
+		if err != nil {
+			return err
+		}
+	}
+	dst, err := sftpClient.Create(remotePath)
+	if err != nil {
+		return err
+	}
+	if config.encryptTo != nil {
+		err = copyEncrypted(dst, src, job.local, nil, config)
+	} else {
+		_, err = copyBuffered(dst, src, config)
+	}
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// stopShadow waits up to shadowDrainTimeout for the queued shadow copies.
+// Copies still queued after that are dropped.
+func stopShadow() {
+	if shadowQueue == nil {
+		return
+	}
+	close(shadowQueue)
+	select {
+	case <-shadowDone:
+	case <-time.After(shadowDrainTimeout):
+		slog.Warn("Shadow copies did not finish in time", "dropped", len(shadowQueue))
+	}
+}
+
+// shadowAttrs returns the shadow counters for the heartbeat.
+func shadowAttrs() []any {
+	return []any{
+		"shadowUploaded", shadowUploaded.Load(),
+		"shadowFailed", shadowFailed.Load(),
+		"shadowDropped", shadowDropped.Load(),
+	}
+}
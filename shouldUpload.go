@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+var errRejected = errors.New("rejected by ShouldUploadCommand")
+
+// What happens to a file ShouldUploadCommand rejects, see ShouldUploadRejected.
+const (
+	rejectedSkip       = "skip"
+	rejectedArchive    = "archive"
+	rejectedQuarantine = "quarantine"
+)
+
+// loadShouldUpload reads ShouldUploadCommand and its settings from
+// [general]. QuarantineFolder is read with the other folders before.
+func loadShouldUpload(section *ini.Section, config *Config) error {
+	var err error
+	config.ShouldUploadCommand = section.Key("ShouldUploadCommand").String()
+	config.ShouldUploadCommandTimeout = time.Duration(section.Key("ShouldUploadCommandTimeoutSeconds").MustInt(30)) * time.Second
+	if config.ShouldUploadCommandTimeout <= 0 {
+		return fmt.Errorf("ShouldUploadCommandTimeoutSeconds must be at least 1")
+	}
+	config.ShouldUploadRejected, err = oneOf(section.Key("ShouldUploadRejected"), rejectedSkip, rejectedArchive, rejectedQuarantine)
+	if err != nil {
+		return err
+	}
+	if config.ShouldUploadCommand != "" && config.ShouldUploadRejected == rejectedQuarantine && config.quarantineFolder == "" {
+		return fmt.Errorf("ShouldUploadRejected = quarantine needs QuarantineFolder")
+	}
+	return nil
+}
+
+// shouldUpload runs ShouldUploadCommand for path. Exit status 0 means
+// upload, 1 means the file is rejected. Any other status or a timeout is an
+// error, so the file is retried like a failed upload. {file} is replaced in
+// each argument after the command was split, no shell is involved.
+func shouldUpload(path string, config *Config) (bool, error) {
+	args := strings.Fields(config.ShouldUploadCommand)
+	for i, arg := range args {
+		args[i] = expandTemplate(arg, map[string]string{"file": path})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShouldUploadCommandTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return false, fmt.Errorf("ShouldUploadCommand timed out after %s", config.ShouldUploadCommandTimeout)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		slog.Debug("ShouldUploadCommand rejected file", "file", path, "output", strings.TrimSpace(string(output)))
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("ShouldUploadCommand failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return true, nil
+}
+
+// handleRejectedFile applies ShouldUploadRejected to a file the predicate
+// turned down. Skipped files stay in place and are asked about again at the
+// next scan.
+func handleRejectedFile(path string, file *os.File, config *Config) error {
+	logSkip(path, skipRejected, config)
+	switch config.ShouldUploadRejected {
+	case rejectedArchive:
+		file.Close()
+		return archiveWithoutUpload(path, config)
+	case rejectedQuarantine:
+		file.Close()
+		return moveToQuarantine(path, errRejected, config)
+	}
+	slog.Info("File rejected by ShouldUploadCommand, not uploaded", "file", path)
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+
+	"github.com/pkg/sftp"
+)
+
+// Hash algorithms accepted by ChecksumAlgorithm.
+const (
+	checksumSHA256 = "sha256"
+	checksumMD5    = "md5"
+)
+
+// remoteTempSuffix marks remote files that are still being written.
+const remoteTempSuffix = ".part"
+
+func newChecksumHash(algorithm string) hash.Hash {
+	if algorithm == checksumMD5 {
+		return md5.New()
+	}
+	return sha256.New()
+}
+
+// writeChecksumSidecar uploads "<remotePath>.<algorithm>" in the format
+// sha256sum/md5sum produce, so the receiver can check it with those tools.
+func writeChecksumSidecar(sftpClient *sftp.Client, remotePath string, sum []byte, config *Config) error {
+	sidecarPath := remotePath + "." + config.ChecksumAlgorithm
+	line := fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum), path.Base(remotePath))
+
+	err := uploadAtomically(sftpClient, sidecarPath, func(w io.Writer) error {
+		_, err := io.WriteString(w, line)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload checksum sidecar: %w", err)
+	}
+	slog.Debug("Uploaded checksum sidecar", "path", sidecarPath)
+	return nil
+}
+
+// uploadAtomically writes a remote file under a temporary name and renames it
+// into place once complete, so readers never see a partial file.
+func uploadAtomically(sftpClient *sftp.Client, remotePath string, write func(io.Writer) error) error {
+	tempPath := remotePath + remoteTempSuffix
+	tempFile, err := sftpClient.Create(tempPath)
+	if err != nil {
+		return err
+	}
+
+	err = write(tempFile)
+	if err != nil {
+		tempFile.Close()
+		sftpClient.Remove(tempPath)
+		return err
+	}
+	err = tempFile.Close()
+	if err != nil {
+		sftpClient.Remove(tempPath)
+		return err
+	}
+
+	err = renameRemote(sftpClient, tempPath, remotePath)
+	if err != nil {
+		sftpClient.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+// uploadDirectly writes a remote file in place.
+func uploadDirectly(sftpClient *sftp.Client, remotePath string, write func(io.Writer) error) error {
+	remoteFile, err := sftpClient.Create(remotePath)
+	if err != nil {
+		return err
+	}
+
+	err = write(remoteFile)
+	if err != nil {
+		remoteFile.Close()
+		return err
+	}
+	return remoteFile.Close()
+}
+
+// writeReadyMarker creates the empty "<remotePath><ReadyMarkerSuffix>" file
+// that tells the receiver remotePath is complete.
+func writeReadyMarker(sftpClient *sftp.Client, remotePath string, config *Config) error {
+	markerPath := remotePath + config.ReadyMarkerSuffix
+	marker, err := sftpClient.Create(markerPath)
+	if err != nil {
+		return fmt.Errorf("failed to create ready marker: %w", err)
+	}
+	err = marker.Close()
+	if err != nil {
+		return fmt.Errorf("failed to create ready marker: %w", err)
+	}
+	slog.Debug("Created ready marker", "path", markerPath)
+	return nil
+}
+
+// renameRemote renames a remote file, replacing an existing target. Plain
+// SFTP rename refuses to overwrite, so the posix-rename extension is used when
+// the server offers it.
+func renameRemote(sftpClient *sftp.Client, from, to string) error {
+	if _, ok := sftpClient.HasExtension("posix-rename@openssh.com"); ok {
+		return sftpClient.PosixRename(from, to)
+	}
+	err := sftpClient.Remove(to)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return sftpClient.Rename(from, to)
+}
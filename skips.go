@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// Reasons a file in the watch folder is not uploaded, see LogSkips.
+const (
+	skipExtension       = "extension not watched"
+	skipNoMatch         = "does not match MatchRegex"
+	skipIgnored         = "matches IgnoreRegex"
+	skipOwner           = "owner not allowed"
+	skipTooOld          = "not modified within OnlyProcessModifiedWithin"
+	skipNoTrigger       = "waiting for trigger file"
+	skipRemoteExists    = "exists on the server"
+	skipAlreadyUploaded = "already uploaded before a restart"
+	skipZeroByte        = "empty file"
+	skipHardLink        = "hard link of an uploaded file"
+	skipRejected        = "rejected by ShouldUploadCommand"
+)
+
+// skipCounts counts the logged skips by reason for the heartbeat. It is only
+// used from the main goroutine.
+var skipCounts = map[string]int{}
+
+// logSkip explains at debug level why path is not uploaded.
+func logSkip(path, reason string, config *Config) {
+	if !config.LogSkips {
+		return
+	}
+	skipCounts[reason]++
+	slog.Debug("File skipped", "file", path, "reason", reason)
+}
+
+// skipSummary formats skipCounts as "reason=count, ...".
+func skipSummary() string {
+	reasons := make([]string, 0, len(skipCounts))
+	for reason := range skipCounts {
+		reasons = append(reasons, reason)
+	}
+	slices.Sort(reasons)
+	for i, reason := range reasons {
+		reasons[i] = fmt.Sprintf("%s=%d", reason, skipCounts[reason])
+	}
+	return strings.Join(reasons, ", ")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/ini.v1"
+)
+
+// stableCheckInterval is how often files waiting to settle are checked.
+const stableCheckInterval = 500 * time.Millisecond
+
+// stabilizationRule is one entry of the [stabilization] section: files
+// whose name matches pattern settle for delay instead of
+// StabilizationDelay.
+type stabilizationRule struct {
+	pattern string
+	delay   time.Duration
+}
+
+// settlingFile is a new file waiting until it stopped changing.
+type settlingFile struct {
+	size       int64
+	modTime    time.Time
+	lastChange time.Time
+	delay      time.Duration
+}
+
+// pendingStable holds the files waiting to settle. It is only used from the
+// main goroutine.
+var pendingStable = map[string]*settlingFile{}
+
+// loadStabilization reads StabilizationDelay from [general] and the
+// overrides of the [stabilization] section, where every key is a file name
+// pattern and its value the delay for matching files. The first matching
+// pattern wins.
+func loadStabilization(general, section *ini.Section, config *Config) error {
+	config.StabilizationDelay = general.Key("StabilizationDelay").MustDuration(2 * time.Second)
+	if config.StabilizationDelay < 0 {
+		return fmt.Errorf("StabilizationDelay must not be negative, got %s", config.StabilizationDelay)
+	}
+	config.StabilizationRules = nil
+	for _, key := range section.Keys() {
+		if _, err := filepath.Match(key.Name(), ""); err != nil {
+			return fmt.Errorf("invalid [stabilization] pattern %q: %w", key.Name(), err)
+		}
+		delay, err := key.Duration()
+		if err != nil || delay < 0 {
+			return fmt.Errorf("invalid [stabilization] delay %q for %s, expected a duration like 30s", key.Value(), key.Name())
+		}
+		config.StabilizationRules = append(config.StabilizationRules, stabilizationRule{pattern: key.Name(), delay: delay})
+	}
+	return nil
+}
+
+// stabilizationFor returns how long path must stay unchanged before it is
+// uploaded.
+func stabilizationFor(path string, config *Config) time.Duration {
+	name := filepath.Base(path)
+	for _, rule := range config.StabilizationRules {
+		if ok, _ := filepath.Match(rule.pattern, name); ok {
+			return rule.delay
+		}
+	}
+	return config.StabilizationDelay
+}
+
+// awaitStable reports whether path has to settle before it is uploaded and,
+// if so, starts tracking it. Further events for a tracked file only restart
+// its delay, so a file written in several steps is uploaded once. A file
+// that was not modified for the delay already, e.g. one moved into the
+// folder, goes up right away.
+func awaitStable(path string, config *Config) bool {
+	if file, ok := pendingStable[path]; ok {
+		file.lastChange = time.Now()
+		return true
+	}
+	delay := stabilizationFor(path, config)
+	if delay <= 0 {
+		return false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		// processFile reports what is wrong with the file
+		return false
+	}
+	lastChange := clampFuture(path, info.ModTime(), time.Now(), config)
+	if time.Since(lastChange) >= delay {
+		return false
+	}
+	slog.Debug("Waiting for file to settle", "file", path, "delay", delay)
+	pendingStable[path] = &settlingFile{size: info.Size(), modTime: info.ModTime(), lastChange: lastChange, delay: delay}
+	return true
+}
+
+// fileChanged restarts the delay of a tracked file on a write event.
+func fileChanged(path string) {
+	if file, ok := pendingStable[path]; ok {
+		file.lastChange = time.Now()
+	}
+}
+
+// checkStableFiles uploads the tracked files whose size and modification
+// time did not change for their delay.
+func checkStableFiles(sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) {
+	for path, file := range pendingStable {
+		info, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			slog.Debug("File is already gone, skipping it", "file", path)
+			delete(pendingStable, path)
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to stat file", "file", path, "error", err)
+			continue
+		}
+		if info.Size() != file.size || !info.ModTime().Equal(file.modTime) {
+			file.size, file.modTime, file.lastChange = info.Size(), info.ModTime(), time.Now()
+			continue
+		}
+		if time.Since(file.lastChange) < file.delay {
+			continue
+		}
+
+		delete(pendingStable, path)
+		slog.Debug("File settled", "file", path)
+		if isWatchedFile(path, config) {
+			err := uploadWatchedFile(path, sftpClient, sshClient, config)
+			if err != nil {
+				slog.Error("Failed to upload watched file", "file", path, "error", err)
+			}
+			continue
+		}
+		uploadNewFile(path, sftpClient, sshClient, config)
+	}
+}
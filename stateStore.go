@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// stateStore is the small amount of state the tool keeps across restarts. It
+// lives in a JSON file (StateFile) that is rewritten atomically on change.
+type stateStore struct {
+	mu   sync.Mutex
+	path string
+
+	// Offsets holds how many bytes of each source file were already appended
+	// to the remote copy in UploadMode=append.
+	Offsets map[string]int64 `json:"offsets"`
+
+	// OffsetFiles holds the device and inode of the file each offset was
+	// counted in. A file rotated into place under the same name has another
+	// one, even when it is already larger than the offset.
+	OffsetFiles map[string]offsetFile `json:"offsetFiles,omitempty"`
+
+	// AppendRemotes holds the remote file each source file is appended to,
+	// chosen at its first append. Dated and run folders move on, the
+	// appends of one file don't.
+	AppendRemotes map[string]string `json:"appendRemotes,omitempty"`
+
+	// Uploaded holds the source files that were uploaded but not yet moved
+	// or deleted. After a crash in between they are not sent again.
+	Uploaded map[string]uploadRecord `json:"uploaded,omitempty"`
+
+	// NotUploaded holds the files in the processed folder that were archived
+	// without an upload, so processed retention never deletes the only copy.
+	NotUploaded map[string]time.Time `json:"notUploaded,omitempty"`
+
+	// Retries holds the files waiting for another upload attempt, so their
+	// attempts and backoff survive a restart.
+	Retries map[string]retryRecord `json:"retries,omitempty"`
+}
+
+// offsetFile is the stored form of the fileID of an appended file.
+type offsetFile struct {
+	Dev uint64 `json:"dev"`
+	Ino uint64 `json:"ino"`
+}
+
+// retryRecord is the stored form of a retryEntry.
+type retryRecord struct {
+	Attempts     int       `json:"attempts"`
+	FirstFailure time.Time `json:"firstFailure"`
+	Next         time.Time `json:"next"`
+}
+
+// uploadRecord identifies the version of a source file that was uploaded.
+type uploadRecord struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Remote  string    `json:"remote"`
+	// UploadedAt is when the upload finished
+	UploadedAt time.Time `json:"uploadedAt,omitempty"`
+	// AckOverdue is set once the missing acknowledgment was alerted
+	AckOverdue bool `json:"ackOverdue,omitempty"`
+}
+
+// state is the store opened by initialize.
+var state *stateStore
+
+func openStateStore(path string) (*stateStore, error) {
+	s := &stateStore{path: path, Offsets: map[string]int64{}, OffsetFiles: map[string]offsetFile{}, AppendRemotes: map[string]string{}, Uploaded: map[string]uploadRecord{}, NotUploaded: map[string]time.Time{}, Retries: map[string]retryRecord{}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	err = json.Unmarshal(data, s)
+	if err != nil {
+		// an unreadable state loses offsets and records, not uploads, so
+		// start over and keep the file for inspection
+		slog.Error("State file is empty or corrupt, starting with an empty state", "file", path, "error", err, "kept", path+".corrupt")
+		rename := os.Rename(path, path+".corrupt")
+		if rename != nil {
+			return nil, fmt.Errorf("failed to set aside corrupt state file: %w", rename)
+		}
+		return openStateStore(path)
+	}
+	if s.Offsets == nil {
+		s.Offsets = map[string]int64{}
+	}
+	if s.OffsetFiles == nil {
+		s.OffsetFiles = map[string]offsetFile{}
+	}
+	if s.AppendRemotes == nil {
+		s.AppendRemotes = map[string]string{}
+	}
+	if s.Uploaded == nil {
+		s.Uploaded = map[string]uploadRecord{}
+	}
+	if s.NotUploaded == nil {
+		s.NotUploaded = map[string]time.Time{}
+	}
+	if s.Retries == nil {
+		s.Retries = map[string]retryRecord{}
+	}
+	return s, nil
+}
+
+// save writes the store to a temporary file, flushes it to disk and renames
+// it over the old one, so a crash never leaves a truncated state file
+// behind. Callers hold s.mu.
+func (s *stateStore) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempPath := s.path + ".tmp"
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	err = os.Rename(tempPath, s.path)
+	if err != nil {
+		return err
+	}
+	err = syncDir(filepath.Dir(s.path))
+	if err != nil {
+		return fmt.Errorf("failed to flush state folder: %w", err)
+	}
+	return nil
+}
+
+// offset returns how many bytes of the file at path, described by info,
+// were appended already. replaced reports that the offset was counted in
+// another file, one that was at path before, so none of this one was sent.
+// Without file identities, on Windows and for offsets saved before they
+// were kept, the file is taken to be the same.
+func (s *stateStore) offset(path string, info os.FileInfo) (offset int64, replaced bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path = filepath.Clean(path)
+	offset = s.Offsets[path]
+	stored, known := s.OffsetFiles[path]
+	id, _, ok := fileIdentity(info)
+	if offset > 0 && known && ok && (stored.Dev != id.dev || stored.Ino != id.ino) {
+		return 0, true
+	}
+	return offset, false
+}
+
+// setOffset records offset for the file at path, described by info.
+func (s *stateStore) setOffset(path string, info os.FileInfo, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path = filepath.Clean(path)
+	s.Offsets[path] = offset
+	if id, _, ok := fileIdentity(info); ok {
+		s.OffsetFiles[path] = offsetFile{Dev: id.dev, Ino: id.ino}
+	}
+	return s.save()
+}
+
+func (s *stateStore) forgetOffset(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path = filepath.Clean(path)
+	_, hasOffset := s.Offsets[path]
+	_, hasRemote := s.AppendRemotes[path]
+	if !hasOffset && !hasRemote {
+		return nil
+	}
+	delete(s.Offsets, path)
+	delete(s.OffsetFiles, path)
+	delete(s.AppendRemotes, path)
+	return s.save()
+}
+
+// appendRemote returns the remote file path is appended to, if it was
+// appended before.
+func (s *stateStore) appendRemote(path string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	remotePath, ok := s.AppendRemotes[filepath.Clean(path)]
+	return remotePath, ok
+}
+
+func (s *stateStore) setAppendRemote(path, remotePath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.AppendRemotes[filepath.Clean(path)] = remotePath
+	return s.save()
+}
+
+// alreadyUploaded reports whether this version of path was uploaded before,
+// and where to.
+func (s *stateStore) alreadyUploaded(path string, info os.FileInfo) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.Uploaded[filepath.Clean(path)]
+	if !ok || record.Size != info.Size() || !record.ModTime.Equal(info.ModTime()) {
+		return "", false
+	}
+	return record.Remote, true
+}
+
+// uploadedRemote returns where path was uploaded to, while it is recorded as
+// uploaded.
+func (s *stateStore) uploadedRemote(path string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.Uploaded[filepath.Clean(path)]
+	return record.Remote, ok
+}
+
+// uploadedAt returns when path was uploaded, or now for records written
+// before the time was kept.
+func (s *stateStore) uploadedAt(path string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	at := s.Uploaded[filepath.Clean(path)].UploadedAt
+	if at.IsZero() {
+		return time.Now()
+	}
+	return at
+}
+
+// ackOverdue reports whether the missing acknowledgment of path was
+// alerted already.
+func (s *stateStore) ackOverdue(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Uploaded[filepath.Clean(path)].AckOverdue
+}
+
+func (s *stateStore) markAckOverdue(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path = filepath.Clean(path)
+	record, ok := s.Uploaded[path]
+	if !ok {
+		return nil
+	}
+	record.AckOverdue = true
+	s.Uploaded[path] = record
+	return s.save()
+}
+
+func (s *stateStore) markUploaded(path string, info os.FileInfo, remotePath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Uploaded[filepath.Clean(path)] = uploadRecord{Size: info.Size(), ModTime: info.ModTime(), Remote: remotePath, UploadedAt: time.Now()}
+	return s.save()
+}
+
+func (s *stateStore) forgetUploaded(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path = filepath.Clean(path)
+	if _, ok := s.Uploaded[path]; !ok {
+		return nil
+	}
+	delete(s.Uploaded, path)
+	return s.save()
+}
+
+// uploadPending reports whether a file named name was uploaded but is not
+// completely archived yet.
+func (s *stateStore) uploadPending(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for path := range s.Uploaded {
+		if filepath.Base(path) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *stateStore) markNotUploaded(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.NotUploaded[filepath.Clean(path)] = time.Now()
+	return s.save()
+}
+
+func (s *stateStore) wasNotUploaded(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.NotUploaded[filepath.Clean(path)]
+	return ok
+}
+
+// forgetNotUploaded drops the records of archived files that are gone,
+// because someone removed them by hand.
+func (s *stateStore) forgetNotUploaded(exists func(path string) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for path := range s.NotUploaded {
+		if !exists(path) {
+			delete(s.NotUploaded, path)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return s.save()
+}
+
+func (s *stateStore) setRetry(path string, entry *retryEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Retries[filepath.Clean(path)] = retryRecord{Attempts: entry.attempts, FirstFailure: entry.firstFailure, Next: entry.next}
+	return s.save()
+}
+
+func (s *stateStore) forgetRetry(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path = filepath.Clean(path)
+	if _, ok := s.Retries[path]; !ok {
+		return nil
+	}
+	delete(s.Retries, path)
+	return s.save()
+}
+
+// retries returns a copy of the stored retries.
+func (s *stateStore) retries() map[string]retryRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	retries := make(map[string]retryRecord, len(s.Retries))
+	for path, record := range s.Retries {
+		retries[path] = record
+	}
+	return retries
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenCorruptStateStore(t *testing.T) {
+	quietLogs(t)
+	for _, content := range []string{"", `{"offsets": {"/data/app.log": 12`} {
+		path := filepath.Join(t.TempDir(), "state.json")
+		writeFile(t, path, content)
+
+		s, err := openStateStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(s.Offsets) != 0 || len(s.Uploaded) != 0 {
+			t.Errorf("state from %q is not empty: %+v", content, s)
+		}
+		kept, err := os.ReadFile(path + ".corrupt")
+		if err != nil || string(kept) != content {
+			t.Errorf("corrupt state file kept as %q, %v, want %q", kept, err, content)
+		}
+
+		// the new state replaces the corrupt one
+		s.Offsets["/data/app.log"] = 5
+		err = s.save()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err = openStateStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Offsets["/data/app.log"] != 5 {
+			t.Errorf("offset after reopening is %d, want 5", s.Offsets["/data/app.log"])
+		}
+	}
+}
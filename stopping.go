@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// errStopped ends a phase that waited when the watcher was asked to stop.
+var errStopped = errors.New("stopped")
+
+// stopping is closed when the watcher was asked to stop. The main loop
+// selects on it; startup, the startup scan, --once and the waits while
+// connecting check it between steps, so a stop request doesn't have to wait
+// for them to finish. Nil outside run.
+var stopping <-chan struct{}
+
+func stopRequested() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleepUnlessStopped waits for d and returns errStopped when the watcher was
+// asked to stop meanwhile.
+func sleepUnlessStopped(d time.Duration) error {
+	select {
+	case <-stopping:
+		return errStopped
+	case <-time.After(d):
+		return nil
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// logConfigSummary logs the effective configuration in one entry, so it is
+// visible at a glance what is watched, which files qualify and where they
+// go. Passwords are never logged.
+func logConfigSummary(config *Config) {
+	auth := "password"
+	if config.PrivateKeyPath != "" {
+		auth = "private key " + config.PrivateKeyPath
+		if config.PrivateKeyCertPath != "" {
+			auth += " with certificate " + config.PrivateKeyCertPath
+		}
+	}
+	if config.AllowInsecureHostKey {
+		auth += ", host key not checked"
+	}
+	connection := config.SftpUser + "@" + config.SftpServer
+	if config.SftpPort != defaultSftpPort {
+		connection = config.SftpUser + "@" + sftpAddress(config)
+	}
+	if config.ProxyType != proxyNone {
+		connection += " via " + config.ProxyType + " proxy " + config.ProxyAddress
+	}
+	if config.cloud != nil {
+		connection, auth = config.cloud.describe()
+	}
+
+	attrs := []any{
+		"config", strings.Join(config.configFiles, ", "),
+		"watchFolder", config.FolderToWatch,
+		"watchFiles", strings.Join(config.WatchFiles, ", "),
+		"extensions", strings.Join(config.WatchExtensions, ", "),
+	}
+	for _, folder := range config.folders {
+		attrs = append(attrs, "watch:"+folder.folderName, folder.FolderToWatch+" -> "+folder.destionationFolder)
+	}
+	if config.UploadFilter != nil {
+		attrs = append(attrs, "uploadFilter", strings.Join(config.UploadFilter, ", "))
+	}
+	if config.ArchiveFilter != nil {
+		attrs = append(attrs, "archiveFilter", strings.Join(config.ArchiveFilter, ", "))
+	}
+	if config.MatchRegex != nil {
+		attrs = append(attrs, "matchRegex", config.MatchRegex.String())
+	}
+	if config.IgnoreRegex != nil {
+		attrs = append(attrs, "ignoreRegex", config.IgnoreRegex.String())
+	}
+	attrs = append(attrs,
+		"server", connection,
+		"auth", auth,
+		"destination", config.destionationFolder,
+		"uploadMode", config.UploadMode,
+		"processedFolder", config.processedFolder,
+		"tempDir", config.TempDir,
+		"failedFolder", config.failedFolder,
+		"features", strings.Join(enabledFeatures(config), ", "),
+	)
+	slog.Info("Effective configuration", attrs...)
+}
+
+// enabledFeatures lists the optional behaviours that are switched on.
+func enabledFeatures(config *Config) []string {
+	var features []string
+	add := func(enabled bool, name string) {
+		if enabled {
+			features = append(features, name)
+		}
+	}
+	add(config.TriggerFileSuffix != "", "trigger files ("+config.TriggerFileSuffix+")")
+	add(config.GroupPattern != nil, "grouping")
+	add(config.VerifyUpload != verifyNone, "verify ("+config.VerifyUpload+")")
+	add(config.WriteRemoteChecksumSidecar, "checksum sidecar ("+config.ChecksumAlgorithm+")")
+	add(config.WatchUnit == watchUnitDirectory, "directory units")
+	add(config.WatchRecursive, "recursive")
+	add(config.StabilizationDelay > 0 || len(config.StabilizationRules) > 0, "stabilization")
+	add(config.PruneEmptyDirs, "prune empty folders")
+	add(config.ExpandArchives, "expand archives")
+	add(config.encryptTo != nil, "encryption ("+filepath.Base(config.EncryptWith)+")")
+	add(config.ZeroByteFilePolicy != zeroByteUpload, "empty files: "+config.ZeroByteFilePolicy)
+	add(config.AllowedOwnerUIDs != nil || config.AllowedOwnerGIDs != nil, "owner filter")
+	add(config.OnlyProcessModifiedWithin > 0, "modified within "+config.OnlyProcessModifiedWithin.String())
+	add(config.RekeyThreshold > 0, "rekey after "+strconv.FormatUint(config.RekeyThreshold>>20, 10)+" MB")
+	add(config.WarmUpConnection, "connection warm-up")
+	add(config.KeepAliveInterval == 0, "no keepalives")
+	add(config.SftpMaxPacketKB != defaultSftpMaxPacketKB, "SFTP packets of "+strconv.Itoa(config.SftpMaxPacketKB)+" KB")
+	add(config.SftpConcurrentWrites, "concurrent SFTP writes")
+	add(config.AdaptiveConcurrency, "adaptive concurrency ("+strconv.Itoa(config.MinConcurrency)+"-"+strconv.Itoa(config.MaxConcurrency)+")")
+	add(config.shadow != nil, "shadow destination")
+	add(config.HardLinkPolicy == hardLinkSkip, "hard links uploaded once")
+	add(config.CorrelationIDs, "correlation IDs")
+	add(config.TransformCommand != "", "transform command")
+	add(config.NormalizeFilenames != normalizeOff, "file names: "+config.NormalizeFilenames)
+	add(config.FilenameEncoding != encodingUTF8, "file name encoding: "+config.FilenameEncoding)
+	add(config.ShouldUploadCommand != "", "upload predicate (rejected: "+config.ShouldUploadRejected+")")
+	add(config.RescanInterval > 0, "rescan every "+config.RescanInterval.String())
+	add(config.RetryScheduling != retrySchedulingFIFO, "retry scheduling ("+config.RetryScheduling+")")
+	add(config.AckFolder != "", "wait for acknowledgment ("+config.AckFolder+")")
+	add(config.AtomicUpload, "atomic upload")
+	add(config.ReuploadIfChangedDuringTransfer, "reupload if changed during transfer")
+	add(config.WriteRemoteReadyMarker, "ready marker ("+config.ReadyMarkerSuffix+")")
+	add(config.RemoteCollisionStrategy != collisionOverwrite, "remote collisions: "+config.RemoteCollisionStrategy)
+	add(config.RemoteCaseInsensitive, "case-insensitive remote")
+	add(config.ProcessedCollisionStrategy != collisionOverwrite, "processed collisions: "+config.ProcessedCollisionStrategy)
+	add(config.FailedCollisionStrategy != collisionOverwrite, "failed collisions: "+config.FailedCollisionStrategy)
+	add(config.RemotePathRoot != "", "remote path root ("+config.RemotePathRoot+")")
+	add(config.RemoteDirTemplate != "", "remote dir template ("+config.RemoteDirTemplate+")")
+	add(config.RunFolderTemplate != "", "run folder ("+config.RunFolderTemplate+")")
+	add(config.PartFileRecovery != partRecoveryOff, "part file recovery: "+config.PartFileRecovery)
+	add(len(config.Metadata) > 0, "metadata")
+	add(config.MirrorDeletions, "mirror deletions")
+	add(config.RemoteRetentionDays > 0, "remote retention")
+	add(config.RemoteRetentionDryRun, "remote retention dry run")
+	add(processedRetentionEnabled(config), "processed retention")
+	add(config.ProcessedRetentionDryRun, "processed retention dry run")
+	add(config.MaxFilesPerMinute > 0, "rate limit")
+	add(config.PerFileUploadDeadline > 0, "upload deadline ("+config.PerFileUploadDeadline.String()+")")
+	add(config.SelfTestInterval > 0, "self-test")
+	add(config.UploadBackend == uploadBackendExternal, "external upload ("+externalUploadProgram(config)+")")
+	add(config.PostUploadCommand != "", "post-upload command")
+	add(config.PostUploadRemoteCommand != "", "post-upload remote command")
+	add(config.StrictChown, "strict chown")
+	add(config.OnRemotePermissionDenied == onPermissionDeniedPause, "pause on permission denied")
+	add(config.EventsType != eventsNone, "events ("+config.EventsType+" "+config.EventsSubject+")")
+	return features
+}
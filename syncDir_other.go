@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// syncDir is not needed here, Windows writes a rename through with the
+// file's metadata and can't flush a folder handle.
+func syncDir(dir string) error {
+	return nil
+}
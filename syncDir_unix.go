@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import "os"
+
+// syncDir flushes the entries of the folder dir to disk, so a file renamed
+// into it survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// expandTemplate replaces "{name}" placeholders in tmpl with values[name].
+// Unknown placeholders are left untouched.
+func expandTemplate(tmpl string, values map[string]string) string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, 2*len(values))
+	for _, name := range names {
+		pairs = append(pairs, "{"+name+"}", values[name])
+	}
+	return strings.NewReplacer(pairs...).Replace(tmpl)
+}
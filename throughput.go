@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// Counters for the throughput statistics, updated by every upload. Times are
+// in nanoseconds.
+var (
+	uploadedBytes atomic.Int64
+	transferTime  atomic.Int64
+	networkTime   atomic.Int64
+	diskTime      atomic.Int64
+	activeUploads atomic.Int64
+	peakUploads   atomic.Int64
+)
+
+// startTransfer counts an upload as active and wraps the remote writer so the
+// time spent waiting for the server and the bytes sent are recorded. The
+// returned function ends the transfer.
+func startTransfer(w io.Writer) (io.Writer, func()) {
+	active := activeUploads.Add(1)
+	for {
+		peak := peakUploads.Load()
+		if active <= peak || peakUploads.CompareAndSwap(peak, active) {
+			break
+		}
+	}
+	start := time.Now()
+	return networkWriter{w}, func() {
+		transferTime.Add(int64(time.Since(start)))
+		activeUploads.Add(-1)
+	}
+}
+
+// networkWriter records the time spent writing to the server.
+type networkWriter struct {
+	w io.Writer
+}
+
+func (n networkWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	written, err := n.w.Write(p)
+	networkTime.Add(int64(time.Since(start)))
+	uploadedBytes.Add(int64(written))
+	return written, err
+}
+
+// diskReader records the time spent reading the local file.
+type diskReader struct {
+	r io.Reader
+}
+
+func (d diskReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := d.r.Read(p)
+	diskTime.Add(int64(time.Since(start)))
+	return n, err
+}
+
+// throughputAttrs returns the statistics since startup as log attributes.
+// The average rate is taken over the time spent uploading, so idle periods
+// don't dilute it.
+func throughputAttrs() []any {
+	bytes := uploadedBytes.Load()
+	transfer := time.Duration(transferTime.Load())
+	var rate float64
+	if transfer > 0 {
+		rate = float64(bytes) / (1 << 20) / transfer.Seconds()
+	}
+	return []any{
+		"bytesTotal", bytes,
+		"filesTotal", uploadedFiles.Load(),
+		"averageMBps", float64(int(rate*100)) / 100,
+		"peakConcurrentUploads", peakUploads.Load(),
+		"uploadTime", transfer.Round(time.Millisecond),
+		"networkWait", time.Duration(networkTime.Load()).Round(time.Millisecond),
+		"diskWait", time.Duration(diskTime.Load()).Round(time.Millisecond),
+	}
+}
+
+// logThroughputSummary logs the statistics of the whole run at shutdown.
+func logThroughputSummary(config *Config) {
+	if !config.LogThroughputStats {
+		return
+	}
+	attrs := append([]any{"uptime", time.Since(startTime).Round(time.Second)}, throughputAttrs()...)
+	slog.Info("Throughput summary", attrs...)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// maxTransformStderr is how much of the command's error output is kept for
+// the log.
+const maxTransformStderr = 4096
+
+// loadTransform reads TransformCommand from [general]. The transformed
+// stream is only known while it is uploaded, so appending and external
+// uploads, which work on the file itself, can't use it.
+func loadTransform(section *ini.Section, config *Config) error {
+	config.TransformCommand = section.Key("TransformCommand").String()
+	config.TransformCommandTimeout = time.Duration(section.Key("TransformCommandTimeoutSeconds").MustInt(600)) * time.Second
+	if config.TransformCommand == "" {
+		return nil
+	}
+	if config.TransformCommandTimeout <= 0 {
+		return fmt.Errorf("TransformCommandTimeoutSeconds must be at least 1")
+	}
+	if config.UploadMode == uploadModeAppend {
+		return fmt.Errorf("TransformCommand can't be used with UploadMode = append")
+	}
+	if config.UploadBackend == uploadBackendExternal {
+		return fmt.Errorf("TransformCommand can't be used with UploadBackend = external")
+	}
+	return nil
+}
+
+// transformError is a failure of TransformCommand. The file is quarantined
+// instead of retried, the same input would fail again.
+type transformError struct {
+	err    error
+	stderr string
+}
+
+func (e *transformError) Error() string {
+	if e.stderr == "" {
+		return fmt.Sprintf("TransformCommand failed: %v", e.err)
+	}
+	return fmt.Sprintf("TransformCommand failed: %v: %s", e.err, e.stderr)
+}
+
+func (e *transformError) Unwrap() error {
+	return e.err
+}
+
+// transformStream is the output of TransformCommand with the local file on
+// its stdin. The pipe between them holds only what the upload hasn't read
+// yet, so memory use doesn't grow with the file.
+type transformStream struct {
+	io.Reader
+	cmd    *exec.Cmd
+	ctx    context.Context
+	cancel context.CancelFunc
+	limit  time.Duration
+	stderr *cappedBuffer
+	waited bool
+}
+
+// startTransform starts TransformCommand with src as its stdin. {file} is
+// replaced with name in each argument after the command was split, no
+// shell is involved.
+func startTransform(src io.Reader, name string, config *Config) (*transformStream, error) {
+	args := strings.Fields(config.TransformCommand)
+	for i, arg := range args {
+		args[i] = expandTemplate(arg, map[string]string{"file": name})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.TransformCommandTimeout)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = diskReader{src}
+	stderr := &cappedBuffer{max: maxTransformStderr}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		cancel()
+		return nil, &transformError{err: err}
+	}
+	return &transformStream{Reader: stdout, cmd: cmd, ctx: ctx, cancel: cancel, limit: config.TransformCommandTimeout, stderr: stderr}, nil
+}
+
+// wait waits for the command after its output was read completely. Output
+// of a command that failed or timed out is incomplete, so the upload must
+// be discarded.
+func (t *transformStream) wait() error {
+	t.waited = true
+	err := t.cmd.Wait()
+	defer t.cancel()
+	if errors.Is(t.ctx.Err(), context.DeadlineExceeded) {
+		return &transformError{err: fmt.Errorf("timed out after %s", t.limit)}
+	}
+	if err != nil {
+		return &transformError{err: err, stderr: strings.TrimSpace(t.stderr.String())}
+	}
+	return nil
+}
+
+// stop kills the command if the upload ended before its output did.
+func (t *transformStream) stop() {
+	if t.waited {
+		return
+	}
+	t.cancel()
+	t.cmd.Wait()
+}
+
+// cappedBuffer keeps the first max bytes written to it and drops the rest.
+type cappedBuffer struct {
+	strings.Builder
+	max int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room > 0 {
+		b.Builder.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
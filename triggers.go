@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Values of the TriggerFileAction setting.
+const (
+	triggerActionDelete  = "delete"
+	triggerActionArchive = "archive"
+)
+
+// With TriggerFileSuffix set, a data file is only complete once its trigger
+// file "<data file><suffix>" exists. Either file may arrive first.
+
+// triggerTarget maps a created file to the data file it concerns and reports
+// whether that data file is complete, i.e. both files are present.
+func triggerTarget(path string, config *Config) (string, bool) {
+	if strings.HasSuffix(path, config.TriggerFileSuffix) {
+		dataPath := strings.TrimSuffix(path, config.TriggerFileSuffix)
+		return dataPath, fileExists(dataPath)
+	}
+	return path, fileExists(path + config.TriggerFileSuffix)
+}
+
+// hasTriggerFile reports whether a data file may be processed. Without
+// trigger files every data file may.
+func hasTriggerFile(dataPath string, config *Config) bool {
+	return config.TriggerFileSuffix == "" || fileExists(dataPath+config.TriggerFileSuffix)
+}
+
+// finishTriggerFile removes or archives the trigger file of a data file that
+// has been processed.
+func finishTriggerFile(dataPath string, config *Config) error {
+	if config.TriggerFileSuffix == "" {
+		return nil
+	}
+
+	triggerPath := dataPath + config.TriggerFileSuffix
+	if config.TriggerFileAction == triggerActionArchive {
+		// next to its data file, named like processed files
+		target, err := moveLocalFile(triggerPath, processedDirFor(dataPath, config), config.ProcessedCollisionStrategy)
+		if err == nil {
+			slog.Debug("Archived trigger file", "file", triggerPath, "target", target)
+			return nil
+		}
+		if !errors.Is(err, errNameTaken) {
+			return fmt.Errorf("failed to archive trigger file: %w", err)
+		}
+		slog.Debug("Trigger file already archived, deleting it", "file", triggerPath)
+	}
+
+	err := removeSourceFile(triggerPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete trigger file: %w", err)
+	}
+	slog.Debug("Removed trigger file", "file", triggerPath)
+	return nil
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchiveTriggerFile(t *testing.T) {
+	quietLogs(t)
+	folder := t.TempDir()
+	config := testConfig(t, folder, map[string]string{
+		"general.TriggerFileSuffix":          ".done",
+		"general.TriggerFileAction":          triggerActionArchive,
+		"general.WatchRecursive":             "true",
+		"general.ProcessedCollisionStrategy": collisionCounter,
+	})
+	os.MkdirAll(filepath.Join(folder, "2024"), 0755)
+	dataPath := filepath.Join(folder, "2024", "data.csv")
+	archived := filepath.Join(folder, "processed", "2024", "data.csv.done")
+
+	for _, want := range []string{archived, filepath.Join(folder, "processed", "2024", "data.csv_1.done")} {
+		writeFile(t, dataPath+".done", "")
+		err := finishTriggerFile(dataPath, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(want); err != nil {
+			t.Errorf("trigger file not archived as %s: %v", want, err)
+		}
+		if _, err := os.Stat(dataPath + ".done"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("trigger file is still in the watch folder: %v", err)
+		}
+		// MirrorDeletions must not take the move for a deletion by the user
+		if !wasRemovedByTool(dataPath + ".done") {
+			t.Error("archiving the trigger file was not recorded as a removal by the tool")
+		}
+	}
+
+	config.ProcessedCollisionStrategy = collisionSkip
+	writeFile(t, dataPath+".done", "")
+	err := finishTriggerFile(dataPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dataPath + ".done"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("trigger file archived before is not deleted under skip: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"time"
+)
+
+// uploadDeadlineError reports an upload cancelled by PerFileUploadDeadline.
+type uploadDeadlineError struct {
+	deadline time.Duration
+	written  int64
+}
+
+func (e *uploadDeadlineError) Error() string {
+	return fmt.Sprintf("upload did not finish within %s, %d bytes transferred", e.deadline, e.written)
+}
+
+// deadlineWriter fails the first write after the deadline, which cancels the
+// copy and lets the caller clean up the remote partial file.
+type deadlineWriter struct {
+	w        io.Writer
+	limit    time.Duration
+	deadline time.Time
+	written  int64
+}
+
+func newDeadlineWriter(w io.Writer, limit time.Duration) *deadlineWriter {
+	return &deadlineWriter{w: w, limit: limit, deadline: time.Now().Add(limit)}
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	if time.Now().After(d.deadline) {
+		return 0, &uploadDeadlineError{deadline: d.limit, written: d.written}
+	}
+	n, err := d.w.Write(p)
+	d.written += int64(n)
+	return n, err
+}
+
+// deferSlowFile moves a file whose upload hit the deadline into SlowFolder,
+// out of the way of the files behind it.
+func deferSlowFile(path string, config *Config) error {
+	target, err := moveLocalFile(path, config.slowFolder, config.CollisionStrategy)
+	if err != nil {
+		return fmt.Errorf("failed to move file to 'slow' folder: %w", err)
+	}
+	forgetRetry(path)
+	deferredFiles.Add(1)
+	slog.Warn("File moved to 'slow' folder after hitting the upload deadline", "file", path, "target", target)
+	pruneEmptyDirs(filepath.Dir(path), config)
+	return nil
+}
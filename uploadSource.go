@@ -0,0 +1,27 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// uploadSource is what an uploader reads. Files in the watch folder are
+// sources with their open file, archive members are streamed straight out
+// of their archive and have none.
+type uploadSource struct {
+	// name is the local path, for logs, TransformCommand and metadata
+	name string
+	r    io.Reader
+	info os.FileInfo
+	file *os.File
+}
+
+func fileSource(file *os.File, info os.FileInfo) uploadSource {
+	return uploadSource{name: file.Name(), r: file, info: info, file: file}
+}
+
+// streamSource is a source without a local file. It can be read only once,
+// so nothing may need its content before the upload.
+func streamSource(name string, r io.Reader, info os.FileInfo) uploadSource {
+	return uploadSource{name: name, r: r, info: info}
+}
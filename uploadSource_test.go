@@ -0,0 +1,121 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// patternReader returns size bytes of a repeating pattern, which gzip
+// shrinks to almost nothing.
+func patternReader(size int64) io.Reader {
+	pattern := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	return io.LimitReader(&repeatReader{pattern: pattern}, size)
+}
+
+type repeatReader struct {
+	pattern []byte
+	offset  int
+}
+
+func (r *repeatReader) Read(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		copied := copy(b[n:], r.pattern[r.offset:])
+		n += copied
+		r.offset = (r.offset + copied) % len(r.pattern)
+	}
+	return n, nil
+}
+
+// writeTarGz writes an archive with a single member of size bytes.
+func writeTarGz(t *testing.T, path, member string, size int64) {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+	err = tw.WriteHeader(&tar.Header{Name: member, Mode: 0644, Size: size, Typeflag: tar.TypeReg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.Copy(tw, patternReader(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []io.Closer{tw, gz} {
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestLargeMemberStreamsWithoutTempDir uploads an archive member larger
+// than any buffer, encrypted and verified by reading it back, while TempDir
+// doesn't exist. Anything spooling the member to disk would fail.
+func TestLargeMemberStreamsWithoutTempDir(t *testing.T) {
+	const size = 64 << 20
+	quietLogs(t)
+	partner, err := openpgp.NewEntity("Partner", "", "partner@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := t.TempDir()
+	settings := startSftpServer(t, remote, nil)
+	tempDir := t.TempDir()
+	settings["paths.TempDir"] = tempDir
+	settings["paths.EncryptWith"] = writePublicKey(t, t.TempDir(), partner)
+	settings["general.ExpandArchives"] = "true"
+	settings["general.WatchFileExtension"] = ".csv"
+	settings["general.VerifyUpload"] = verifyReadback
+
+	watchFolder := t.TempDir()
+	archive := filepath.Join(watchFolder, "big.tar.gz")
+	writeTarGz(t, archive, "big.csv", size)
+	config := testConfig(t, watchFolder, settings)
+	err = os.Remove(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sftpClient, sshClient, _, err := dialServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sftpClient.Close()
+	err = processArchive(archive, sftpClient, sshClient, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploaded, err := os.Open(filepath.Join(remote, filepath.FromSlash(config.destionationFolder), "big.csv.gpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uploaded.Close()
+	message, err := openpgp.ReadMessage(uploaded, openpgp.EntityList{partner}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := sha256.New()
+	n, err := io.Copy(got, message.UnverifiedBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.New()
+	io.Copy(want, patternReader(size))
+	if n != size || !bytes.Equal(got.Sum(nil), want.Sum(nil)) {
+		t.Errorf("the uploaded member differs: %d bytes, want %d", n, size)
+	}
+}
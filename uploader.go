@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// uploader sends a source to the destination UploadBackend names. It
+// returns the SHA-256 of the data sent when verification, an upload event
+// or PostUploadCommand needs it, nil otherwise.
+type uploader interface {
+	upload(source uploadSource, remotePath string) ([]byte, error)
+}
+
+// newUploader returns the uploader of config.UploadBackend. The clients are
+// nil for cloud storage, which opens no SFTP session.
+func newUploader(sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) uploader {
+	switch {
+	case config.cloud != nil:
+		return cloudUploader{config}
+	case config.UploadBackend == uploadBackendExternal:
+		return externalUploader{sftpClient, config}
+	default:
+		return sftpUploader{sftpClient, sshClient, config}
+	}
+}
+
+// uploadFile uploads file with the uploader of config.UploadBackend.
+func uploadFile(file *os.File, remotePath string, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) ([]byte, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file: %w", err)
+	}
+	return newUploader(sftpClient, sshClient, config).upload(fileSource(file, info), remotePath)
+}
+
+type sftpUploader struct {
+	sftpClient *sftp.Client
+	sshClient  *ssh.Client
+	config     *Config
+}
+
+func (u sftpUploader) upload(source uploadSource, remotePath string) ([]byte, error) {
+	return copyToSftp(source, remotePath, u.sftpClient, u.sshClient, u.config)
+}
+
+// externalUploader hands the local file to ExternalUploadCommand, which
+// reads it itself, so there is no checksum of what was sent.
+type externalUploader struct {
+	sftpClient *sftp.Client
+	config     *Config
+}
+
+func (u externalUploader) upload(source uploadSource, remotePath string) ([]byte, error) {
+	if source.file == nil {
+		return nil, fmt.Errorf("ExternalUploadCommand needs a local file, %s has none", source.name)
+	}
+	return nil, runExternalUpload(source.file.Name(), remotePath, u.sftpClient, u.config)
+}
+
+// cloudUploader writes the source as an object of the [cloud] container
+// through the same transform, encryption and hashes as an SFTP upload. An
+// object is only committed once all of it was written, whatever goes wrong
+// before that aborts it and leaves nothing behind.
+type cloudUploader struct {
+	config *Config
+}
+
+func (u cloudUploader) upload(source uploadSource, remotePath string) ([]byte, error) {
+	config := u.config
+	waitForUploadSlot(config)
+	object, err := config.cloud.newObject(strings.TrimPrefix(remotePath, "/"))
+	if err != nil {
+		slog.Error("Failed to start upload to cloud storage", "object", remotePath, "error", err)
+		return nil, err
+	}
+
+	hash := sha256.New()
+	var hashes []io.Writer
+	hashed := config.PostUploadCommand != "" || config.EventsType != eventsNone
+	if hashed {
+		hashes = append(hashes, hash)
+	}
+	err = writeUpload(object, source, hashes, config)
+	if err != nil {
+		object.abort()
+	} else {
+		err = object.commit()
+	}
+	if err != nil {
+		slog.Error("Failed to upload file to cloud storage", "file", source.name, "object", remotePath, "error", err)
+		return nil, err
+	}
+
+	uploadedFiles.Add(1)
+	slog.Info("File uploaded successfully", "file", source.name, "remote", remotePath)
+	if !hashed {
+		return nil, nil
+	}
+	return hash.Sum(nil), nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Values of the VerifyUpload setting.
+const (
+	verifyNone     = "none"
+	verifyReadback = "readback"
+	verifyChecksum = "checksum"
+)
+
+// verifyUpload compares the remote copy of a file with the SHA-256 computed
+// while uploading it. In checksum mode the server hashes the file itself via
+// the check-file extension; servers without it are verified by reading the
+// file back.
+func verifyUpload(sshClient *ssh.Client, sftpClient *sftp.Client, remotePath string, localSum []byte, config *Config) error {
+	var remoteSum []byte
+	if config.VerifyUpload == verifyChecksum {
+		if serverSupportsCheckFile(sftpClient) {
+			sum, err := remoteCheckFile(sshClient, remotePath)
+			if err != nil {
+				slog.Warn("Server-side checksum failed, falling back to readback", "path", remotePath, "error", err)
+			} else {
+				remoteSum = sum
+			}
+		} else {
+			slog.Debug("Server does not support check-file, verifying by readback")
+		}
+	}
+
+	if remoteSum == nil {
+		sum, err := readbackChecksum(sftpClient, remotePath, config)
+		if err != nil {
+			return fmt.Errorf("failed to read back %s: %w", remotePath, err)
+		}
+		remoteSum = sum
+	}
+
+	if !bytes.Equal(localSum, remoteSum) {
+		return fmt.Errorf("checksum mismatch for %s: local %s, remote %s", remotePath, hex.EncodeToString(localSum), hex.EncodeToString(remoteSum))
+	}
+	slog.Info("Upload verified", "path", remotePath)
+	return nil
+}
+
+func serverSupportsCheckFile(sftpClient *sftp.Client) bool {
+	if _, ok := sftpClient.HasExtension("check-file"); ok {
+		return true
+	}
+	_, ok := sftpClient.HasExtension("check-file-name")
+	return ok
+}
+
+// remoteCheckFile asks the server for the SHA-256 of a whole file using the
+// check-file-name request from draft-ietf-secsh-filexfer-extensions.
+func remoteCheckFile(sshClient *ssh.Client, remotePath string) ([]byte, error) {
+	channel, err := openRawSftpChannel(sshClient)
+	if err != nil {
+		return nil, err
+	}
+	defer channel.Close()
+
+	body := appendSftpString(nil, "check-file-name")
+	body = appendSftpString(body, remotePath)
+	body = appendSftpString(body, "sha256")
+	body = binary.BigEndian.AppendUint64(body, 0) // start offset
+	body = binary.BigEndian.AppendUint64(body, 0) // length, 0 means the whole file
+	body = binary.BigEndian.AppendUint32(body, 0) // block size, 0 means a single hash
+
+	typ, reply, err := channel.request(sshFxpExtended, body)
+	if err != nil {
+		return nil, err
+	}
+	if typ != sshFxpExtendedReply {
+		return nil, fmt.Errorf("unexpected check-file response type %d", typ)
+	}
+
+	// string "check-file", string hash-algo-used, byte hash[]
+	_, reply, ok := readSftpString(reply)
+	if !ok {
+		return nil, fmt.Errorf("malformed check-file response")
+	}
+	algorithm, hash, ok := readSftpString(reply)
+	if !ok {
+		return nil, fmt.Errorf("malformed check-file response")
+	}
+	if algorithm != "sha256" || len(hash) != sha256.Size {
+		return nil, fmt.Errorf("server answered with %s instead of sha256", algorithm)
+	}
+	return hash, nil
+}
+
+// readbackChecksum downloads the remote file and hashes it on the fly.
+func readbackChecksum(sftpClient *sftp.Client, remotePath string, config *Config) ([]byte, error) {
+	remoteFile, err := sftpClient.Open(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	defer remoteFile.Close()
+
+	hasher := sha256.New()
+	_, err = copyBuffered(hasher, remoteFile, config)
+	if err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// fsnotify can only watch directories, so explicitly listed WatchFiles are
+// watched through their parent directories and events are filtered by path.
+
+// watchFileDirs returns the parent directories of all WatchFiles that are not
+// already covered by FolderToWatch.
+func watchFileDirs(config *Config) []string {
+	seen := map[string]bool{}
+	if config.FolderToWatch != "" {
+		seen[filepath.Clean(config.FolderToWatch)] = true
+	}
+
+	var dirs []string
+	for _, file := range config.WatchFiles {
+		dir := filepath.Dir(file)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// isWatchedFile reports whether path is one of the explicitly listed WatchFiles.
+func isWatchedFile(path string, config *Config) bool {
+	path = filepath.Clean(path)
+	for _, file := range config.WatchFiles {
+		if file == path {
+			return true
+		}
+	}
+	return false
+}
+
+// isInWatchFolder reports whether path is a direct child of FolderToWatch,
+// or with WatchRecursive anywhere below it outside the internal folders.
+func isInWatchFolder(path string, config *Config) bool {
+	if config.WatchRecursive {
+		_, ok := relativeToWatchFolder(path, config)
+		return ok && !isInternalFolder(path, config)
+	}
+	return config.FolderToWatch != "" && filepath.Dir(filepath.Clean(path)) == filepath.Clean(config.FolderToWatch)
+}
+
+// uploadWatchedFiles ships the current content of every explicitly watched
+// file for --once and returns how many failed. Files that don't exist are
+// left out.
+func uploadWatchedFiles(sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) int {
+	failed := 0
+	for _, path := range config.WatchFiles {
+		if stopRequested() {
+			break
+		}
+		err := uploadWatchedFile(path, sftpClient, sshClient, config)
+		if err != nil {
+			slog.Error("Failed to upload watched file", "file", path, "error", err)
+			failed++
+		}
+	}
+	return failed
+}
+
+// uploadWatchedFile ships the current content of an explicitly watched file,
+// or only the new data in append mode. Unlike files in FolderToWatch it stays
+// where it is, so no post-upload action is applied.
+func uploadWatchedFile(path string, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) error {
+	if config.UploadMode == uploadModeAppend {
+		return appendNewData(path, sftpClient, config)
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Debug("Watched file is gone, nothing to upload", "file", path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	slog.Info("Watched file changed", "file", path)
+	_, err = uploadFile(file, remotePathFor(path, config), sftpClient, sshClient, config)
+	if err != nil {
+		return fmt.Errorf("error copying file to SFTP server: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Backoff bounds used while waiting for a missing FolderToWatch to appear.
+const (
+	watchFolderInitialPoll = time.Second
+	watchFolderMaxPoll     = 30 * time.Second
+)
+
+// ensureWatchFolder makes sure every watch folder exists before it is
+// scanned and watched. Depending on the config a missing folder is created,
+// waited for (e.g. until an automounter brought the volume up) or reported as
+// an error.
+func ensureWatchFolder(config *Config) error {
+	for _, folder := range watchFolders(config) {
+		err := ensureFolderExists(folder)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ensureFolderExists(config *Config) error {
+	exists, err := folderExists(config.FolderToWatch)
+	if err != nil || exists {
+		return err
+	}
+
+	if config.CreateWatchFolder {
+		err = os.MkdirAll(config.FolderToWatch, 0755)
+		if err != nil {
+			return fmt.Errorf("failed to create watch folder: %w", err)
+		}
+		slog.Info("Created missing watch folder", "folder", config.FolderToWatch)
+		return nil
+	}
+
+	if !config.WaitForWatchFolder {
+		return fmt.Errorf("watch folder %s does not exist", config.FolderToWatch)
+	}
+
+	slog.Warn("Watch folder does not exist yet, waiting for it", "folder", config.FolderToWatch, "maxWait", config.WatchFolderMaxWait)
+	deadline := time.Now().Add(config.WatchFolderMaxWait)
+	delay := watchFolderInitialPoll
+	for time.Now().Before(deadline) {
+		err = sleepUnlessStopped(min(delay, time.Until(deadline)))
+		if err != nil {
+			return err
+		}
+
+		exists, err = folderExists(config.FolderToWatch)
+		if err != nil {
+			return err
+		}
+		if exists {
+			slog.Info("Watch folder appeared", "folder", config.FolderToWatch)
+			return nil
+		}
+		delay = min(delay*2, watchFolderMaxPoll)
+	}
+	return fmt.Errorf("watch folder %s did not appear within %s", config.FolderToWatch, config.WatchFolderMaxWait)
+}
+
+func folderExists(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check watch folder: %w", err)
+	}
+	if !info.IsDir() {
+		return false, fmt.Errorf("watch folder %s is not a directory", path)
+	}
+	return true, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// watchFolderTarget is what FolderToWatch resolved to when its watch was
+// added. It is only used from the main goroutine.
+var watchFolderTarget string
+
+// resolveWatchFolder remembers the current target of FolderToWatch.
+func resolveWatchFolder(config *Config) {
+	if !config.ResolveWatchSymlink || config.FolderToWatch == "" {
+		return
+	}
+	target, err := filepath.EvalSymlinks(config.FolderToWatch)
+	if err != nil {
+		slog.Warn("Failed to resolve watch folder", "folder", config.FolderToWatch, "error", err)
+		return
+	}
+	watchFolderTarget = target
+	if target != filepath.Clean(config.FolderToWatch) {
+		slog.Info("Watch folder is a symlink", "folder", config.FolderToWatch, "target", target)
+	}
+}
+
+// checkWatchSymlink re-adds the watch when FolderToWatch is a symlink that
+// was repointed. The kernel watches the directory the link pointed to when
+// the watch was added, so without this no events arrive from the new target.
+func checkWatchSymlink(watcher *fsnotify.Watcher, sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) {
+	if !config.ResolveWatchSymlink || config.FolderToWatch == "" {
+		return
+	}
+	target, err := filepath.EvalSymlinks(config.FolderToWatch)
+	if err != nil {
+		slog.Warn("Failed to resolve watch folder", "folder", config.FolderToWatch, "error", err)
+		return
+	}
+	if target == watchFolderTarget {
+		return
+	}
+
+	slog.Info("Watch folder symlink was repointed", "folder", config.FolderToWatch, "from", watchFolderTarget, "to", target)
+	err = watcher.Remove(config.FolderToWatch)
+	if err != nil {
+		slog.Debug("Failed to remove old watch", "folder", config.FolderToWatch, "error", err)
+	}
+	err = watcher.Add(config.FolderToWatch)
+	if err != nil {
+		alert("Failed to watch folder: " + err.Error())
+		return
+	}
+	watchFolderTarget = target
+
+	// files that arrived in the new target before the watch was moved
+	_, err = processExistingFiles(config.FolderToWatch, sftpClient, sshClient, *config)
+	if err != nil {
+		alert("Failed to process existing files: " + err.Error())
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/ini.v1"
+)
+
+// Values of ZeroByteFilePolicy and ZeroByteWaitFallback.
+const (
+	zeroByteUpload = "upload"
+	zeroByteSkip   = "skip"
+	zeroByteWait   = "wait"
+)
+
+// pendingZeroByte holds the empty files waiting for content and when they
+// were first seen. It is only used from the main goroutine.
+var pendingZeroByte = map[string]time.Time{}
+
+// loadZeroBytePolicy reads how empty files are handled.
+func loadZeroBytePolicy(section *ini.Section, config *Config) error {
+	var err error
+	config.ZeroByteFilePolicy, err = oneOf(section.Key("ZeroByteFilePolicy"), zeroByteUpload, zeroByteSkip, zeroByteWait)
+	if err != nil {
+		return err
+	}
+	config.ZeroByteWaitFallback, err = oneOf(section.Key("ZeroByteWaitFallback"), zeroByteUpload, zeroByteSkip)
+	if err != nil {
+		return err
+	}
+	config.ZeroByteWaitTimeout = section.Key("ZeroByteWaitTimeout").MustDuration(time.Minute)
+	if config.ZeroByteFilePolicy == zeroByteWait && config.ZeroByteWaitTimeout <= 0 {
+		return fmt.Errorf("ZeroByteWaitTimeout must be positive, got %s", config.ZeroByteWaitTimeout)
+	}
+	return nil
+}
+
+// acceptZeroByte decides whether the empty file path is uploaded now. With
+// the wait policy the file is held back until it gets content, which
+// checkZeroByteFiles notices, or until ZeroByteWaitTimeout passes and
+// ZeroByteWaitFallback applies.
+func acceptZeroByte(path string, config *Config) bool {
+	policy := config.ZeroByteFilePolicy
+	if policy == zeroByteWait {
+		since, waiting := pendingZeroByte[path]
+		if !waiting {
+			pendingZeroByte[path] = time.Now()
+			deferredFiles.Add(1)
+			slog.Info("File is empty, waiting for content", "file", path, "timeout", config.ZeroByteWaitTimeout)
+			return false
+		}
+		if time.Since(since) < config.ZeroByteWaitTimeout {
+			return false
+		}
+		delete(pendingZeroByte, path)
+		policy = config.ZeroByteWaitFallback
+		slog.Info("File is still empty, applying ZeroByteWaitFallback", "file", path, "fallback", policy)
+	}
+	if policy == zeroByteSkip {
+		logSkip(path, skipZeroByte, config)
+		return false
+	}
+	return true
+}
+
+// checkZeroByteFiles hands empty files that got content, or waited long
+// enough, back to processFile.
+func checkZeroByteFiles(sftpClient *sftp.Client, sshClient *ssh.Client, config *Config) {
+	for path, since := range pendingZeroByte {
+		info, err := os.Stat(path)
+		if err != nil {
+			delete(pendingZeroByte, path)
+			continue
+		}
+		if info.Size() == 0 && time.Since(since) < config.ZeroByteWaitTimeout {
+			continue
+		}
+
+		err = processFile(path, sftpClient, sshClient, config)
+		if err != nil {
+			scheduleRetry(path, err, config)
+		}
+	}
+}